@@ -1,11 +1,13 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"time"
 
 	"google.golang.org/grpc"
@@ -15,13 +17,22 @@ import (
 	"crypto/x509"
 	"io/ioutil"
 
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/archive"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/audit"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/clientcert"
 	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/config"
 	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
 	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/egress"
 	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/ingress"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/loggregator"
 	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/monitor"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/otlp"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/plaintext"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/prometheus"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/syslog"
 	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/tokenchecker"
 	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/unmarshal"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/webhook"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 )
@@ -53,27 +64,192 @@ func main() {
 		log.Fatalf("failed to listen on port %d: %v", c.EgressPort, err)
 	}
 
-	uaaTLSConfig := &tls.Config{}
-	err = setCACert(uaaTLSConfig, c.UaaCA)
+	authMode, err := egress.ParseAuthMode(c.AuthMode)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	tokenChecker := tokenchecker.New(&tokenchecker.TokenCheckerConfig{
-		UaaURL:      c.UaaURL,
-		TLSConfig:   uaaTLSConfig,
-		UaaClient:   c.UaaClientIdentity,
-		UaaPassword: c.UaaClientPassword,
-		Authority:   "bosh.system_metrics.read",
-	})
+	var tokenChecker checker
+	if authMode != egress.AuthMTLS {
+		var stopTokenChecker func()
+		tokenChecker, stopTokenChecker, err = newTokenChecker(c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer stopTokenChecker()
+	}
+
+	distribution, err := egress.ParseDistribution(c.Distribution)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	slowConsumerAction, err := egress.ParseSlowConsumerAction(c.SlowConsumerAction)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	messages := make(chan *definitions.Event, 10000)
+	alerts := make(chan *definitions.Event, 10000)
+
+	ingressOpts := []ingress.IngestorOpt{ingress.WithAlertOutput(alerts)}
+	if c.IngressShedHeartbeats {
+		ingressOpts = append(ingressOpts, ingress.WithHeartbeatShedding())
+	}
+	i := ingress.New(c.IngressPort, unmarshal.Event, messages, ingressOpts...)
+	serverOpts := []egress.ServerOpt{
+		egress.WithAlerts(alerts),
+		egress.WithSharedEncoding(),
+		egress.WithDistribution(distribution),
+		egress.WithMaxSubscriptionBufferSize(c.MaxSubscriptionBufferSize),
+		egress.WithSubscriptionBufferBudget(c.SubscriptionBufferBudget),
+		egress.WithSlowConsumerPolicy(egress.SlowConsumerPolicy{
+			Threshold: c.SlowConsumerThreshold,
+			Action:    slowConsumerAction,
+		}),
+	}
+	if c.SubscriptionBufferSize > 0 {
+		serverOpts = append(serverOpts, egress.WithSubscriptionBufferSize(c.SubscriptionBufferSize))
+	}
+	if c.DispatchShards > 0 {
+		serverOpts = append(serverOpts, egress.WithDispatchShards(c.DispatchShards))
+	}
+	if c.AlertBufferSize > 0 {
+		serverOpts = append(serverOpts, egress.WithAlertBufferSize(c.AlertBufferSize))
+	}
+	if c.TokenRevalidationInterval > 0 {
+		serverOpts = append(serverOpts, egress.WithTokenRevalidation(c.TokenRevalidationInterval))
+	}
+	if c.TeamScopes {
+		serverOpts = append(serverOpts, egress.WithTeamScopes("bosh.system_metrics.read"))
+	}
+	if c.SubscriptionOwnership {
+		serverOpts = append(serverOpts, egress.WithSubscriptionOwnership(egress.SharingPolicy{
+			Subscriptions: c.SharedSubscriptions,
+			Clients:       c.SharedClients,
+		}))
+	}
+
+	egressTLSConfig := tlsConfig
+	if authMode != egress.AuthUAA {
+		authorizer, err := clientcert.New(c.ClientCommonNames, c.ClientSANs, c.ClientSPIFFEIDs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverOpts = append(serverOpts, egress.WithClientCertAuth(authMode, authorizer))
+
+		egressTLSConfig, err = newEgressTLSConfig(tlsConfig, c.ClientCA, authMode)
+		if err != nil {
+			log.Fatalf("unable to configure client certificate auth: %s", err)
+		}
+	}
+
+	var prometheusServer *http.Server
+	if c.PrometheusPort > 0 {
+		var exporterOpts []prometheus.ExporterOpt
+		if c.PrometheusSeriesTTL > 0 {
+			exporterOpts = append(exporterOpts, prometheus.WithTTL(c.PrometheusSeriesTTL))
+		}
+		exporter := prometheus.New(exporterOpts...)
+		serverOpts = append(serverOpts, egress.WithSinks(exporter))
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", exporter)
+		prometheusServer = &http.Server{
+			Addr:      fmt.Sprintf(":%d", c.PrometheusPort),
+			Handler:   mux,
+			TLSConfig: tlsConfig,
+		}
+	}
+
+	var otlpExporter *otlp.Exporter
+	if c.OtlpEndpoint != "" {
+		otlpExporter, err = newOTLPExporter(c)
+		if err != nil {
+			log.Fatalf("unable to create otlp exporter: %s", err)
+		}
+		serverOpts = append(serverOpts, egress.WithSinks(otlpExporter))
+	}
+
+	var loggregatorSink *loggregator.Sink
+	if c.LoggregatorAddr != "" {
+		loggregatorTLSConfig, err := newTLSConfig(c.LoggregatorCert, c.LoggregatorKey)
+		if err != nil {
+			log.Fatalf("unable to parse loggregator certs: %s", err)
+		}
+		loggregatorTLSConfig.ServerName = "metron"
+		err = setCACert(loggregatorTLSConfig, c.LoggregatorCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		loggregatorSink, err = loggregator.New(c.LoggregatorAddr, loggregatorTLSConfig)
+		if err != nil {
+			log.Fatalf("unable to create loggregator sink: %s", err)
+		}
+		serverOpts = append(serverOpts, egress.WithSinks(loggregatorSink))
+	}
+
+	var plaintextSinks []*plaintext.Sink
+	if c.StatsDAddr != "" {
+		sink, err := newPlaintextSink(plaintext.StatsD, c.StatsDNetwork, c.StatsDAddr, c.StatsDTemplate, c.StatsDTags)
+		if err != nil {
+			log.Fatalf("unable to create statsd sink: %s", err)
+		}
+		plaintextSinks = append(plaintextSinks, sink)
+	}
+	if c.GraphiteAddr != "" {
+		sink, err := newPlaintextSink(plaintext.Graphite, c.GraphiteNetwork, c.GraphiteAddr, c.GraphiteTemplate, c.GraphiteTags)
+		if err != nil {
+			log.Fatalf("unable to create graphite sink: %s", err)
+		}
+		plaintextSinks = append(plaintextSinks, sink)
+	}
+	for _, sink := range plaintextSinks {
+		serverOpts = append(serverOpts, egress.WithSinks(sink))
+	}
+
+	var webhookSink *webhook.Sink
+	if len(c.WebhookRoutes) > 0 {
+		webhookSink, err = newWebhookSink(c)
+		if err != nil {
+			log.Fatalf("unable to create webhook sink: %s", err)
+		}
+		serverOpts = append(serverOpts, egress.WithSinks(webhookSink))
+	}
+
+	var syslogSink *syslog.Sink
+	if c.SyslogAddr != "" {
+		syslogSink, err = newSyslogSink(c)
+		if err != nil {
+			log.Fatalf("unable to create syslog sink: %s", err)
+		}
+		serverOpts = append(serverOpts, egress.WithSinks(syslogSink))
+	}
+
+	var archiveSink *archive.Sink
+	if c.ArchiveDir != "" {
+		archiveSink, err = newArchiveSink(c)
+		if err != nil {
+			log.Fatalf("unable to create archive sink: %s", err)
+		}
+		serverOpts = append(serverOpts, egress.WithSinks(archiveSink))
+	}
 
-	i := ingress.New(c.IngressPort, unmarshal.Event, messages)
-	e := egress.NewServer(messages, tokenChecker)
+	var auditLogger *audit.Logger
+	if c.AuditLogDestination != "" {
+		auditLogger, err = newAuditLogger(c)
+		if err != nil {
+			log.Fatalf("unable to create audit log: %s", err)
+		}
+		serverOpts = append(serverOpts, egress.WithAuditLog(auditLogger))
+	}
+
+	e := egress.NewServer(messages, tokenChecker, serverOpts...)
 
 	grpcServer := grpc.NewServer(
-		grpc.Creds(credentials.NewTLS(tlsConfig)),
+		grpc.Creds(credentials.NewTLS(egressTLSConfig)),
+		grpc.ForceServerCodec(egress.Codec()),
 		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
 			MinTime:             5 * time.Second,
 			PermitWithoutStream: true,
@@ -84,6 +260,38 @@ func main() {
 	)
 	definitions.RegisterEgressServer(grpcServer, e)
 
+	var httpServer *http.Server
+	if c.HTTPEgressPort > 0 {
+		httpServer = &http.Server{
+			Addr:      fmt.Sprintf(":%d", c.HTTPEgressPort),
+			Handler:   e.HTTPHandler(),
+			TLSConfig: egressTLSConfig,
+		}
+	}
+
+	var stopSinks []func()
+	if otlpExporter != nil {
+		stopSinks = append(stopSinks, otlpExporter.Start())
+	}
+	if loggregatorSink != nil {
+		stopSinks = append(stopSinks, loggregatorSink.Start())
+	}
+	for _, sink := range plaintextSinks {
+		stopSinks = append(stopSinks, sink.Start())
+	}
+	if webhookSink != nil {
+		stopSinks = append(stopSinks, webhookSink.Start())
+	}
+	if syslogSink != nil {
+		stopSinks = append(stopSinks, syslogSink.Start())
+	}
+	if archiveSink != nil {
+		stopSinks = append(stopSinks, archiveSink.Start())
+	}
+	stopAuditLog := func() {}
+	if auditLogger != nil {
+		stopAuditLog = auditLogger.Start()
+	}
 	stopReadingMessages := i.Start()
 	stopWritingMessages := e.Start()
 
@@ -91,14 +299,44 @@ func main() {
 		fmt.Println("process shutting down, stop accepting messages from bosh health monitor...")
 		stopReadingMessages()
 		close(messages)
+		close(alerts)
 
 		fmt.Println("drain remaining messages...")
 		stopWritingMessages()
+		for _, stop := range stopSinks {
+			stop()
+		}
 		grpcServer.GracefulStop()
+		if httpServer != nil {
+			httpServer.Close()
+		}
+		if prometheusServer != nil {
+			prometheusServer.Close()
+		}
+		stopAuditLog()
 
 		fmt.Println("DONE")
 	}()
 
+	if httpServer != nil {
+		go func() {
+			log.Printf("bosh system metrics http server listening on %s\n", httpServer.Addr)
+			err := httpServer.ListenAndServeTLS("", "")
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("unable to serve http server: %s", err)
+			}
+		}()
+	}
+	if prometheusServer != nil {
+		go func() {
+			log.Printf("prometheus metrics endpoint listening on %s\n", prometheusServer.Addr)
+			err := prometheusServer.ListenAndServeTLS("", "")
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("unable to serve prometheus metrics: %s", err)
+			}
+		}()
+	}
+
 	go monitor.NewHealth(uint32(c.HealthPort)).Start()
 	go monitor.NewProfiler(uint32(c.PProfPort)).Start()
 
@@ -126,20 +364,282 @@ func newTLSConfig(certFile, keyFile string) (*tls.Config, error) {
 	return tlsConfig, err
 }
 
+// newEgressTLSConfig returns a copy of the server TLS configuration
+// that verifies client certificates against the CA. Client
+// certificates are optional when tokens are accepted instead.
+func newEgressTLSConfig(tlsConfig *tls.Config, caPath string, m egress.AuthMode) (*tls.Config, error) {
+	pool, err := loadCertPool(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	egressTLSConfig := tlsConfig.Clone()
+	egressTLSConfig.ClientCAs = pool
+	egressTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if m == egress.AuthUAAOrMTLS {
+		egressTLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return egressTLSConfig, nil
+}
+
+type checker interface {
+	CheckToken(token string) error
+}
+
+// newTokenChecker returns the token checker for the configured token
+// validation and a function that stops it.
+func newTokenChecker(c config.Config) (checker, func(), error) {
+	switch c.TokenValidation {
+	case "", "check_token":
+		uaaTLSConfig := &tls.Config{}
+		err := setCACert(uaaTLSConfig, c.UaaCA)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var opts []tokenchecker.TokenCheckerOpt
+		if c.UaaTimeout > 0 {
+			opts = append(opts, tokenchecker.WithTimeout(c.UaaTimeout))
+		}
+		if c.UaaBreakerThreshold > 0 {
+			opts = append(opts, tokenchecker.WithCircuitBreaker(c.UaaBreakerThreshold, c.UaaBreakerCooldown))
+		}
+
+		tc := tokenchecker.New(&tokenchecker.TokenCheckerConfig{
+			UaaURL:       c.UaaURL,
+			FailoverURLs: c.UaaFailoverURLs,
+			TLSConfig:    uaaTLSConfig,
+			UaaClient:    c.UaaClientIdentity,
+			UaaPassword:  c.UaaClientPassword,
+			Authority:    "bosh.system_metrics.read",
+			TeamScopes:   c.TeamScopes,
+		}, opts...)
+		return withTokenCache(c, tc), func() {}, nil
+	case "token_keys":
+		uaaTLSConfig := &tls.Config{}
+		err := setCACert(uaaTLSConfig, c.UaaCA)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		jc := tokenchecker.NewJWTChecker(&tokenchecker.JWTCheckerConfig{
+			UaaURL:     c.UaaURL,
+			TLSConfig:  uaaTLSConfig,
+			Issuer:     c.UaaIssuer,
+			Audience:   c.UaaAudience,
+			Authority:  "bosh.system_metrics.read",
+			TeamScopes: c.TeamScopes,
+		})
+		return jc, jc.Start(), nil
+	case "introspection":
+		// Team scopes are read from the token, which
+		// introspection allows to be opaque.
+		if c.TeamScopes {
+			return nil, nil, errors.New("team scopes require check_token or token_keys token validation")
+		}
+
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if c.IntrospectionCA != "" {
+			err := setCACert(tlsConfig, c.IntrospectionCA)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		authority := c.IntrospectionAuthority
+		if authority == "" {
+			authority = "bosh.system_metrics.read"
+		}
+		ic, err := tokenchecker.NewIntrospectionChecker(&tokenchecker.IntrospectionConfig{
+			URL:            c.IntrospectionURL,
+			TLSConfig:      tlsConfig,
+			ClientAuth:     tokenchecker.ClientAuthMethod(c.IntrospectionClientAuth),
+			ClientID:       c.IntrospectionClientID,
+			ClientSecret:   c.IntrospectionClientSecret,
+			ClientToken:    c.IntrospectionClientToken,
+			Authority:      authority,
+			AuthorityClaim: c.IntrospectionAuthorityClaim,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return withTokenCache(c, ic), func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown token validation %q: must be check_token, token_keys or introspection", c.TokenValidation)
+	}
+}
+
+// withTokenCache puts a cache in front of checkers
+// that make a request for every token.
+func withTokenCache(c config.Config, tc checker) checker {
+	if c.TokenCacheSize <= 0 {
+		return tc
+	}
+
+	opts := []tokenchecker.CacheOpt{tokenchecker.WithMaxEntries(c.TokenCacheSize)}
+	if c.TokenCacheNegativeTTL > 0 {
+		opts = append(opts, tokenchecker.WithNegativeTTL(c.TokenCacheNegativeTTL))
+	}
+	if c.TokenRevalidationInterval > 0 {
+		opts = append(opts, tokenchecker.WithMaxTTL(c.TokenRevalidationInterval))
+	}
+
+	return tokenchecker.NewCache(tc, opts...)
+}
+
+func newOTLPExporter(c config.Config) (*otlp.Exporter, error) {
+	var tlsConfig *tls.Config
+	if !c.OtlpInsecure {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if c.OtlpCA != "" {
+			err := setCACert(tlsConfig, c.OtlpCA)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var client otlp.Client
+	switch c.OtlpProtocol {
+	case "", "grpc":
+		var err error
+		client, err = otlp.NewGRPCClient(c.OtlpEndpoint, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	case "http":
+		client = otlp.NewHTTPClient(c.OtlpEndpoint, tlsConfig)
+	default:
+		return nil, fmt.Errorf("unknown otlp protocol %q: must be grpc or http", c.OtlpProtocol)
+	}
+
+	var opts []otlp.ExporterOpt
+	if c.OtlpBufferSize > 0 {
+		opts = append(opts, otlp.WithBufferSize(c.OtlpBufferSize))
+	}
+
+	return otlp.New(client, opts...), nil
+}
+
+func newPlaintextSink(p plaintext.Protocol, network, addr, template string, tags bool) (*plaintext.Sink, error) {
+	name := "statsd"
+	if p == plaintext.Graphite {
+		name = "graphite"
+	}
+	if network == "" {
+		network = "udp"
+	}
+
+	var opts []plaintext.SinkOpt
+	if template != "" {
+		opts = append(opts, plaintext.WithTemplate(template))
+	}
+	if tags {
+		opts = append(opts, plaintext.WithTags())
+	}
+
+	return plaintext.New(name, p, network, addr, opts...)
+}
+
+func newWebhookSink(c config.Config) (*webhook.Sink, error) {
+	routes := make([]webhook.Route, 0, len(c.WebhookRoutes))
+	for _, r := range c.WebhookRoutes {
+		routes = append(routes, webhook.Route{
+			Name:        r.Name,
+			URL:         r.URL,
+			Severities:  r.Severities,
+			Deployments: r.Deployments,
+			Title:       r.Title,
+			Template:    r.Template,
+			ContentType: r.ContentType,
+		})
+	}
+
+	var opts []webhook.SinkOpt
+	if c.WebhookOutboxSize > 0 {
+		opts = append(opts, webhook.WithOutboxSize(c.WebhookOutboxSize))
+	}
+
+	return webhook.New(routes, opts...)
+}
+
+func newSyslogSink(c config.Config) (*syslog.Sink, error) {
+	network := c.SyslogNetwork
+	if network == "" {
+		network = "tcp"
+	}
+
+	var opts []syslog.SinkOpt
+	if c.SyslogFacility != nil {
+		opts = append(opts, syslog.WithFacility(*c.SyslogFacility))
+	}
+	if c.SyslogHeartbeats {
+		opts = append(opts, syslog.WithHeartbeats())
+	}
+	if network == "tls" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if c.SyslogCA != "" {
+			err := setCACert(tlsConfig, c.SyslogCA)
+			if err != nil {
+				return nil, err
+			}
+		}
+		opts = append(opts, syslog.WithTLSConfig(tlsConfig))
+	}
+
+	return syslog.New(network, c.SyslogAddr, opts...)
+}
+
+func newArchiveSink(c config.Config) (*archive.Sink, error) {
+	policies := make(map[string]archive.Policy, len(c.ArchiveKinds))
+	for kind, p := range c.ArchiveKinds {
+		policies[kind] = archive.Policy{
+			RotateInterval: p.RotateInterval,
+			RotateSize:     p.RotateSize,
+			Compress:       p.Compress,
+			MaxAge:         p.MaxAge,
+			MaxTotalSize:   p.MaxTotalSize,
+		}
+	}
+
+	return archive.New(c.ArchiveDir, policies)
+}
+
+func newAuditLogger(c config.Config) (*audit.Logger, error) {
+	switch c.AuditLogDestination {
+	case "file":
+		return audit.NewFile(c.AuditLogPath)
+	case "syslog":
+		return audit.NewSyslog("system-metrics-server")
+	default:
+		return nil, fmt.Errorf("unknown audit log destination %q: must be file or syslog", c.AuditLogDestination)
+	}
+}
+
 func setCACert(tlsConfig *tls.Config, caPath string) error {
-	caCertBytes, err := ioutil.ReadFile(caPath)
+	caCertPool, err := loadCertPool(caPath)
 	if err != nil {
 		return err
 	}
 
+	tlsConfig.RootCAs = caCertPool
+
+	return nil
+}
+
+func loadCertPool(caPath string) (*x509.CertPool, error) {
+	caCertBytes, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+
 	caCertPool := x509.NewCertPool()
 	if ok := caCertPool.AppendCertsFromPEM(caCertBytes); !ok {
-		return fmt.Errorf("cannot parse ca cert from %s", caPath)
+		return nil, fmt.Errorf("cannot parse ca cert from %s", caPath)
 	}
 
-	tlsConfig.RootCAs = caCertPool
-
-	return nil
+	return caCertPool, nil
 }
 
 func getUaaPassword(filePath string) (string, error) {
@@ -0,0 +1,199 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// file is the series of rotated files that one kind of event is
+// archived to. Files are named <kind>-<time>.jsonl after the time they
+// were opened, and get a .gz suffix once compressed.
+type file struct {
+	dir    string
+	kind   string
+	policy Policy
+
+	f      *os.File
+	w      *bufio.Writer
+	opened time.Time
+	size   int64
+}
+
+func newFile(dir, kind string, p Policy) *file {
+	return &file{
+		dir:    dir,
+		kind:   kind,
+		policy: p,
+	}
+}
+
+func (f *file) write(line []byte) error {
+	if f.f != nil && f.policy.RotateSize > 0 && f.size+int64(len(line)) > f.policy.RotateSize {
+		f.rotate()
+	}
+
+	if f.f == nil {
+		err := f.open(time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := f.w.Write(line)
+	f.size += int64(n)
+
+	return err
+}
+
+// check flushes the current file, rotates it if it is too old and
+// removes files that are beyond the retention policy.
+func (f *file) check(now time.Time) {
+	if f.f != nil {
+		err := f.w.Flush()
+		if err != nil {
+			log.Printf("unable to flush %s archive: %s\n", f.kind, err)
+			archiveWriteErr.Add(1)
+		}
+
+		if f.policy.RotateInterval > 0 && now.Sub(f.opened) >= f.policy.RotateInterval {
+			f.rotate()
+		}
+	}
+
+	f.retain(now)
+}
+
+func (f *file) open(now time.Time) error {
+	name := filepath.Join(f.dir, fmt.Sprintf("%s-%s.jsonl", f.kind, now.UTC().Format("20060102T150405.000000000Z")))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	f.f = file
+	f.w = bufio.NewWriter(file)
+	f.opened = now
+	f.size = 0
+
+	return nil
+}
+
+// rotate closes the current file, compressing it if configured.
+// The next write opens a new file.
+func (f *file) rotate() {
+	f.close()
+	archiveRotations.Add(1)
+}
+
+func (f *file) close() {
+	if f.f == nil {
+		return
+	}
+
+	name := f.f.Name()
+	err := f.w.Flush()
+	if err != nil {
+		log.Printf("unable to flush %s archive: %s\n", f.kind, err)
+		archiveWriteErr.Add(1)
+	}
+	f.f.Close()
+	f.f = nil
+	f.w = nil
+
+	if f.policy.Compress {
+		err := compress(name)
+		if err != nil {
+			log.Printf("unable to compress %s: %s\n", name, err)
+			archiveWriteErr.Add(1)
+		}
+	}
+}
+
+// compress replaces the file with a gzipped copy.
+func compress(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+// retain removes rotated files older than the maximum age, then the
+// oldest rotated files until the kind is within its maximum total size.
+// The current file is never removed but counts towards the total size.
+func (f *file) retain(now time.Time) {
+	if f.policy.MaxAge <= 0 && f.policy.MaxTotalSize <= 0 {
+		return
+	}
+
+	names, err := filepath.Glob(filepath.Join(f.dir, f.kind+"-*.jsonl*"))
+	if err != nil {
+		return
+	}
+	// Names sort by the time the files were opened.
+	sort.Strings(names)
+
+	type archived struct {
+		name string
+		info os.FileInfo
+	}
+	var rotated []archived
+	var total int64
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		total += info.Size()
+
+		if f.f != nil && name == f.f.Name() {
+			continue
+		}
+		rotated = append(rotated, archived{name: name, info: info})
+	}
+
+	for _, a := range rotated {
+		expired := f.policy.MaxAge > 0 && now.Sub(a.info.ModTime()) > f.policy.MaxAge
+		oversized := f.policy.MaxTotalSize > 0 && total > f.policy.MaxTotalSize
+		if !expired && !oversized {
+			continue
+		}
+
+		err := os.Remove(a.name)
+		if err != nil {
+			log.Printf("unable to remove %s: %s\n", a.name, err)
+			continue
+		}
+		total -= a.info.Size()
+		archiveRemoved.Add(1)
+	}
+}
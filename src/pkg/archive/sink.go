@@ -0,0 +1,201 @@
+package archive
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var (
+	archiveWritten   *expvar.Int
+	archiveDropped   *expvar.Int
+	archiveWriteErr  *expvar.Int
+	archiveRotations *expvar.Int
+	archiveRemoved   *expvar.Int
+)
+
+func init() {
+	archiveWritten = expvar.NewInt("archive.written")
+	archiveDropped = expvar.NewInt("archive.dropped")
+	archiveWriteErr = expvar.NewInt("archive.write_err")
+	archiveRotations = expvar.NewInt("archive.rotations")
+	archiveRemoved = expvar.NewInt("archive.removed")
+}
+
+// Kinds of events that can be archived.
+const (
+	KindHeartbeat = "heartbeat"
+	KindAlert     = "alert"
+)
+
+// Policy configures how the archive of one kind of event is rotated
+// and retained. Zero values disable the corresponding limit.
+type Policy struct {
+	// RotateInterval is how long a file is written to
+	// before a new one is started.
+	RotateInterval time.Duration
+	// RotateSize is the size in bytes at which a new file is started.
+	RotateSize int64
+	// Compress gzips files once they are rotated.
+	Compress bool
+
+	// MaxAge is how long rotated files are kept.
+	MaxAge time.Duration
+	// MaxTotalSize is the most bytes the files of the kind may use.
+	// The oldest rotated files are removed to stay under it.
+	MaxTotalSize int64
+}
+
+// Sink writes events as JSON lines to files in a directory, one series
+// of files per kind of event. Events are written on their own go
+// routine so a slow disk does not hold up the server. Events that do
+// not fit in the buffer are dropped.
+type Sink struct {
+	dir    string
+	files  map[string]*file
+	events chan *definitions.Event
+
+	bufferSize    int
+	checkInterval time.Duration
+}
+
+type SinkOpt func(*Sink)
+
+// WithBufferSize sets how many events are buffered
+// while waiting to be written.
+func WithBufferSize(n int) SinkOpt {
+	return func(s *Sink) {
+		s.bufferSize = n
+	}
+}
+
+// WithCheckInterval sets how often files are flushed and checked
+// for rotation and retention.
+func WithCheckInterval(d time.Duration) SinkOpt {
+	return func(s *Sink) {
+		s.checkInterval = d
+	}
+}
+
+// New returns a Sink that archives the kinds of events in policies
+// to dir. Other kinds of events are ignored.
+func New(dir string, policies map[string]Policy, opts ...SinkOpt) (*Sink, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sink{
+		dir:           dir,
+		files:         make(map[string]*file),
+		bufferSize:    10000,
+		checkInterval: time.Second,
+	}
+
+	for kind, p := range policies {
+		if kind != KindHeartbeat && kind != KindAlert {
+			return nil, fmt.Errorf("unknown event kind %q: must be %s or %s", kind, KindHeartbeat, KindAlert)
+		}
+		s.files[kind] = newFile(dir, kind, p)
+	}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	s.events = make(chan *definitions.Event, s.bufferSize)
+
+	return s, nil
+}
+
+// Write queues the event to be archived without blocking.
+func (s *Sink) Write(evt *definitions.Event) {
+	if _, ok := s.files[kind(evt)]; !ok {
+		return
+	}
+
+	select {
+	case s.events <- evt:
+	default:
+		archiveDropped.Add(1)
+	}
+}
+
+// Start spins up a go routine that writes the queued events.
+// It returns a shutdown function that writes what is still queued,
+// closes the files and blocks until it is done.
+func (s *Sink) Start() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(s.checkInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case evt := <-s.events:
+				s.write(evt)
+			case now := <-ticker.C:
+				for _, f := range s.files {
+					f.check(now)
+				}
+			case <-stop:
+				for {
+					select {
+					case evt := <-s.events:
+						s.write(evt)
+					default:
+						for _, f := range s.files {
+							f.close()
+						}
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (s *Sink) write(evt *definitions.Event) {
+	b, err := jsonMarshaller.Marshal(proto.MessageV2(evt))
+	if err != nil {
+		log.Printf("unable to encode event for archive: %s\n", err)
+		archiveWriteErr.Add(1)
+		return
+	}
+
+	err = s.files[kind(evt)].write(append(b, '\n'))
+	if err != nil {
+		log.Printf("unable to archive event: %s\n", err)
+		archiveWriteErr.Add(1)
+		return
+	}
+	archiveWritten.Add(1)
+}
+
+var jsonMarshaller = protojson.MarshalOptions{UseProtoNames: true}
+
+func kind(evt *definitions.Event) string {
+	switch {
+	case evt.GetHeartbeat() != nil:
+		return KindHeartbeat
+	case evt.GetAlert() != nil:
+		return KindAlert
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,265 @@
+package archive_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/archive"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	. "github.com/onsi/gomega"
+)
+
+func TestSinkWritesEventsAsJSONLines(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+
+	sink, err := archive.New(dir, map[string]archive.Policy{
+		archive.KindHeartbeat: {},
+		archive.KindAlert:     {},
+	})
+	Expect(err).ToNot(HaveOccurred())
+	stop := sink.Start()
+	sink.Write(heartbeat)
+	sink.Write(alert)
+	sink.Write(alert)
+	stop()
+
+	heartbeats := readLines(files(dir, "heartbeat-*.jsonl")...)
+	Expect(heartbeats).To(HaveLen(1))
+	Expect(heartbeats[0]).To(HaveKeyWithValue("deployment", "loggregator"))
+	Expect(heartbeats[0]["heartbeat"]).To(HaveKeyWithValue("instance_id", "6f60a3ce"))
+
+	alerts := readLines(files(dir, "alert-*.jsonl")...)
+	Expect(alerts).To(HaveLen(2))
+	Expect(alerts[0]["alert"]).To(HaveKeyWithValue("title", "SSH Access Denied"))
+}
+
+func TestSinkOnlyArchivesConfiguredKinds(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+
+	sink, err := archive.New(dir, map[string]archive.Policy{archive.KindAlert: {}})
+	Expect(err).ToNot(HaveOccurred())
+	stop := sink.Start()
+	sink.Write(heartbeat)
+	sink.Write(alert)
+	stop()
+
+	Expect(files(dir, "heartbeat-*")).To(BeEmpty())
+	Expect(readLines(files(dir, "alert-*")...)).To(HaveLen(1))
+}
+
+func TestSinkRotatesAndCompressesBySize(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+
+	sink, err := archive.New(dir, map[string]archive.Policy{
+		archive.KindAlert: {RotateSize: 200, Compress: true},
+	})
+	Expect(err).ToNot(HaveOccurred())
+	stop := sink.Start()
+	for i := 0; i < 5; i++ {
+		sink.Write(alert)
+	}
+	stop()
+
+	Expect(files(dir, "alert-*.jsonl")).To(BeEmpty())
+	compressed := files(dir, "alert-*.jsonl.gz")
+	Expect(len(compressed)).To(BeNumerically(">", 1))
+	Expect(readLines(compressed...)).To(HaveLen(5))
+}
+
+func TestSinkRotatesByTime(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+
+	sink, err := archive.New(
+		dir,
+		map[string]archive.Policy{archive.KindAlert: {RotateInterval: 20 * time.Millisecond}},
+		archive.WithCheckInterval(10*time.Millisecond),
+	)
+	Expect(err).ToNot(HaveOccurred())
+	stop := sink.Start()
+	sink.Write(alert)
+	time.Sleep(100 * time.Millisecond)
+	sink.Write(alert)
+	stop()
+
+	Expect(files(dir, "alert-*.jsonl")).To(HaveLen(2))
+}
+
+func TestSinkRemovesTheOldestFilesBeyondTheTotalSize(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+
+	sink, err := archive.New(
+		dir,
+		map[string]archive.Policy{archive.KindAlert: {RotateSize: 200, MaxTotalSize: 600}},
+		archive.WithCheckInterval(10*time.Millisecond),
+	)
+	Expect(err).ToNot(HaveOccurred())
+	stop := sink.Start()
+
+	for i := 0; i < 10; i++ {
+		sink.Write(alert)
+	}
+	Eventually(func() []map[string]interface{} {
+		return readLines(files(dir, "alert-*")...)
+	}).ShouldNot(BeEmpty())
+	Eventually(totalSize(dir)).Should(BeNumerically("<=", 600))
+	newest := files(dir, "alert-*")
+	stop()
+
+	Expect(len(newest)).To(BeNumerically("<", 10))
+	Expect(newest[len(newest)-1]).To(BeAnExistingFile())
+}
+
+func TestSinkRemovesFilesOlderThanTheMaxAge(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "alert-20170706T163922.000000000Z.jsonl.gz")
+	Expect(ioutil.WriteFile(old, []byte("old"), 0640)).To(Succeed())
+	Expect(os.Chtimes(old, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour))).To(Succeed())
+	other := filepath.Join(dir, "heartbeat-20170706T163922.000000000Z.jsonl.gz")
+	Expect(ioutil.WriteFile(other, []byte("old"), 0640)).To(Succeed())
+	Expect(os.Chtimes(other, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour))).To(Succeed())
+
+	sink, err := archive.New(
+		dir,
+		map[string]archive.Policy{archive.KindAlert: {MaxAge: time.Hour}},
+		archive.WithCheckInterval(10*time.Millisecond),
+	)
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	Eventually(func() bool { _, err := os.Stat(old); return os.IsNotExist(err) }).Should(BeTrue())
+	Expect(other).To(BeAnExistingFile())
+}
+
+func TestSinkDropsEventsThatDoNotFitInTheBuffer(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+
+	sink, err := archive.New(dir, map[string]archive.Policy{archive.KindAlert: {}}, archive.WithBufferSize(3))
+	Expect(err).ToNot(HaveOccurred())
+	for i := 0; i < 10; i++ {
+		sink.Write(alert)
+	}
+	sink.Start()()
+
+	Expect(readLines(files(dir, "alert-*")...)).To(HaveLen(3))
+}
+
+func TestNewRejectsUnknownKinds(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+
+	_, err := archive.New(dir, map[string]archive.Policy{"gap": {}})
+	Expect(err).To(HaveOccurred())
+}
+
+func tempDir() string {
+	dir, err := ioutil.TempDir("", "archive")
+	Expect(err).ToNot(HaveOccurred())
+
+	return dir
+}
+
+func files(dir, pattern string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, pattern))
+	Expect(err).ToNot(HaveOccurred())
+	sort.Strings(names)
+
+	return names
+}
+
+func totalSize(dir string) func() int64 {
+	return func() int64 {
+		var total int64
+		for _, name := range files(dir, "*") {
+			info, err := os.Stat(name)
+			if err == nil {
+				total += info.Size()
+			}
+		}
+		return total
+	}
+}
+
+func readLines(names ...string) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, name := range names {
+		f, err := os.Open(name)
+		Expect(err).ToNot(HaveOccurred())
+
+		var r io.Reader = f
+		if strings.HasSuffix(name, ".gz") {
+			r, err = gzip.NewReader(f)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var line map[string]interface{}
+			Expect(json.Unmarshal(scanner.Bytes(), &line)).To(Succeed())
+			lines = append(lines, line)
+		}
+		f.Close()
+	}
+
+	return lines
+}
+
+var heartbeat = &definitions.Event{
+	Id:         "55b68400",
+	Timestamp:  1499293724,
+	Deployment: "loggregator",
+	Message: &definitions.Event_Heartbeat{
+		Heartbeat: &definitions.Heartbeat{
+			Job:        "consul",
+			InstanceId: "6f60a3ce",
+			Metrics: []*definitions.Heartbeat_Metric{
+				{Name: "system.cpu.user", Value: 2.5, Timestamp: 1499293724},
+			},
+		},
+	},
+}
+
+var alert = &definitions.Event{
+	Id:         "93eb25a4-9348-4232-6f71-69e1e01081d7",
+	Timestamp:  1499359162,
+	Deployment: "loggregator",
+	Message: &definitions.Event_Alert{
+		Alert: &definitions.Alert{
+			Severity: 4,
+			Title:    "SSH Access Denied",
+			Summary:  "Failed password for vcap from 10.244.0.1 port 38732 ssh2",
+		},
+	},
+}
@@ -0,0 +1,173 @@
+package audit
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"log"
+	"log/syslog"
+	"os"
+	"time"
+)
+
+var (
+	auditLogged   *expvar.Int
+	auditDropped  *expvar.Int
+	auditWriteErr *expvar.Int
+)
+
+func init() {
+	auditLogged = expvar.NewInt("audit.logged")
+	auditDropped = expvar.NewInt("audit.dropped")
+	auditWriteErr = expvar.NewInt("audit.write_err")
+}
+
+// Decision is the outcome an entry records.
+type Decision string
+
+const (
+	// Allowed records a stream that was authenticated and subscribed.
+	Allowed Decision = "allowed"
+	// Denied records a stream that was rejected.
+	Denied Decision = "denied"
+	// Ended records a stream that has disconnected.
+	Ended Decision = "ended"
+)
+
+// Entry is one line of the audit log. It never holds the token.
+type Entry struct {
+	Time           time.Time `json:"time"`
+	Peer           string    `json:"peer,omitempty"`
+	ClientID       string    `json:"client_id,omitempty"`
+	SubscriptionID string    `json:"subscription_id"`
+	Filters        Filters   `json:"filters"`
+	Decision       Decision  `json:"decision"`
+	Reason         string    `json:"reason,omitempty"`
+	// Duration is how long an ended stream was connected, in seconds.
+	Duration float64 `json:"duration_seconds,omitempty"`
+}
+
+// Filters are the options of the subscription request, and the teams
+// the stream is limited to if it is team-scoped.
+type Filters struct {
+	BufferSize int32    `json:"buffer_size,omitempty"`
+	DropPolicy string   `json:"drop_policy,omitempty"`
+	Teams      []string `json:"teams,omitempty"`
+}
+
+// Logger writes entries as JSON lines. Entries are written on their
+// own go routine so a slow disk or syslog does not hold up clients.
+// Entries that do not fit in the buffer are dropped.
+type Logger struct {
+	w       io.WriteCloser
+	entries chan Entry
+
+	bufferSize int
+}
+
+type LoggerOpt func(*Logger)
+
+// WithBufferSize sets how many entries are buffered
+// while waiting to be written.
+func WithBufferSize(n int) LoggerOpt {
+	return func(l *Logger) {
+		l.bufferSize = n
+	}
+}
+
+// New returns a Logger that writes to w.
+func New(w io.WriteCloser, opts ...LoggerOpt) *Logger {
+	l := &Logger{
+		w:          w,
+		bufferSize: 1024,
+	}
+
+	for _, o := range opts {
+		o(l)
+	}
+
+	l.entries = make(chan Entry, l.bufferSize)
+
+	return l
+}
+
+// NewFile returns a Logger that appends to the file at path.
+func NewFile(path string, opts ...LoggerOpt) (*Logger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(f, opts...), nil
+}
+
+// NewSyslog returns a Logger that writes to the local syslog
+// daemon with the auth facility, one message per entry.
+func NewSyslog(tag string, opts ...LoggerOpt) (*Logger, error) {
+	w, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(w, opts...), nil
+}
+
+// Log queues the entry to be written without blocking.
+func (l *Logger) Log(e Entry) {
+	select {
+	case l.entries <- e:
+	default:
+		auditDropped.Add(1)
+	}
+}
+
+// Start spins up a go routine that writes the queued entries.
+// It returns a shutdown function that writes what is still queued,
+// closes the writer and blocks until it is done.
+func (l *Logger) Start() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case e := <-l.entries:
+				l.write(e)
+			case <-stop:
+				for {
+					select {
+					case e := <-l.entries:
+						l.write(e)
+					default:
+						l.w.Close()
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (l *Logger) write(e Entry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("unable to encode audit entry: %s\n", err)
+		auditWriteErr.Add(1)
+		return
+	}
+
+	_, err = l.w.Write(append(b, '\n'))
+	if err != nil {
+		log.Printf("unable to write audit entry: %s\n", err)
+		auditWriteErr.Add(1)
+		return
+	}
+	auditLogged.Add(1)
+}
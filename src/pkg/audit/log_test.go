@@ -0,0 +1,61 @@
+package audit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/audit"
+	. "github.com/onsi/gomega"
+)
+
+func TestLoggerAppendsEntriesAsJSONLines(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir, err := ioutil.TempDir("", "audit")
+	Expect(err).ToNot(HaveOccurred())
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	for i := 0; i < 2; i++ {
+		l, err := audit.NewFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		stop := l.Start()
+		l.Log(audit.Entry{
+			Time:           time.Now(),
+			Peer:           "10.0.0.1:5000",
+			ClientID:       "firehose",
+			SubscriptionID: "sub-id",
+			Filters:        audit.Filters{BufferSize: 50, DropPolicy: "drop_oldest"},
+			Decision:       audit.Ended,
+			Duration:       1.5,
+		})
+		stop()
+	}
+
+	info, err := os.Stat(path)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+	f, err := os.Open(path)
+	Expect(err).ToNot(HaveOccurred())
+	defer f.Close()
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		Expect(json.Unmarshal(scanner.Bytes(), &line)).To(Succeed())
+		lines = append(lines, line)
+	}
+	Expect(lines).To(HaveLen(2))
+	Expect(lines[0]).To(HaveKeyWithValue("peer", "10.0.0.1:5000"))
+	Expect(lines[0]).To(HaveKeyWithValue("client_id", "firehose"))
+	Expect(lines[0]).To(HaveKeyWithValue("decision", "ended"))
+	Expect(lines[0]).To(HaveKeyWithValue("duration_seconds", 1.5))
+	Expect(lines[0]["filters"]).To(HaveKeyWithValue("drop_policy", "drop_oldest"))
+}
@@ -0,0 +1,72 @@
+package clientcert
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// Authorizer allows client certificates by their subject common
+// name, subject alternative names or SPIFFE ID. The certificates
+// must already have been verified against the client CA.
+type Authorizer struct {
+	commonNames map[string]bool
+	sans        map[string]bool
+	spiffeIDs   map[string]bool
+}
+
+// New returns an Authorizer that allows certificates with any of the
+// common names, DNS, email or IP subject alternative names, or SPIFFE
+// IDs. At least one must be given.
+func New(commonNames, sans, spiffeIDs []string) (*Authorizer, error) {
+	if len(commonNames) == 0 && len(sans) == 0 && len(spiffeIDs) == 0 {
+		return nil, errors.New("client certificates need at least one allowed common name, SAN or SPIFFE ID")
+	}
+
+	return &Authorizer{
+		commonNames: set(commonNames),
+		sans:        set(sans),
+		spiffeIDs:   set(spiffeIDs),
+	}, nil
+}
+
+// Authorize returns an error unless the certificate
+// matches one of the allow-lists.
+func (a *Authorizer) Authorize(cert *x509.Certificate) error {
+	if a.commonNames[cert.Subject.CommonName] {
+		return nil
+	}
+
+	for _, name := range cert.DNSNames {
+		if a.sans[name] {
+			return nil
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if a.sans[email] {
+			return nil
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		if a.sans[ip.String()] {
+			return nil
+		}
+	}
+
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" && a.spiffeIDs[uri.String()] {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("client certificate %q is not allowed", cert.Subject.CommonName)
+}
+
+func set(l []string) map[string]bool {
+	s := make(map[string]bool, len(l))
+	for _, v := range l {
+		s[v] = true
+	}
+
+	return s
+}
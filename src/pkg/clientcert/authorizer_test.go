@@ -0,0 +1,70 @@
+package clientcert_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/clientcert"
+	. "github.com/onsi/gomega"
+)
+
+func TestAuthorizerAllowsCertificatesOnTheAllowLists(t *testing.T) {
+	RegisterTestingT(t)
+
+	a, err := clientcert.New(
+		[]string{"metrics-forwarder"},
+		[]string{"forwarder.service.internal", "10.0.0.5"},
+		[]string{"spiffe://bosh.internal/metrics/forwarder"},
+	)
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(a.Authorize(&x509.Certificate{
+		Subject: pkix.Name{CommonName: "metrics-forwarder"},
+	})).To(Succeed())
+	Expect(a.Authorize(&x509.Certificate{
+		Subject:  pkix.Name{CommonName: "other"},
+		DNSNames: []string{"other.internal", "forwarder.service.internal"},
+	})).To(Succeed())
+	Expect(a.Authorize(&x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.5")},
+	})).To(Succeed())
+	Expect(a.Authorize(&x509.Certificate{
+		URIs: []*url.URL{mustParse("spiffe://bosh.internal/metrics/forwarder")},
+	})).To(Succeed())
+}
+
+func TestAuthorizerRejectsOtherCertificates(t *testing.T) {
+	RegisterTestingT(t)
+
+	a, err := clientcert.New(
+		[]string{"metrics-forwarder"},
+		nil,
+		[]string{"spiffe://bosh.internal/metrics/forwarder"},
+	)
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(a.Authorize(&x509.Certificate{
+		Subject:  pkix.Name{CommonName: "other"},
+		DNSNames: []string{"metrics-forwarder"},
+	})).ToNot(Succeed())
+	Expect(a.Authorize(&x509.Certificate{
+		URIs: []*url.URL{mustParse("https://bosh.internal/metrics/forwarder")},
+	})).ToNot(Succeed())
+}
+
+func TestNewRequiresAnAllowList(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := clientcert.New(nil, nil, nil)
+	Expect(err).To(HaveOccurred())
+}
+
+func mustParse(s string) *url.URL {
+	u, err := url.Parse(s)
+	Expect(err).ToNot(HaveOccurred())
+
+	return u
+}
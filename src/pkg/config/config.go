@@ -2,26 +2,135 @@ package config
 
 import (
 	"io/ioutil"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
 	// TODO: required / default values?
-	EgressPort  int    `yaml:"egress-port"`
-	IngressPort int    `yaml:"ingress-port"`
-	CertPath    string `yaml:"metrics-cert"`
-	KeyPath     string `yaml:"metrics-key"`
+	EgressPort     int    `yaml:"egress-port"`
+	HTTPEgressPort int    `yaml:"http-egress-port"`
+	IngressPort    int    `yaml:"ingress-port"`
+	CertPath       string `yaml:"metrics-cert"`
+	KeyPath        string `yaml:"metrics-key"`
+
+	IngressShedHeartbeats bool `yaml:"ingress-shed-heartbeats"`
 
 	UaaURL            string `yaml:"uaa-url"`
 	UaaCA             string `yaml:"uaa-ca"`
 	UaaClientIdentity string `yaml:"uaa-client-identity"`
 	UaaClientPassword string `yaml:"uaa-client-password"`
+	UaaIssuer         string `yaml:"uaa-issuer"`
+	UaaAudience       string `yaml:"uaa-audience"`
+
+	UaaFailoverURLs     []string      `yaml:"uaa-failover-urls"`
+	UaaTimeout          time.Duration `yaml:"uaa-timeout"`
+	UaaBreakerThreshold int           `yaml:"uaa-breaker-threshold"`
+	UaaBreakerCooldown  time.Duration `yaml:"uaa-breaker-cooldown"`
+
+	AuthMode          string   `yaml:"auth-mode"`
+	ClientCA          string   `yaml:"client-ca"`
+	ClientCommonNames []string `yaml:"client-common-names"`
+	ClientSANs        []string `yaml:"client-sans"`
+	ClientSPIFFEIDs   []string `yaml:"client-spiffe-ids"`
+
+	TokenValidation           string        `yaml:"token-validation"`
+	TokenRevalidationInterval time.Duration `yaml:"token-revalidation-interval"`
+	TeamScopes                bool          `yaml:"team-scopes"`
+
+	AuditLogDestination string `yaml:"audit-log-destination"`
+	AuditLogPath        string `yaml:"audit-log-path"`
+
+	IntrospectionURL            string `yaml:"introspection-url"`
+	IntrospectionCA             string `yaml:"introspection-ca"`
+	IntrospectionClientAuth     string `yaml:"introspection-client-auth"`
+	IntrospectionClientID       string `yaml:"introspection-client-id"`
+	IntrospectionClientSecret   string `yaml:"introspection-client-secret"`
+	IntrospectionClientToken    string `yaml:"introspection-client-token"`
+	IntrospectionAuthority      string `yaml:"introspection-authority"`
+	IntrospectionAuthorityClaim string `yaml:"introspection-authority-claim"`
+
+	TokenCacheSize        int           `yaml:"token-cache-size"`
+	TokenCacheNegativeTTL time.Duration `yaml:"token-cache-negative-ttl"`
+
+	Distribution              string `yaml:"distribution"`
+	DispatchShards            int    `yaml:"dispatch-shards"`
+	SubscriptionBufferSize    int    `yaml:"subscription-buffer-size"`
+	MaxSubscriptionBufferSize int    `yaml:"max-subscription-buffer-size"`
+	SubscriptionBufferBudget  int    `yaml:"subscription-buffer-budget"`
+	AlertBufferSize           int    `yaml:"alert-buffer-size"`
+
+	SubscriptionOwnership bool                `yaml:"subscription-ownership"`
+	SharedSubscriptions   []string            `yaml:"shared-subscriptions"`
+	SharedClients         map[string][]string `yaml:"shared-clients"`
+
+	SlowConsumerThreshold time.Duration `yaml:"slow-consumer-threshold"`
+	SlowConsumerAction    string        `yaml:"slow-consumer-action"`
+
+	PrometheusPort      int           `yaml:"prometheus-port"`
+	PrometheusSeriesTTL time.Duration `yaml:"prometheus-series-ttl"`
+
+	OtlpEndpoint   string `yaml:"otlp-endpoint"`
+	OtlpProtocol   string `yaml:"otlp-protocol"`
+	OtlpCA         string `yaml:"otlp-ca"`
+	OtlpInsecure   bool   `yaml:"otlp-insecure"`
+	OtlpBufferSize int    `yaml:"otlp-buffer-size"`
+
+	LoggregatorAddr string `yaml:"loggregator-addr"`
+	LoggregatorCA   string `yaml:"loggregator-ca"`
+	LoggregatorCert string `yaml:"loggregator-cert"`
+	LoggregatorKey  string `yaml:"loggregator-key"`
+
+	StatsDAddr     string `yaml:"statsd-addr"`
+	StatsDNetwork  string `yaml:"statsd-network"`
+	StatsDTemplate string `yaml:"statsd-template"`
+	StatsDTags     bool   `yaml:"statsd-tags"`
+
+	GraphiteAddr     string `yaml:"graphite-addr"`
+	GraphiteNetwork  string `yaml:"graphite-network"`
+	GraphiteTemplate string `yaml:"graphite-template"`
+	GraphiteTags     bool   `yaml:"graphite-tags"`
+
+	SyslogAddr    string `yaml:"syslog-addr"`
+	SyslogNetwork string `yaml:"syslog-network"`
+	SyslogCA      string `yaml:"syslog-ca"`
+	// SyslogFacility is nil when the key is absent,
+	// so that 0 (kern) can be told from the default.
+	SyslogFacility   *int `yaml:"syslog-facility"`
+	SyslogHeartbeats bool `yaml:"syslog-heartbeats"`
+
+	WebhookRoutes     []WebhookRoute `yaml:"webhook-routes"`
+	WebhookOutboxSize int            `yaml:"webhook-outbox-size"`
+
+	ArchiveDir   string                   `yaml:"archive-dir"`
+	ArchiveKinds map[string]ArchivePolicy `yaml:"archive-kinds"`
 
 	HealthPort int `yaml:"health-port"`
 	PProfPort  int `yaml:"pprof-port"`
 }
 
+// WebhookRoute configures where matching alerts are posted.
+type WebhookRoute struct {
+	Name        string   `yaml:"name"`
+	URL         string   `yaml:"url"`
+	Severities  []int32  `yaml:"severities"`
+	Deployments []string `yaml:"deployments"`
+	Title       string   `yaml:"title"`
+	Template    string   `yaml:"template"`
+	ContentType string   `yaml:"content_type"`
+}
+
+// ArchivePolicy configures how archived events of one kind
+// are rotated and retained.
+type ArchivePolicy struct {
+	RotateInterval time.Duration `yaml:"rotate_interval"`
+	RotateSize     int64         `yaml:"rotate_size"`
+	Compress       bool          `yaml:"compress"`
+	MaxAge         time.Duration `yaml:"max_age"`
+	MaxTotalSize   int64         `yaml:"max_total_size"`
+}
+
 func Read(configFilePath string) (Config, error) {
 	configContents, err := ioutil.ReadFile(configFilePath)
 	if err != nil {
@@ -23,6 +23,25 @@ func TestConfigRead(t *testing.T) {
 	Expect(c).To(Equal(expected))
 }
 
+func TestConfigReadSyslogFacility(t *testing.T) {
+	RegisterTestingT(t)
+
+	configFilePath := writeConfigFile(configContents)
+	defer os.Remove(configFilePath)
+
+	c, err := config.Read(configFilePath)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(c.SyslogFacility).To(BeNil())
+
+	configFilePath = writeConfigFile("syslog-facility: 0\n")
+	defer os.Remove(configFilePath)
+
+	c, err = config.Read(configFilePath)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(c.SyslogFacility).ToNot(BeNil())
+	Expect(*c.SyslogFacility).To(Equal(0))
+}
+
 func writeConfigFile(config string) string {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -12,7 +12,11 @@ It has these top-level messages:
 	Event
 	Heartbeat
 	Alert
+	Gap
 	EgressRequest
+
+It has these top-level enums:
+	DropPolicy
 */
 package definitions
 
@@ -38,6 +42,7 @@ type Event struct {
 	// Types that are valid to be assigned to Message:
 	//	*Event_Heartbeat
 	//	*Event_Alert
+	//	*Event_Gap
 	Message isEvent_Message `protobuf_oneof:"message"`
 }
 
@@ -56,9 +61,13 @@ type Event_Heartbeat struct {
 type Event_Alert struct {
 	Alert *Alert `protobuf:"bytes,5,opt,name=alert,oneof"`
 }
+type Event_Gap struct {
+	Gap *Gap `protobuf:"bytes,6,opt,name=gap,oneof"`
+}
 
 func (*Event_Heartbeat) isEvent_Message() {}
 func (*Event_Alert) isEvent_Message()     {}
+func (*Event_Gap) isEvent_Message()       {}
 
 func (m *Event) GetMessage() isEvent_Message {
 	if m != nil {
@@ -102,11 +111,19 @@ func (m *Event) GetAlert() *Alert {
 	return nil
 }
 
+func (m *Event) GetGap() *Gap {
+	if x, ok := m.GetMessage().(*Event_Gap); ok {
+		return x.Gap
+	}
+	return nil
+}
+
 // XXX_OneofFuncs is for the internal use of the proto package.
 func (*Event) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error, func(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error), func(msg proto.Message) (n int), []interface{}) {
 	return _Event_OneofMarshaler, _Event_OneofUnmarshaler, _Event_OneofSizer, []interface{}{
 		(*Event_Heartbeat)(nil),
 		(*Event_Alert)(nil),
+		(*Event_Gap)(nil),
 	}
 }
 
@@ -124,6 +141,11 @@ func _Event_OneofMarshaler(msg proto.Message, b *proto.Buffer) error {
 		if err := b.EncodeMessage(x.Alert); err != nil {
 			return err
 		}
+	case *Event_Gap:
+		b.EncodeVarint(6<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Gap); err != nil {
+			return err
+		}
 	case nil:
 	default:
 		return fmt.Errorf("Event.Message has unexpected type %T", x)
@@ -150,6 +172,14 @@ func _Event_OneofUnmarshaler(msg proto.Message, tag, wire int, b *proto.Buffer)
 		err := b.DecodeMessage(msg)
 		m.Message = &Event_Alert{msg}
 		return true, err
+	case 6: // message.gap
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(Gap)
+		err := b.DecodeMessage(msg)
+		m.Message = &Event_Gap{msg}
+		return true, err
 	default:
 		return false, nil
 	}
@@ -169,6 +199,11 @@ func _Event_OneofSizer(msg proto.Message) (n int) {
 		n += proto.SizeVarint(5<<3 | proto.WireBytes)
 		n += proto.SizeVarint(uint64(s))
 		n += s
+	case *Event_Gap:
+		s := proto.Size(x.Gap)
+		n += proto.SizeVarint(6<<3 | proto.WireBytes)
+		n += proto.SizeVarint(uint64(s))
+		n += s
 	case nil:
 	default:
 		panic(fmt.Sprintf("proto: unexpected type %T in oneof", x))
@@ -183,6 +218,7 @@ type Heartbeat struct {
 	InstanceId string              `protobuf:"bytes,4,opt,name=instance_id,json=instanceId" json:"instance_id,omitempty"`
 	JobState   string              `protobuf:"bytes,5,opt,name=job_state,json=jobState" json:"job_state,omitempty"`
 	Metrics    []*Heartbeat_Metric `protobuf:"bytes,6,rep,name=metrics" json:"metrics,omitempty"`
+	Teams      []string            `protobuf:"bytes,7,rep,name=teams" json:"teams,omitempty"`
 }
 
 func (m *Heartbeat) Reset()                    { *m = Heartbeat{} }
@@ -232,6 +268,13 @@ func (m *Heartbeat) GetMetrics() []*Heartbeat_Metric {
 	return nil
 }
 
+func (m *Heartbeat) GetTeams() []string {
+	if m != nil {
+		return m.Teams
+	}
+	return nil
+}
+
 type Heartbeat_Metric struct {
 	Name      string            `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
 	Value     float64           `protobuf:"fixed64,2,opt,name=value" json:"value,omitempty"`
@@ -320,43 +363,81 @@ func (m *Alert) GetSource() string {
 	return ""
 }
 
+type Gap struct {
+	Dropped        int64 `protobuf:"varint,1,opt,name=dropped" json:"dropped,omitempty"`
+	StartTimestamp int64 `protobuf:"varint,2,opt,name=start_timestamp,json=startTimestamp" json:"start_timestamp,omitempty"`
+	EndTimestamp   int64 `protobuf:"varint,3,opt,name=end_timestamp,json=endTimestamp" json:"end_timestamp,omitempty"`
+}
+
+func (m *Gap) Reset()                    { *m = Gap{} }
+func (m *Gap) String() string            { return proto.CompactTextString(m) }
+func (*Gap) ProtoMessage()               {}
+func (*Gap) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *Gap) GetDropped() int64 {
+	if m != nil {
+		return m.Dropped
+	}
+	return 0
+}
+
+func (m *Gap) GetStartTimestamp() int64 {
+	if m != nil {
+		return m.StartTimestamp
+	}
+	return 0
+}
+
+func (m *Gap) GetEndTimestamp() int64 {
+	if m != nil {
+		return m.EndTimestamp
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Event)(nil), "definitions.Event")
 	proto.RegisterType((*Heartbeat)(nil), "definitions.Heartbeat")
 	proto.RegisterType((*Heartbeat_Metric)(nil), "definitions.Heartbeat.Metric")
 	proto.RegisterType((*Alert)(nil), "definitions.Alert")
+	proto.RegisterType((*Gap)(nil), "definitions.Gap")
 }
 
 func init() { proto.RegisterFile("events.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 438 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x52, 0x4d, 0x8f, 0xd3, 0x30,
-	0x10, 0xdd, 0x34, 0x4d, 0x5b, 0x4f, 0x11, 0x42, 0x23, 0xb4, 0x0a, 0xe5, 0xab, 0xea, 0x85, 0x8a,
-	0x43, 0x0e, 0x8b, 0xc4, 0x22, 0x38, 0x81, 0xb4, 0x52, 0xf7, 0xc0, 0xc5, 0x70, 0x5f, 0x39, 0xcd,
-	0x10, 0x5c, 0x1a, 0xa7, 0xb2, 0xa7, 0x15, 0xf9, 0x05, 0xdc, 0xf8, 0x55, 0x88, 0xdf, 0x85, 0xec,
-	0x24, 0xdd, 0x2d, 0x42, 0xdc, 0xe6, 0xbd, 0xf9, 0xc8, 0x7b, 0x79, 0x86, 0x7b, 0x74, 0x20, 0xc3,
-	0x2e, 0xdb, 0xd9, 0x9a, 0x6b, 0x9c, 0x16, 0xf4, 0x45, 0x1b, 0xcd, 0xba, 0x36, 0x6e, 0xf1, 0x2b,
-	0x82, 0xe4, 0xca, 0x77, 0xf1, 0x09, 0x08, 0xd6, 0x15, 0x39, 0x56, 0xd5, 0x2e, 0x8d, 0xe6, 0xd1,
-	0x32, 0x96, 0xb7, 0x04, 0xde, 0x87, 0x81, 0x2e, 0xd2, 0xc1, 0x3c, 0x5a, 0x0a, 0x39, 0xd0, 0x05,
-	0x3e, 0x03, 0x28, 0x68, 0xb7, 0xad, 0x9b, 0x8a, 0x0c, 0xa7, 0x71, 0xe0, 0xef, 0x30, 0xf8, 0x1a,
-	0xc4, 0x57, 0x52, 0x96, 0x73, 0x52, 0x9c, 0x0e, 0xe7, 0xd1, 0x72, 0x7a, 0x71, 0x9e, 0xdd, 0xf9,
-	0x70, 0xb6, 0xea, 0xbb, 0xab, 0x33, 0x79, 0x3b, 0x8a, 0x2f, 0x21, 0x51, 0x5b, 0xb2, 0x9c, 0x26,
-	0x61, 0x07, 0x4f, 0x76, 0xde, 0xfb, 0xce, 0xea, 0x4c, 0xb6, 0x23, 0x1f, 0x04, 0x8c, 0x2b, 0x72,
-	0x4e, 0x95, 0xb4, 0xf8, 0x19, 0x83, 0x38, 0x5e, 0xc4, 0x47, 0x30, 0x51, 0x25, 0x19, 0xbe, 0xd1,
-	0x45, 0x70, 0x22, 0xe4, 0x38, 0xe0, 0xeb, 0x02, 0x1f, 0x40, 0xbc, 0xa9, 0xf3, 0xce, 0x88, 0x2f,
-	0xf1, 0x21, 0x24, 0xda, 0x14, 0xf4, 0x3d, 0x98, 0x48, 0x64, 0x0b, 0xf0, 0x39, 0x4c, 0xb5, 0x71,
-	0xac, 0xcc, 0x9a, 0xfc, 0x95, 0x61, 0x6b, 0xb0, 0xa7, 0xae, 0x0b, 0x7c, 0x0c, 0x62, 0x53, 0xe7,
-	0x37, 0x8e, 0x15, 0x53, 0x10, 0x2b, 0xe4, 0x64, 0x53, 0xe7, 0x9f, 0x3c, 0xc6, 0x4b, 0xaf, 0x8c,
-	0xad, 0x5e, 0xbb, 0x74, 0x34, 0x8f, 0x97, 0xd3, 0x8b, 0xa7, 0xff, 0xf6, 0x9e, 0x7d, 0x0c, 0x53,
-	0xb2, 0x9f, 0x9e, 0xfd, 0x8e, 0x60, 0xd4, 0x72, 0x88, 0x30, 0x34, 0xaa, 0xa2, 0xce, 0x40, 0xa8,
-	0xbd, 0xd6, 0x83, 0xda, 0xee, 0x29, 0xe8, 0x8f, 0x64, 0x0b, 0x4e, 0x93, 0x8b, 0xff, 0x4e, 0xee,
-	0x1d, 0x0c, 0x59, 0x95, 0x2e, 0x1d, 0x06, 0x21, 0x2f, 0xfe, 0x2b, 0x24, 0xfb, 0xac, 0x4a, 0x77,
-	0x65, 0xd8, 0x36, 0x32, 0x2c, 0xcd, 0x2e, 0x41, 0x1c, 0x29, 0xff, 0xef, 0xbe, 0x51, 0xd3, 0x09,
-	0xf2, 0xe5, 0xa9, 0x1e, 0xd1, 0xe9, 0x79, 0x3b, 0x78, 0x13, 0x2d, 0x7e, 0x44, 0x90, 0x84, 0xb8,
-	0x70, 0x06, 0x13, 0x47, 0x07, 0xb2, 0x9a, 0xdb, 0xd5, 0x44, 0x1e, 0xb1, 0xef, 0xad, 0x15, 0x53,
-	0x59, 0xdb, 0xa6, 0x3b, 0x71, 0xc4, 0xfe, 0x36, 0x6b, 0xde, 0x52, 0xf7, 0xb8, 0x5a, 0x80, 0x29,
-	0x8c, 0xdd, 0xbe, 0xaa, 0x94, 0x6d, 0xba, 0x4c, 0x7a, 0x88, 0xe7, 0x30, 0x72, 0xf5, 0xde, 0xae,
-	0xfb, 0x34, 0x3a, 0x94, 0x8f, 0xc2, 0xab, 0x7f, 0xf5, 0x27, 0x00, 0x00, 0xff, 0xff, 0x62, 0x01,
-	0x31, 0x71, 0x05, 0x03, 0x00, 0x00,
+	// 515 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x53, 0xcd, 0x6e, 0x13, 0x31,
+	0x10, 0xee, 0x66, 0xb3, 0x49, 0x3d, 0x29, 0xa5, 0xb2, 0x50, 0xb5, 0x94, 0xbf, 0x28, 0x20, 0x35,
+	0xe2, 0x90, 0x43, 0x91, 0x28, 0x82, 0x13, 0x48, 0x55, 0xd3, 0x03, 0x17, 0xd3, 0x7b, 0xe4, 0xc4,
+	0xc3, 0xe2, 0x90, 0xf5, 0xae, 0xec, 0x49, 0x44, 0x9e, 0x80, 0x17, 0xe1, 0x59, 0x78, 0x18, 0x9e,
+	0x02, 0xd9, 0xfb, 0x93, 0xa6, 0x42, 0xdc, 0xfc, 0xcd, 0x7c, 0xb3, 0xfe, 0xbe, 0x6f, 0xd6, 0x70,
+	0x84, 0x1b, 0x34, 0xe4, 0x26, 0xa5, 0x2d, 0xa8, 0xe0, 0x03, 0x85, 0x5f, 0xb5, 0xd1, 0xa4, 0x0b,
+	0xe3, 0x46, 0x7f, 0x22, 0x48, 0xae, 0x7c, 0x97, 0x3f, 0x05, 0x46, 0x3a, 0x47, 0x47, 0x32, 0x2f,
+	0xd3, 0x68, 0x18, 0x8d, 0x63, 0xb1, 0x2b, 0xf0, 0x63, 0xe8, 0x68, 0x95, 0x76, 0x86, 0xd1, 0x98,
+	0x89, 0x8e, 0x56, 0xfc, 0x39, 0x80, 0xc2, 0x72, 0x55, 0x6c, 0x73, 0x34, 0x94, 0xc6, 0xa1, 0x7e,
+	0xa7, 0xc2, 0xdf, 0x02, 0xfb, 0x86, 0xd2, 0xd2, 0x1c, 0x25, 0xa5, 0xdd, 0x61, 0x34, 0x1e, 0x5c,
+	0x9c, 0x4e, 0xee, 0x5c, 0x3c, 0x99, 0x36, 0xdd, 0xe9, 0x81, 0xd8, 0x51, 0xf9, 0x6b, 0x48, 0xe4,
+	0x0a, 0x2d, 0xa5, 0x49, 0x98, 0xe1, 0x7b, 0x33, 0x1f, 0x7d, 0x67, 0x7a, 0x20, 0x2a, 0x0a, 0x7f,
+	0x05, 0x71, 0x26, 0xcb, 0xb4, 0x17, 0x98, 0x27, 0x7b, 0xcc, 0x6b, 0x59, 0x4e, 0x0f, 0x84, 0x6f,
+	0x7f, 0x62, 0xd0, 0xcf, 0xd1, 0x39, 0x99, 0xe1, 0xe8, 0x57, 0x0c, 0xac, 0xbd, 0x97, 0x3f, 0x86,
+	0x43, 0x99, 0xa1, 0xa1, 0x99, 0x56, 0xc1, 0x2f, 0x13, 0xfd, 0x80, 0x6f, 0x14, 0x3f, 0x81, 0x78,
+	0x59, 0xcc, 0x6b, 0xbb, 0xfe, 0xc8, 0x1f, 0x41, 0xa2, 0x8d, 0xc2, 0x1f, 0xc1, 0x6a, 0x22, 0x2a,
+	0xc0, 0x5f, 0xc0, 0x40, 0x1b, 0x47, 0xd2, 0x2c, 0xd0, 0x7f, 0xa5, 0x5b, 0xc5, 0xd0, 0x94, 0x6e,
+	0x14, 0x7f, 0x02, 0x6c, 0x59, 0xcc, 0x67, 0x8e, 0x24, 0x61, 0xb0, 0xc4, 0xc4, 0xe1, 0xb2, 0x98,
+	0x7f, 0xf1, 0x98, 0x5f, 0x7a, 0x65, 0x64, 0xf5, 0xc2, 0xa5, 0xbd, 0x61, 0x3c, 0x1e, 0x5c, 0x3c,
+	0xfb, 0x77, 0x42, 0x93, 0xcf, 0x81, 0x25, 0x1a, 0xb6, 0x17, 0x43, 0x28, 0x73, 0x97, 0xf6, 0x87,
+	0xf1, 0x98, 0x89, 0x0a, 0x9c, 0xfd, 0x8e, 0xa0, 0x57, 0x31, 0x39, 0x87, 0xae, 0x91, 0x39, 0xd6,
+	0xb6, 0xc2, 0xd9, 0x0f, 0x6d, 0xe4, 0x6a, 0x8d, 0xc1, 0x55, 0x24, 0x2a, 0xb0, 0xbf, 0xf5, 0xf8,
+	0xfe, 0xd6, 0x3f, 0x40, 0x97, 0x64, 0xe6, 0xd2, 0x6e, 0x90, 0x77, 0xfe, 0x5f, 0x79, 0x93, 0x5b,
+	0x99, 0xb9, 0x2b, 0x43, 0x76, 0x2b, 0xc2, 0xd0, 0xd9, 0x25, 0xb0, 0xb6, 0xe4, 0x13, 0xfd, 0x8e,
+	0xdb, 0x5a, 0x90, 0x3f, 0xee, 0xeb, 0x61, 0xb5, 0x9e, 0xf7, 0x9d, 0x77, 0xd1, 0xe8, 0x67, 0x04,
+	0x49, 0x58, 0x35, 0x3f, 0x83, 0x43, 0x87, 0x1b, 0xb4, 0x9a, 0xaa, 0xd1, 0x44, 0xb4, 0xd8, 0xf7,
+	0x16, 0x92, 0x30, 0x2b, 0xec, 0xb6, 0xfe, 0x44, 0x8b, 0x43, 0x40, 0x9a, 0x56, 0x58, 0xff, 0x98,
+	0x15, 0xe0, 0x29, 0xf4, 0xdd, 0x3a, 0xcf, 0xa5, 0xdd, 0xd6, 0x9b, 0x6a, 0x20, 0x3f, 0x85, 0x9e,
+	0x2b, 0xd6, 0x76, 0xd1, 0xec, 0xa8, 0x46, 0xa3, 0x1c, 0xe2, 0x6b, 0x59, 0xfa, 0x41, 0x65, 0x8b,
+	0xb2, 0x44, 0x55, 0x3f, 0x8c, 0x06, 0xf2, 0x73, 0x78, 0xe8, 0x48, 0x5a, 0x9a, 0xed, 0x42, 0xec,
+	0x04, 0xc6, 0x71, 0x28, 0xdf, 0xb6, 0x49, 0xbe, 0x84, 0x07, 0x68, 0xd4, 0xec, 0x7e, 0xd6, 0x47,
+	0x68, 0x54, 0x4b, 0x9a, 0xf7, 0xc2, 0x03, 0x7d, 0xf3, 0x77, 0x00, 0x34, 0x7a, 0x47, 0xcb, 0xb0,
+	0x03, 0x00, 0x00,
 }
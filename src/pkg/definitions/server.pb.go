@@ -17,8 +17,31 @@ var _ = proto.Marshal
 var _ = fmt.Errorf
 var _ = math.Inf
 
+type DropPolicy int32
+
+const (
+	DropPolicy_DROP_NEWEST DropPolicy = 0
+	DropPolicy_DROP_OLDEST DropPolicy = 1
+)
+
+var DropPolicy_name = map[int32]string{
+	0: "DROP_NEWEST",
+	1: "DROP_OLDEST",
+}
+var DropPolicy_value = map[string]int32{
+	"DROP_NEWEST": 0,
+	"DROP_OLDEST": 1,
+}
+
+func (x DropPolicy) String() string {
+	return proto.EnumName(DropPolicy_name, int32(x))
+}
+func (DropPolicy) EnumDescriptor() ([]byte, []int) { return fileDescriptor1, []int{0} }
+
 type EgressRequest struct {
-	SubscriptionId string `protobuf:"bytes,1,opt,name=subscription_id,json=subscriptionId" json:"subscription_id,omitempty"`
+	SubscriptionId string     `protobuf:"bytes,1,opt,name=subscription_id,json=subscriptionId" json:"subscription_id,omitempty"`
+	BufferSize     int32      `protobuf:"varint,2,opt,name=buffer_size,json=bufferSize" json:"buffer_size,omitempty"`
+	DropPolicy     DropPolicy `protobuf:"varint,3,opt,name=drop_policy,json=dropPolicy,enum=definitions.DropPolicy" json:"drop_policy,omitempty"`
 }
 
 func (m *EgressRequest) Reset()                    { *m = EgressRequest{} }
@@ -33,8 +56,23 @@ func (m *EgressRequest) GetSubscriptionId() string {
 	return ""
 }
 
+func (m *EgressRequest) GetBufferSize() int32 {
+	if m != nil {
+		return m.BufferSize
+	}
+	return 0
+}
+
+func (m *EgressRequest) GetDropPolicy() DropPolicy {
+	if m != nil {
+		return m.DropPolicy
+	}
+	return DropPolicy_DROP_NEWEST
+}
+
 func init() {
 	proto.RegisterType((*EgressRequest)(nil), "definitions.EgressRequest")
+	proto.RegisterEnum("definitions.DropPolicy", DropPolicy_name, DropPolicy_value)
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -139,15 +177,21 @@ var _Egress_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("server.proto", fileDescriptor1) }
 
 var fileDescriptor1 = []byte{
-	// 152 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x29, 0x4e, 0x2d, 0x2a,
-	0x4b, 0x2d, 0xd2, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x4e, 0x49, 0x4d, 0xcb, 0xcc, 0xcb,
-	0x2c, 0xc9, 0xcc, 0xcf, 0x2b, 0x96, 0xe2, 0x49, 0x2d, 0x4b, 0xcd, 0x2b, 0x29, 0x86, 0x48, 0x29,
-	0x59, 0x70, 0xf1, 0xba, 0xa6, 0x17, 0xa5, 0x16, 0x17, 0x07, 0xa5, 0x16, 0x96, 0xa6, 0x16, 0x97,
-	0x08, 0xa9, 0x73, 0xf1, 0x17, 0x97, 0x26, 0x15, 0x27, 0x17, 0x65, 0x16, 0x80, 0xd4, 0xc7, 0x67,
-	0xa6, 0x48, 0x30, 0x2a, 0x30, 0x6a, 0x70, 0x06, 0xf1, 0x21, 0x0b, 0x7b, 0xa6, 0x18, 0x79, 0x73,
-	0xb1, 0x41, 0x74, 0x0a, 0x39, 0x72, 0x71, 0x3b, 0xe5, 0x17, 0x67, 0xf8, 0xa6, 0x96, 0x14, 0x65,
-	0x26, 0x17, 0x0b, 0x49, 0xe9, 0x21, 0x59, 0xa7, 0x87, 0x62, 0xba, 0x94, 0x10, 0xaa, 0x1c, 0xc8,
-	0x25, 0x4a, 0x0c, 0x06, 0x8c, 0x49, 0x6c, 0x60, 0xd7, 0x18, 0x03, 0x02, 0x00, 0x00, 0xff, 0xff,
-	0x51, 0xff, 0x2b, 0x13, 0xb8, 0x00, 0x00, 0x00,
+	// 242 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x54, 0x90, 0x4d, 0x4b, 0xc3, 0x40,
+	0x10, 0x86, 0xbb, 0x8a, 0x05, 0x27, 0xb5, 0x95, 0xbd, 0x18, 0x72, 0x31, 0xf4, 0x62, 0xf0, 0x10,
+	0xa4, 0x5e, 0xbc, 0x2a, 0xc9, 0x41, 0xfc, 0x68, 0xd9, 0x0a, 0x1e, 0x03, 0xc9, 0x4e, 0x74, 0x41,
+	0xb2, 0xeb, 0xcc, 0xa6, 0x60, 0xff, 0x86, 0x7f, 0x58, 0xd2, 0x40, 0x6d, 0x6e, 0xc3, 0xf3, 0x30,
+	0xcc, 0xbc, 0x2f, 0x4c, 0x18, 0x69, 0x83, 0x94, 0x3a, 0xb2, 0xde, 0xca, 0x40, 0x63, 0x6d, 0x1a,
+	0xe3, 0x8d, 0x6d, 0x38, 0x9a, 0xe0, 0x06, 0x1b, 0xcf, 0xbd, 0x9a, 0xff, 0x0a, 0x38, 0xcb, 0x3f,
+	0x08, 0x99, 0x15, 0x7e, 0xb7, 0xc8, 0x5e, 0x5e, 0xc1, 0x8c, 0xdb, 0x92, 0x2b, 0x32, 0xae, 0x5b,
+	0x28, 0x8c, 0x0e, 0x45, 0x2c, 0x92, 0x53, 0x35, 0x3d, 0xc4, 0x8f, 0x5a, 0x5e, 0x42, 0x50, 0xb6,
+	0x75, 0x8d, 0x54, 0xb0, 0xd9, 0x62, 0x78, 0x14, 0x8b, 0xe4, 0x44, 0x41, 0x8f, 0xd6, 0x66, 0x8b,
+	0xf2, 0x0e, 0x02, 0x4d, 0xd6, 0x15, 0xce, 0x7e, 0x99, 0xea, 0x27, 0x3c, 0x8e, 0x45, 0x32, 0x5d,
+	0x5c, 0xa4, 0x07, 0xcf, 0xa4, 0x19, 0x59, 0xb7, 0xda, 0x69, 0x05, 0x7a, 0x3f, 0x5f, 0xa7, 0x00,
+	0xff, 0x46, 0xce, 0x20, 0xc8, 0xd4, 0x72, 0x55, 0xbc, 0xe6, 0xef, 0xf9, 0xfa, 0xed, 0x7c, 0xb4,
+	0x07, 0xcb, 0xe7, 0xac, 0x03, 0x62, 0xf1, 0x04, 0xe3, 0x3e, 0x84, 0xbc, 0x87, 0xe0, 0xc1, 0xf2,
+	0xe7, 0x0b, 0x7a, 0x32, 0x15, 0xcb, 0x68, 0x70, 0x6d, 0x10, 0x34, 0x92, 0x43, 0xd7, 0xb5, 0x32,
+	0x1f, 0xdd, 0x88, 0x72, 0xbc, 0x6b, 0xe6, 0xf6, 0x6f, 0x00, 0xd3, 0x1d, 0xea, 0x70, 0x44, 0x01,
+	0x00, 0x00,
 }
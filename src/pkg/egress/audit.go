@@ -0,0 +1,75 @@
+package egress
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/audit"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+type auditor interface {
+	Log(audit.Entry)
+}
+
+// WithAuditLog records every stream that is allowed or denied, and
+// every allowed stream when it ends, to the audit log.
+func WithAuditLog(a auditor) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.auditor = a
+	}
+}
+
+// audit records a decision about the stream of the request. The
+// request is nil if it could not be parsed.
+func (s *BoshMetricsServer) audit(ctx context.Context, r *definitions.EgressRequest, p principal, d audit.Decision, err error, duration time.Duration) {
+	if s.auditor == nil {
+		return
+	}
+
+	e := audit.Entry{
+		Time:           time.Now(),
+		ClientID:       p.clientID,
+		SubscriptionID: r.GetSubscriptionId(),
+		Filters: audit.Filters{
+			BufferSize: r.GetBufferSize(),
+			DropPolicy: r.GetDropPolicy().String(),
+			Teams:      p.teams,
+		},
+		Decision: d,
+		Duration: duration.Seconds(),
+	}
+	if pr, ok := peer.FromContext(ctx); ok && pr.Addr != nil {
+		e.Peer = pr.Addr.String()
+	}
+	if err != nil {
+		e.Reason = redact(ctx, errorMessage(err))
+	}
+
+	s.auditor.Log(e)
+}
+
+// redact removes the token from the reason in case
+// the error of a token checker quotes it.
+func redact(ctx context.Context, reason string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, token := range md["authorization"] {
+		if i := strings.IndexByte(token, ' '); i >= 0 && i+1 < len(token) {
+			reason = strings.Replace(reason, token[i+1:], "[REDACTED]", -1)
+		}
+		if token != "" {
+			reason = strings.Replace(reason, token, "[REDACTED]", -1)
+		}
+	}
+
+	return reason
+}
+
+// remoteAddr is the address of an HTTP client.
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+func (a remoteAddr) String() string  { return string(a) }
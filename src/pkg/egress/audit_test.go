@@ -0,0 +1,125 @@
+package egress_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/audit"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/egress"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/peer"
+)
+
+func TestBoshMetricsAuditsAllowedStreamsUntilTheyEnd(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	auditor := &spyAuditor{}
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithAuditLog(auditor))
+	defer server.Start()()
+	defer close(messages)
+
+	ctx, cancel := context.WithCancel(validContext(tokenFor("firehose")))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}})
+	sender := newSpyEgressSender(ctx, 50)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.BoshMetrics(&definitions.EgressRequest{
+			SubscriptionId: "subscriptionA",
+			BufferSize:     50,
+			DropPolicy:     definitions.DropPolicy_DROP_OLDEST,
+		}, sender)
+	}()
+
+	Eventually(auditor.all).Should(HaveLen(1))
+	messages <- event
+	Eventually(sender.received).Should(Receive())
+	cancel()
+	Eventually(done).Should(BeClosed())
+
+	entries := auditor.all()
+	Expect(entries).To(HaveLen(2))
+	Expect(entries[0].Decision).To(Equal(audit.Allowed))
+	Expect(entries[0].Peer).To(Equal("10.0.0.1:5000"))
+	Expect(entries[0].ClientID).To(Equal("firehose"))
+	Expect(entries[0].SubscriptionID).To(Equal("subscriptionA"))
+	Expect(entries[0].Filters).To(Equal(audit.Filters{BufferSize: 50, DropPolicy: "DROP_OLDEST"}))
+	Expect(entries[1].Decision).To(Equal(audit.Ended))
+	Expect(entries[1].Duration).To(BeNumerically(">", 0))
+}
+
+func TestBoshMetricsAuditsDeniedStreamsWithoutTheToken(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	auditor := &spyAuditor{}
+	checker := newSpyTokenChecker(errors.New("invalid token: bearer secret-token"))
+	server := egress.NewServer(messages, checker, egress.WithAuditLog(auditor))
+	defer server.Start()()
+	defer close(messages)
+
+	err := server.BoshMetrics(
+		&definitions.EgressRequest{SubscriptionId: "subscriptionA"},
+		newSpyEgressSender(validContext("bearer secret-token"), 50),
+	)
+	Expect(err).To(HaveOccurred())
+
+	entries := auditor.all()
+	Expect(entries).To(HaveLen(1))
+	Expect(entries[0].Decision).To(Equal(audit.Denied))
+	Expect(entries[0].SubscriptionID).To(Equal("subscriptionA"))
+	Expect(entries[0].Reason).To(ContainSubstring("invalid token"))
+	Expect(entries[0].Reason).ToNot(ContainSubstring("secret-token"))
+}
+
+func TestSSEAuditsTheAddressOfDeniedClients(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	auditor := &spyAuditor{}
+	server := egress.NewServer(messages, newSpyTokenChecker(errors.New("token-invalid")), egress.WithAuditLog(auditor))
+	httpServer := httptest.NewServer(server.HTTPHandler())
+	defer httpServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, httpServer.URL+"/sse?subscription_id=subscriptionA", nil)
+	Expect(err).ToNot(HaveOccurred())
+	req.Header.Set("Authorization", "test-token")
+
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).ToNot(HaveOccurred())
+	resp.Body.Close()
+	Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+
+	entries := auditor.all()
+	Expect(entries).To(HaveLen(1))
+	Expect(entries[0].Decision).To(Equal(audit.Denied))
+	Expect(entries[0].SubscriptionID).To(Equal("subscriptionA"))
+	Expect(entries[0].Peer).To(HavePrefix("127.0.0.1:"))
+}
+
+type spyAuditor struct {
+	mu      sync.Mutex
+	entries []audit.Entry
+}
+
+func (a *spyAuditor) Log(e audit.Entry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.entries = append(a.entries, e)
+}
+
+func (a *spyAuditor) all() []audit.Entry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]audit.Entry(nil), a.entries...)
+}
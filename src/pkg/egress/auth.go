@@ -0,0 +1,130 @@
+package egress
+
+import (
+	"crypto/x509"
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	clientCertMissingErr = status.Error(codes.Unauthenticated, "Request does not include a verified client certificate")
+	clientCertDeniedErr  = func(err error) error {
+		return status.Errorf(codes.PermissionDenied, "Client certificate is not authorized: %s", err)
+	}
+)
+
+// AuthMode is how clients authenticate.
+type AuthMode int
+
+const (
+	// AuthUAA requires a UAA token.
+	AuthUAA AuthMode = iota
+	// AuthMTLS requires an authorized client certificate.
+	AuthMTLS
+	// AuthUAAOrMTLS accepts an authorized client certificate
+	// and otherwise requires a UAA token.
+	AuthUAAOrMTLS
+	// AuthUAAAndMTLS requires both.
+	AuthUAAAndMTLS
+)
+
+// ParseAuthMode converts a configuration value into an
+// AuthMode. An empty string means AuthUAA.
+func ParseAuthMode(s string) (AuthMode, error) {
+	switch s {
+	case "", "uaa":
+		return AuthUAA, nil
+	case "mtls":
+		return AuthMTLS, nil
+	case "uaa-or-mtls":
+		return AuthUAAOrMTLS, nil
+	case "uaa-and-mtls":
+		return AuthUAAAndMTLS, nil
+	default:
+		return AuthUAA, fmt.Errorf("unknown auth mode %q: must be uaa, mtls, uaa-or-mtls or uaa-and-mtls", s)
+	}
+}
+
+type certAuthorizer interface {
+	Authorize(cert *x509.Certificate) error
+}
+
+// WithClientCertAuth configures how clients authenticate and which
+// client certificates are authorized. The certificates must be
+// verified by the TLS configuration of the grpc and HTTP servers.
+func WithClientCertAuth(m AuthMode, a certAuthorizer) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.authMode = m
+		s.certAuthorizer = a
+	}
+}
+
+// principal is the authenticated client of a stream.
+type principal struct {
+	// token is empty for clients authenticated
+	// only by client certificate.
+	token string
+	// clientID is the client_id claim of the token, or the
+	// common name of the certificate without a token.
+	clientID string
+	// teams are the teams whose deployments the client may read,
+	// or nil if it may read every deployment.
+	teams []string
+	// exp is when the token expires, or 0 if it does not.
+	exp int64
+}
+
+// authorize authenticates the client according to the auth mode.
+func (s *BoshMetricsServer) authorize(ctx context.Context) (principal, error) {
+	switch s.authMode {
+	case AuthMTLS:
+		cn, err := s.checkClientCert(ctx)
+		if err != nil {
+			egressAuthErrCounter.Add(1)
+		}
+		return principal{clientID: cn}, err
+	case AuthUAAOrMTLS:
+		// A missing or denied certificate is not an auth error
+		// as long as the client has a valid token.
+		if cn, err := s.checkClientCert(ctx); err == nil {
+			return principal{clientID: cn}, nil
+		}
+		return s.checkToken(ctx)
+	case AuthUAAAndMTLS:
+		_, err := s.checkClientCert(ctx)
+		if err != nil {
+			egressAuthErrCounter.Add(1)
+			return principal{}, err
+		}
+		return s.checkToken(ctx)
+	default:
+		return s.checkToken(ctx)
+	}
+}
+
+// checkClientCert verifies that the peer presented a certificate
+// that is authorized and returns its common name.
+func (s *BoshMetricsServer) checkClientCert(ctx context.Context) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", clientCertMissingErr
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return "", clientCertMissingErr
+	}
+
+	cert := info.State.VerifiedChains[0][0]
+	err := s.certAuthorizer.Authorize(cert)
+	if err != nil {
+		return "", clientCertDeniedErr(err)
+	}
+
+	return cert.Subject.CommonName, nil
+}
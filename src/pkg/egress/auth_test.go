@@ -0,0 +1,142 @@
+package egress_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/egress"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestBoshMetricsAuthorizesClientCertificatesInMTLSMode(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	tokenChecker := newSpyTokenChecker(errors.New("token-invalid"))
+	server := egress.NewServer(messages, tokenChecker, egress.WithClientCertAuth(egress.AuthMTLS, allowCommonName("forwarder")))
+	defer server.Start()()
+	defer close(messages)
+
+	sender := newSpyEgressSender(withClientCert(context.Background(), "forwarder"), 50)
+	go server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "subscriptionA"}, sender)
+	time.Sleep(100 * time.Millisecond)
+	messages <- event
+
+	Eventually(sender.received).Should(Receive(Equal(event)))
+	Expect(tokenChecker.received).To(BeEmpty())
+}
+
+func TestBoshMetricsRejectsUnauthorizedClientsInMTLSMode(t *testing.T) {
+	RegisterTestingT(t)
+
+	server := egress.NewServer(nil, newSpyTokenChecker(nil), egress.WithClientCertAuth(egress.AuthMTLS, allowCommonName("forwarder")))
+	req := &definitions.EgressRequest{SubscriptionId: "subscriptionA"}
+
+	err := server.BoshMetrics(req, newSpyEgressSender(validContext("test-token"), 50))
+	Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+
+	err = server.BoshMetrics(req, newSpyEgressSender(withClientCert(context.Background(), "other"), 50))
+	Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+}
+
+func TestBoshMetricsFallsBackToTokensInUAAOrMTLSMode(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithClientCertAuth(egress.AuthUAAOrMTLS, allowCommonName("forwarder")))
+	defer server.Start()()
+	defer close(messages)
+
+	sender := newSpyEgressSender(withClientCert(validContext("test-token"), "other"), 50)
+	go server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "subscriptionA"}, sender)
+	time.Sleep(100 * time.Millisecond)
+	messages <- event
+
+	Eventually(sender.received).Should(Receive(Equal(event)))
+}
+
+func TestBoshMetricsDoesNotCountTokenFallbacksAsAuthErrors(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithClientCertAuth(egress.AuthUAAOrMTLS, allowCommonName("forwarder")))
+	defer server.Start()()
+	defer close(messages)
+
+	authErrs := expvar.Get("egress.auth_err").(*expvar.Int)
+	before := authErrs.Value()
+
+	sender := newSpyEgressSender(validContext("test-token"), 50)
+	go server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "subscriptionA"}, sender)
+	time.Sleep(100 * time.Millisecond)
+	messages <- event
+
+	Eventually(sender.received).Should(Receive(Equal(event)))
+	Expect(authErrs.Value()).To(Equal(before))
+}
+
+func TestBoshMetricsRequiresBothInUAAAndMTLSMode(t *testing.T) {
+	RegisterTestingT(t)
+
+	server := egress.NewServer(nil, newSpyTokenChecker(errors.New("token-invalid")), egress.WithClientCertAuth(egress.AuthUAAAndMTLS, allowCommonName("forwarder")))
+	req := &definitions.EgressRequest{SubscriptionId: "subscriptionA"}
+
+	err := server.BoshMetrics(req, newSpyEgressSender(withClientCert(validContext("test-token"), "forwarder"), 50))
+	Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+
+	server = egress.NewServer(nil, newSpyTokenChecker(nil), egress.WithClientCertAuth(egress.AuthUAAAndMTLS, allowCommonName("forwarder")))
+	err = server.BoshMetrics(req, newSpyEgressSender(validContext("test-token"), 50))
+	Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+}
+
+func TestParseAuthMode(t *testing.T) {
+	RegisterTestingT(t)
+
+	for s, m := range map[string]egress.AuthMode{
+		"":             egress.AuthUAA,
+		"uaa":          egress.AuthUAA,
+		"mtls":         egress.AuthMTLS,
+		"uaa-or-mtls":  egress.AuthUAAOrMTLS,
+		"uaa-and-mtls": egress.AuthUAAAndMTLS,
+	} {
+		mode, err := egress.ParseAuthMode(s)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mode).To(Equal(m))
+	}
+
+	_, err := egress.ParseAuthMode("basic")
+	Expect(err).To(HaveOccurred())
+}
+
+type allowCommonName string
+
+func (a allowCommonName) Authorize(cert *x509.Certificate) error {
+	if cert.Subject.CommonName != string(a) {
+		return errors.New("not allowed")
+	}
+
+	return nil
+}
+
+// withClientCert adds a peer that presented a verified
+// certificate with the common name.
+func withClientCert(ctx context.Context, commonName string) context.Context {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+
+	return peer.NewContext(ctx, &peer.Peer{
+		AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+		},
+	})
+}
@@ -0,0 +1,80 @@
+package egress
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// frame is an event on its way to every subscription. The event is
+// encoded at most once, by whichever stream sends it first, and the
+// encoded payload is shared with every other stream.
+//
+// The payload is never reused for another event because grpc may
+// still be writing it after SendMsg returns. It is left to the garbage
+// collector once no subscription holds the frame.
+type frame struct {
+	event *definitions.Event
+	// teams own the deployment of the event. They are
+	// only resolved when team scopes are enabled.
+	teams []string
+
+	once    sync.Once
+	payload []byte
+	err     error
+
+	jsonOnce    sync.Once
+	jsonPayload []byte
+	jsonErr     error
+}
+
+func newFrame(e *definitions.Event) *frame {
+	return &frame{event: e}
+}
+
+func (f *frame) encode() ([]byte, error) {
+	f.once.Do(func() {
+		f.payload, f.err = proto.Marshal(f.event)
+		if f.err == nil {
+			egressEncodedCounter.Add(1)
+		}
+	})
+
+	return f.payload, f.err
+}
+
+// encodeJSON returns the event encoded as JSON for clients
+// that are not using grpc.
+func (f *frame) encodeJSON() ([]byte, error) {
+	f.jsonOnce.Do(func() {
+		f.jsonPayload, f.jsonErr = marshalJSON(f.event)
+	})
+
+	return f.jsonPayload, f.jsonErr
+}
+
+func marshalJSON(e *definitions.Event) ([]byte, error) {
+	return protojson.MarshalOptions{UseProtoNames: true}.Marshal(proto.MessageV2(e))
+}
+
+// Codec returns a grpc codec that sends frames as their shared
+// pre-encoded payload and handles every other message as protobuf.
+func Codec() encoding.Codec {
+	return frameCodec{encoding.GetCodec("proto")}
+}
+
+type frameCodec struct {
+	encoding.Codec
+}
+
+func (c frameCodec) Marshal(v interface{}) ([]byte, error) {
+	if f, ok := v.(*frame); ok {
+		return f.encode()
+	}
+
+	return c.Codec.Marshal(v)
+}
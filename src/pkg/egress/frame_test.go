@@ -0,0 +1,146 @@
+package egress_test
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/egress"
+	"github.com/golang/protobuf/proto"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestSharedEncodingSendsEventsOverGrpc(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithSharedEncoding())
+
+	grpcServer := grpc.NewServer(grpc.ForceServerCodec(egress.Codec()))
+	definitions.RegisterEgressServer(grpcServer, server)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(), "authorization", "test-token"))
+	defer cancel()
+	client := definitions.NewEgressClient(conn)
+	streamA, err := client.BoshMetrics(ctx, &definitions.EgressRequest{SubscriptionId: "subscriptionA"})
+	Expect(err).ToNot(HaveOccurred())
+	streamB, err := client.BoshMetrics(ctx, &definitions.EgressRequest{SubscriptionId: "subscriptionB"})
+	Expect(err).ToNot(HaveOccurred())
+	time.Sleep(time.Millisecond * 100)
+
+	server.Start()
+	messages <- event
+	messages <- heartbeatEvent
+
+	for _, stream := range []definitions.Egress_BoshMetricsClient{streamA, streamB} {
+		e, err := stream.Recv()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proto.Equal(e, event)).To(BeTrue())
+
+		e, err = stream.Recv()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proto.Equal(e, heartbeatEvent)).To(BeTrue())
+	}
+}
+
+func TestCodecMarshalsOtherMessagesAsProtobuf(t *testing.T) {
+	RegisterTestingT(t)
+
+	b, err := egress.Codec().Marshal(event)
+	Expect(err).ToNot(HaveOccurred())
+
+	expected, err := proto.Marshal(event)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(b).To(Equal(expected))
+	Expect(egress.Codec().Name()).To(Equal("proto"))
+}
+
+func BenchmarkDispatchToTenStreams(b *testing.B) {
+	b.Run("marshal per stream", func(b *testing.B) {
+		benchmarkDispatchToTenStreams(b)
+	})
+	b.Run("shared encoding", func(b *testing.B) {
+		benchmarkDispatchToTenStreams(b, egress.WithSharedEncoding())
+	})
+}
+
+// benchmarkDispatchToTenStreams measures distributing events to ten
+// grpc streams, from the server's input to the clients' Recv.
+func benchmarkDispatchToTenStreams(b *testing.B, opts ...egress.ServerOpt) {
+	messages := make(chan *definitions.Event, b.N)
+	opts = append(opts, egress.WithSubscriptionBufferSize(b.N))
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), opts...)
+
+	grpcServer := grpc.NewServer(grpc.ForceServerCodec(egress.Codec()))
+	definitions.RegisterEgressServer(grpcServer, server)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(), "authorization", "test-token"))
+	defer cancel()
+	client := definitions.NewEgressClient(conn)
+
+	received := make([]int64, 10)
+	var wg sync.WaitGroup
+	for i := range received {
+		stream, err := client.BoshMetrics(ctx, &definitions.EgressRequest{SubscriptionId: fmt.Sprintf("subscription-%d", i)})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				if _, err := stream.Recv(); err != nil {
+					return
+				}
+				received[i]++
+			}
+		}(i)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	stop := server.Start()
+	for i := 0; i < b.N; i++ {
+		messages <- heartbeatEvent
+	}
+	close(messages)
+	stop()
+	wg.Wait()
+
+	b.StopTimer()
+	for _, n := range received {
+		if n != int64(b.N) {
+			b.Fatalf("expected %d events to be received, got %d", b.N, n)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package egress
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// replicas is the number of points each member gets on the ring.
+// More points spread keys more evenly between members.
+const replicas = 128
+
+// hashRing maps keys onto a set of members so that adding or
+// removing a member only moves the keys owned by that member.
+type hashRing struct {
+	points  []uint32
+	members map[uint32]string
+}
+
+func newHashRing() *hashRing {
+	return &hashRing{
+		members: make(map[uint32]string),
+	}
+}
+
+func (r *hashRing) add(member string) {
+	for i := 0; i < replicas; i++ {
+		p := hashKey(member + "#" + strconv.Itoa(i))
+		if _, ok := r.members[p]; ok {
+			continue
+		}
+		r.members[p] = member
+		r.points = append(r.points, p)
+	}
+
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func (r *hashRing) remove(member string) {
+	points := r.points[:0]
+	for _, p := range r.points {
+		if r.members[p] == member {
+			delete(r.members, p)
+			continue
+		}
+		points = append(points, p)
+	}
+
+	r.points = points
+}
+
+// get returns the member that owns key, or an empty
+// string if the ring has no members.
+func (r *hashRing) get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.members[r.points[i]]
+}
+
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
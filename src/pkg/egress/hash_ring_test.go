@@ -0,0 +1,60 @@
+package egress
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestHashRingIsEmptyWithoutMembers(t *testing.T) {
+	RegisterTestingT(t)
+
+	r := newHashRing()
+
+	Expect(r.get("instance-a")).To(BeEmpty())
+}
+
+func TestHashRingAssignsKeysToAllMembers(t *testing.T) {
+	RegisterTestingT(t)
+
+	r := newHashRing()
+	r.add("stream-1")
+	r.add("stream-2")
+	r.add("stream-3")
+
+	owners := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		owners[r.get(fmt.Sprintf("instance-%d", i))]++
+	}
+
+	Expect(owners).To(HaveLen(3))
+	for _, n := range owners {
+		Expect(n).To(BeNumerically(">", 150))
+	}
+}
+
+func TestHashRingOnlyMovesKeysOfRemovedMember(t *testing.T) {
+	RegisterTestingT(t)
+
+	r := newHashRing()
+	r.add("stream-1")
+	r.add("stream-2")
+	r.add("stream-3")
+
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("instance-%d", i)
+		before[k] = r.get(k)
+	}
+
+	r.remove("stream-2")
+
+	for k, owner := range before {
+		if owner == "stream-2" {
+			Expect(r.get(k)).ToNot(Equal("stream-2"))
+			continue
+		}
+		Expect(r.get(k)).To(Equal(owner))
+	}
+}
@@ -0,0 +1,312 @@
+package egress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/audit"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// WithSSEKeepAlive sets how often SSE streams are sent a keepalive
+// comment.
+func WithSSEKeepAlive(d time.Duration) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.sseKeepAliveInterval = d
+	}
+}
+
+// HTTPHandler returns a handler that serves subscriptions to clients
+// that do not speak grpc. Events are encoded as JSON and streamed as
+// Server-Sent Events from /sse or as WebSocket text messages from
+// /websocket.
+//
+// Clients authenticate with the same token as grpc clients, sent in
+// the Authorization header. The subscription_id, buffer_size and
+// drop_policy query parameters correspond to the EgressRequest fields.
+// WebSocket handshakes from browser pages of another origin are
+// rejected, and SSE streams are sent a comment when they are quiet so
+// that proxies do not close them.
+func (s *BoshMetricsServer) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sse", s.serveSSE)
+	mux.HandleFunc("/websocket", s.serveWebSocket)
+
+	return mux
+}
+
+func (s *BoshMetricsServer) serveSSE(w http.ResponseWriter, r *http.Request) {
+	req, ctx, p, ok := s.authorizeHTTP(w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Events and keepalives are written from different go routines.
+	var mu sync.Mutex
+	stream := &httpStream{ctx: ctx}
+	send := func(format string, a ...interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !stream.started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			stream.started = true
+		}
+
+		_, err := fmt.Fprintf(w, format, a...)
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+
+		return nil
+	}
+	stream.write = func(b []byte) error {
+		return send("data: %s\n\n", b)
+	}
+
+	stopKeepAlive := s.keepAlive(func() {
+		send(": keepalive\n\n")
+	})
+	err := s.serve(req, stream, p)
+	stopKeepAlive()
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+
+	if !stream.started {
+		writeHTTPError(w, err)
+		return
+	}
+	send("event: error\ndata: %s\n\n", errorMessage(err))
+}
+
+// keepAlive calls f every SSE keepalive interval until the
+// returned function is called.
+func (s *BoshMetricsServer) keepAlive(f func()) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(s.sseKeepAliveInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				f()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (s *BoshMetricsServer) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	req, ctx, p, ok := s.authorizeHTTP(w, r)
+	if !ok {
+		return
+	}
+
+	websocket.Server{
+		Handshake: checkOrigin,
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			// Clients are not expected to send anything, reading only
+			// detects when they go away.
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go func() {
+				defer cancel()
+				io.Copy(ioutil.Discard, ws)
+			}()
+
+			stream := &httpStream{
+				ctx: ctx,
+				write: func(b []byte) error {
+					return websocket.Message.Send(ws, string(b))
+				},
+			}
+
+			err := s.serve(req, stream, p)
+			if err != nil && ctx.Err() == nil {
+				b, _ := json.Marshal(map[string]string{"error": errorMessage(err)})
+				websocket.Message.Send(ws, string(b))
+			}
+		},
+	}.ServeHTTP(w, r)
+}
+
+// checkOrigin rejects WebSocket handshakes from browser pages of
+// another origin. Clients that are not browsers need not send an
+// Origin header.
+func checkOrigin(_ *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return fmt.Errorf("origin %q is not allowed", origin)
+	}
+
+	return nil
+}
+
+// authorizeHTTP checks the token in the Authorization header, or the
+// client certificate, and parses the subscription request. It writes
+// an error response and returns false if the request cannot be served.
+func (s *BoshMetricsServer) authorizeHTTP(w http.ResponseWriter, r *http.Request) (*definitions.EgressRequest, context.Context, principal, bool) {
+	md := metadata.MD{}
+	if token := r.Header.Get("Authorization"); token != "" {
+		md.Set("authorization", token)
+	}
+	ctx := metadata.NewIncomingContext(r.Context(), md)
+	pr := &peer.Peer{Addr: remoteAddr(r.RemoteAddr)}
+	if r.TLS != nil {
+		pr.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+	}
+	ctx = peer.NewContext(ctx, pr)
+
+	req, reqErr := parseEgressRequest(r)
+
+	p, err := s.authorize(ctx)
+	if err != nil {
+		s.audit(ctx, req, principal{}, audit.Denied, err, 0)
+		writeHTTPError(w, err)
+		return nil, nil, principal{}, false
+	}
+
+	if reqErr != nil {
+		s.audit(ctx, req, p, audit.Denied, reqErr, 0)
+		http.Error(w, reqErr.Error(), http.StatusBadRequest)
+		return nil, nil, principal{}, false
+	}
+
+	return req, ctx, p, true
+}
+
+func parseEgressRequest(r *http.Request) (*definitions.EgressRequest, error) {
+	q := r.URL.Query()
+	req := &definitions.EgressRequest{
+		SubscriptionId: q.Get("subscription_id"),
+	}
+
+	if v := q.Get("buffer_size"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid buffer_size %q", v)
+		}
+		req.BufferSize = int32(size)
+	}
+
+	if v := q.Get("drop_policy"); v != "" {
+		p, ok := definitions.DropPolicy_value[strings.ToUpper(v)]
+		if !ok {
+			return nil, fmt.Errorf("invalid drop_policy %q", v)
+		}
+		req.DropPolicy = definitions.DropPolicy(p)
+	}
+
+	return req, nil
+}
+
+func writeHTTPError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch status.Code(err) {
+	case codes.Unauthenticated:
+		code = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		code = http.StatusForbidden
+	case codes.ResourceExhausted:
+		code = http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		code = http.StatusConflict
+	case codes.Unavailable:
+		code = http.StatusServiceUnavailable
+	}
+	if err == authorizationMissingErr {
+		code = http.StatusUnauthorized
+	}
+
+	http.Error(w, errorMessage(err), code)
+}
+
+func errorMessage(err error) string {
+	if st, ok := status.FromError(err); ok {
+		return st.Message()
+	}
+
+	return err.Error()
+}
+
+// httpStream adapts an HTTP response to the grpc stream
+// interface used to serve subscriptions.
+type httpStream struct {
+	ctx     context.Context
+	write   func([]byte) error
+	started bool
+
+	grpc.ServerStream
+}
+
+func (s *httpStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *httpStream) Send(e *definitions.Event) error {
+	b, err := marshalJSON(e)
+	if err != nil {
+		return err
+	}
+
+	return s.write(b)
+}
+
+func (s *httpStream) SendMsg(m interface{}) error {
+	f, ok := m.(*frame)
+	if !ok {
+		return fmt.Errorf("unable to send %T over http", m)
+	}
+
+	b, err := f.encodeJSON()
+	if err != nil {
+		log.Printf("unable to encode event as json: %s\n", err)
+		return err
+	}
+
+	return s.write(b)
+}
@@ -0,0 +1,190 @@
+package egress_test
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/egress"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/websocket"
+)
+
+func TestSSEStreamsEventsAsJSON(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	tokenChecker := newSpyTokenChecker(nil)
+	server := egress.NewServer(messages, tokenChecker, egress.WithSharedEncoding())
+	httpServer := httptest.NewServer(server.HTTPHandler())
+	defer httpServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, httpServer.URL+"/sse?subscription_id=subscriptionA", nil)
+	Expect(err).ToNot(HaveOccurred())
+	req.Header.Set("Authorization", "test-token")
+
+	server.Start()
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		messages <- event
+	}()
+
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).ToNot(HaveOccurred())
+	defer resp.Body.Close()
+
+	Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+	Expect(tokenChecker.received).To(Receive(Equal("test-token")))
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	Expect(err).ToNot(HaveOccurred())
+	Expect(line).To(HavePrefix("data: {"))
+	Expect(line).To(ContainSubstring(`"title":"SSH Access Denied"`))
+	Expect(line).To(ContainSubstring(`"deployment":"loggregator"`))
+}
+
+func TestSSESendsKeepalivesWhileTheStreamIsQuiet(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithSSEKeepAlive(10*time.Millisecond))
+	httpServer := httptest.NewServer(server.HTTPHandler())
+	defer httpServer.Close()
+	defer server.Start()()
+	defer close(messages)
+
+	req, err := http.NewRequest(http.MethodGet, httpServer.URL+"/sse?subscription_id=subscriptionA", nil)
+	Expect(err).ToNot(HaveOccurred())
+	req.Header.Set("Authorization", "test-token")
+
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).ToNot(HaveOccurred())
+	defer resp.Body.Close()
+
+	Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	Expect(err).ToNot(HaveOccurred())
+	Expect(line).To(Equal(": keepalive\n"))
+}
+
+func TestSSERejectsInvalidTokens(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(messages, newSpyTokenChecker(errors.New("token-invalid")))
+	httpServer := httptest.NewServer(server.HTTPHandler())
+	defer httpServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, httpServer.URL+"/sse", nil)
+	Expect(err).ToNot(HaveOccurred())
+	req.Header.Set("Authorization", "test-token")
+
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).ToNot(HaveOccurred())
+	defer resp.Body.Close()
+
+	Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+}
+
+func TestSSERequiresAnAuthorizationHeader(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil))
+	httpServer := httptest.NewServer(server.HTTPHandler())
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL + "/sse")
+	Expect(err).ToNot(HaveOccurred())
+	defer resp.Body.Close()
+
+	Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+}
+
+func TestSSERejectsInvalidQueryParameters(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil))
+	httpServer := httptest.NewServer(server.HTTPHandler())
+	defer httpServer.Close()
+
+	for _, query := range []string{"buffer_size=lots", "drop_policy=drop_everything"} {
+		req, err := http.NewRequest(http.MethodGet, httpServer.URL+"/sse?"+query, nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Authorization", "test-token")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	}
+}
+
+func TestWebSocketStreamsEventsAsJSON(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil))
+	httpServer := httptest.NewServer(server.HTTPHandler())
+	defer httpServer.Close()
+
+	wsURL := strings.Replace(httpServer.URL, "http", "ws", 1) + "/websocket?subscription_id=subscriptionA&drop_policy=drop_oldest"
+	config, err := websocket.NewConfig(wsURL, httpServer.URL)
+	Expect(err).ToNot(HaveOccurred())
+	config.Header.Set("Authorization", "test-token")
+
+	ws, err := websocket.DialConfig(config)
+	Expect(err).ToNot(HaveOccurred())
+	defer ws.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	server.Start()
+	messages <- heartbeatEvent
+
+	var msg string
+	Expect(websocket.Message.Receive(ws, &msg)).To(Succeed())
+	Expect(msg).To(ContainSubstring(`"instance_id":"6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9"`))
+	Expect(msg).To(ContainSubstring(`"name":"system.cpu.user"`))
+}
+
+func TestWebSocketRejectsInvalidTokens(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(messages, newSpyTokenChecker(errors.New("token-invalid")))
+	httpServer := httptest.NewServer(server.HTTPHandler())
+	defer httpServer.Close()
+
+	wsURL := strings.Replace(httpServer.URL, "http", "ws", 1) + "/websocket"
+	config, err := websocket.NewConfig(wsURL, httpServer.URL)
+	Expect(err).ToNot(HaveOccurred())
+	config.Header.Set("Authorization", "test-token")
+
+	_, err = websocket.DialConfig(config)
+	Expect(err).To(HaveOccurred())
+}
+
+func TestWebSocketRejectsOtherOrigins(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil))
+	httpServer := httptest.NewServer(server.HTTPHandler())
+	defer httpServer.Close()
+
+	wsURL := strings.Replace(httpServer.URL, "http", "ws", 1) + "/websocket?subscription_id=subscriptionA"
+	config, err := websocket.NewConfig(wsURL, "https://attacker.example.com")
+	Expect(err).ToNot(HaveOccurred())
+	config.Header.Set("Authorization", "test-token")
+
+	_, err = websocket.DialConfig(config)
+	Expect(err).To(HaveOccurred())
+}
@@ -0,0 +1,80 @@
+package egress
+
+import (
+	"expvar"
+	"path"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var subscriptionOwnedErr = func(subscription string) error {
+	return status.Errorf(codes.PermissionDenied, "Unable to join subscription %q: it belongs to another client", subscription)
+}
+
+// SharingPolicy decides which clients other than its owner may join
+// a subscription. The owner is the client that created it.
+type SharingPolicy struct {
+	// Subscriptions are subscription ids, or path.Match patterns,
+	// that any client may join.
+	Subscriptions []string
+	// Clients maps an owner's client id to the other
+	// clients that may join its subscriptions.
+	Clients map[string][]string
+}
+
+// WithSubscriptionOwnership binds every subscription to the client
+// that created it. Other clients are rejected unless the policy
+// allows them to share it. Clients without a known identity are
+// not bound.
+func WithSubscriptionOwnership(p SharingPolicy) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.sharingPolicy = &p
+	}
+}
+
+// mayJoin returns whether the client may join the
+// subscription owned by owner.
+func (p *SharingPolicy) mayJoin(subscription, owner, client string) bool {
+	if owner == "" || owner == client {
+		return true
+	}
+
+	for _, pattern := range p.Subscriptions {
+		if ok, _ := path.Match(pattern, subscription); ok {
+			return true
+		}
+	}
+
+	for _, c := range p.Clients[owner] {
+		if c == client {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setOwner records the owner of a new subscription.
+func (s *BoshMetricsServer) setOwner(sub *subscription, owner string) {
+	if s.sharingPolicy == nil {
+		return
+	}
+
+	sub.owner = owner
+	v := new(expvar.String)
+	v.Set(owner)
+	egressSubscriptionOwner.Set(sub.id, v)
+}
+
+// checkOwner returns an error if the client may not
+// join the existing subscription.
+func (s *BoshMetricsServer) checkOwner(sub *subscription, client string) error {
+	if s.sharingPolicy == nil || s.sharingPolicy.mayJoin(sub.id, sub.owner, client) {
+		return nil
+	}
+
+	egressSubscriptionOwnerRejected.Add(sub.id, 1)
+
+	return subscriptionOwnedErr(sub.id)
+}
@@ -0,0 +1,98 @@
+package egress_test
+
+import (
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/egress"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSubscriptionsAreBoundToTheClientThatCreatedThem(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithSubscriptionOwnership(egress.SharingPolicy{}))
+	defer server.Start()()
+	defer close(messages)
+
+	req := &definitions.EgressRequest{SubscriptionId: "team-a-metrics"}
+	owner := newSpyEgressSender(validContext(tokenFor("team-a-forwarder")), 50)
+	go server.BoshMetrics(req, owner)
+	time.Sleep(100 * time.Millisecond)
+
+	err := server.BoshMetrics(req, newSpyEgressSender(validContext(tokenFor("team-b-forwarder")), 50))
+	Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+
+	sameClient := newSpyEgressSender(validContext(tokenFor("team-a-forwarder")), 50)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.BoshMetrics(req, sameClient)
+	}()
+	Consistently(errs, 100*time.Millisecond).ShouldNot(Receive())
+
+	owners := expvar.Get("egress.subscription_owner").(*expvar.Map)
+	Expect(owners.Get("team-a-metrics").String()).To(Equal(`"team-a-forwarder"`))
+}
+
+func TestSharingPolicyAllowsOtherClientsToJoin(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithSubscriptionOwnership(egress.SharingPolicy{
+		Subscriptions: []string{"shared-*"},
+		Clients:       map[string][]string{"team-a-forwarder": {"team-a-standby"}},
+	}))
+	defer server.Start()()
+	defer close(messages)
+
+	for _, c := range []struct {
+		subscription, owner, other string
+	}{
+		{"shared-metrics", "team-a-forwarder", "team-b-forwarder"},
+		{"team-a-metrics", "team-a-forwarder", "team-a-standby"},
+	} {
+		req := &definitions.EgressRequest{SubscriptionId: c.subscription}
+		go server.BoshMetrics(req, newSpyEgressSender(validContext(tokenFor(c.owner)), 50))
+		time.Sleep(100 * time.Millisecond)
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- server.BoshMetrics(req, newSpyEgressSender(validContext(tokenFor(c.other)), 50))
+		}()
+		Consistently(errs, 100*time.Millisecond).ShouldNot(Receive(), c.subscription)
+	}
+}
+
+func TestSubscriptionsAreSharedWithoutOwnership(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil))
+	defer server.Start()()
+	defer close(messages)
+
+	req := &definitions.EgressRequest{SubscriptionId: "team-a-metrics"}
+	go server.BoshMetrics(req, newSpyEgressSender(validContext(tokenFor("team-a-forwarder")), 50))
+	time.Sleep(100 * time.Millisecond)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.BoshMetrics(req, newSpyEgressSender(validContext(tokenFor("team-b-forwarder")), 50))
+	}()
+	Consistently(errs, 100*time.Millisecond).ShouldNot(Receive())
+}
+
+// tokenFor returns an unsigned token with the client_id claim.
+func tokenFor(clientID string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"client_id":%q}`, clientID)))
+
+	return fmt.Sprintf("bearer %s.%s.", header, payload)
+}
@@ -0,0 +1,271 @@
+package egress
+
+import (
+	"expvar"
+	"hash/fnv"
+	"sync"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+)
+
+// registry holds every subscription, split into shards so that
+// registering a stream only contends with the subscriptions and
+// the dispatcher of one shard.
+type registry struct {
+	shards []*shard
+}
+
+// shard queues alerts apart from heartbeats so that alerts reach the
+// shard's subscriptions ahead of any heartbeats already queued.
+type shard struct {
+	in *lanes[*frame]
+
+	mu            sync.RWMutex
+	subscriptions map[string]*subscription
+}
+
+func newRegistry(n int) *registry {
+	if n < 1 {
+		n = 1
+	}
+
+	r := &registry{
+		shards: make([]*shard, n),
+	}
+	for i := range r.shards {
+		r.shards[i] = &shard{
+			in:            newLanes[*frame](256, 256),
+			subscriptions: make(map[string]*subscription),
+		}
+	}
+
+	return r
+}
+
+func (r *registry) shardFor(subscriptionId string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(subscriptionId))
+	return r.shards[h.Sum32()%uint32(len(r.shards))]
+}
+
+// each calls f for every subscription in the registry.
+func (r *registry) each(f func(*subscription)) {
+	for _, sh := range r.shards {
+		sh.mu.RLock()
+		for _, sub := range sh.subscriptions {
+			f(sub)
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+// write queues the frame on the shard's alert or heartbeat input.
+func (sh *shard) write(f *frame) {
+	if f.event.GetAlert() != nil {
+		sh.in.alerts <- f
+		return
+	}
+	sh.in.events <- f
+}
+
+// dispatch offers every event from the shard's input to each of its
+// subscriptions until the input is closed, alerts first.
+func (sh *shard) dispatch() {
+	in := *sh.in
+	for {
+		f, ok := in.next(nil)
+		if !ok {
+			return
+		}
+
+		sh.mu.RLock()
+		for _, sub := range sh.subscriptions {
+			sub.offer(f)
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+// subscribe joins the stream identified by key to the requested
+// subscription, creating the subscription owned by the client if it
+// does not exist yet. It returns an error if a new subscription would
+// exceed the subscription buffer budget, or if the client may not
+// join an existing one.
+func (s *BoshMetricsServer) subscribe(r *definitions.EgressRequest, key string, p principal) (*subscription, lanes[*frame], error) {
+	sh := s.registry.shardFor(r.SubscriptionId)
+
+	sh.mu.Lock()
+	sub, ok := sh.subscriptions[r.SubscriptionId]
+	if ok {
+		defer sh.mu.Unlock()
+		if err := s.checkOwner(sub, p.clientID); err != nil {
+			return nil, lanes[*frame]{}, err
+		}
+		if err := s.checkTeams(sub, p.teams); err != nil {
+			return nil, lanes[*frame]{}, err
+		}
+		if err := s.checkBuffer(sub, r); err != nil {
+			return nil, lanes[*frame]{}, err
+		}
+		return s.join(sub, key)
+	}
+	sh.mu.Unlock()
+
+	// With consistent hashing the subscription has no buffer of its
+	// own, the buffer of each stream is reserved as it joins.
+	size := s.bufferSizeFor(r) + s.alertBufferSize
+	shared := s.distribution != DistributeConsistentHash
+	if shared && !s.reserveBuffer(size) {
+		s.evictIdleSubscriptions()
+		if !s.reserveBuffer(size) {
+			egressSubscriptionRejected.Add(1)
+			return nil, lanes[*frame]{}, bufferBudgetExceededErr(r.SubscriptionId, size, s.remainingBuffer())
+		}
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	// Another stream may have created the subscription
+	// while the shard was unlocked.
+	sub, ok = sh.subscriptions[r.SubscriptionId]
+	if ok {
+		if shared {
+			s.releaseBuffer(size)
+		}
+		if err := s.checkOwner(sub, p.clientID); err != nil {
+			return nil, lanes[*frame]{}, err
+		}
+		if err := s.checkTeams(sub, p.teams); err != nil {
+			return nil, lanes[*frame]{}, err
+		}
+		if err := s.checkBuffer(sub, r); err != nil {
+			return nil, lanes[*frame]{}, err
+		}
+		return s.join(sub, key)
+	}
+
+	sub = newSubscription(r.SubscriptionId, s.bufferSizeFor(r), s.alertBufferSize, r.DropPolicy, s.distribution)
+	sub.reserve = s.reserveBuffer
+	sub.release = s.releaseBuffer
+	sub.teams = p.teams
+
+	// The first stream of a new subscription must fit in the
+	// budget before the subscription is registered.
+	_, l, err := s.join(sub, key)
+	if err != nil {
+		return nil, lanes[*frame]{}, err
+	}
+	s.setOwner(sub, p.clientID)
+	sh.subscriptions[r.SubscriptionId] = sub
+
+	return sub, l, nil
+}
+
+// join joins the stream identified by key to the subscription. It
+// returns an error if the budget has no room for the stream's buffer.
+func (s *BoshMetricsServer) join(sub *subscription, key string) (*subscription, lanes[*frame], error) {
+	l, ok := sub.join(key)
+	if !ok {
+		egressSubscriptionRejected.Add(1)
+		return nil, lanes[*frame]{}, bufferBudgetExceededErr(sub.id, sub.size(), s.remainingBuffer())
+	}
+
+	return sub, l, nil
+}
+
+// checkBuffer returns an error if the client requested a buffer size or
+// drop policy other than the ones the subscription was created with.
+func (s *BoshMetricsServer) checkBuffer(sub *subscription, r *definitions.EgressRequest) error {
+	size := s.bufferSizeFor(r)
+	if size != sub.bufferSize || r.DropPolicy != sub.dropPolicy {
+		return subscriptionBufferErr(sub.id, size, r.DropPolicy, sub.bufferSize, sub.dropPolicy)
+	}
+
+	return nil
+}
+
+// bufferSizeFor returns the buffer size requested by the client,
+// limited to the maximum allowed by the operator.
+func (s *BoshMetricsServer) bufferSizeFor(r *definitions.EgressRequest) int {
+	size := s.subscriptionBufferSize
+	if r.BufferSize > 0 {
+		size = int(r.BufferSize)
+	}
+
+	if s.maxSubscriptionBufferSize > 0 && size > s.maxSubscriptionBufferSize {
+		size = s.maxSubscriptionBufferSize
+	}
+
+	return size
+}
+
+// reserveBuffer takes size events from the subscription buffer
+// budget. It returns false if there is not enough left.
+func (s *BoshMetricsServer) reserveBuffer(size int) bool {
+	s.budgetMu.Lock()
+	defer s.budgetMu.Unlock()
+
+	if s.subscriptionBufferBudget > 0 && s.bufferAllocated+size > s.subscriptionBufferBudget {
+		return false
+	}
+
+	s.bufferAllocated += size
+	egressSubscriptionBufferAllocated.Set(int64(s.bufferAllocated))
+
+	return true
+}
+
+func (s *BoshMetricsServer) releaseBuffer(size int) {
+	s.budgetMu.Lock()
+	defer s.budgetMu.Unlock()
+
+	s.bufferAllocated -= size
+	egressSubscriptionBufferAllocated.Set(int64(s.bufferAllocated))
+}
+
+func (s *BoshMetricsServer) remainingBuffer() int {
+	s.budgetMu.Lock()
+	defer s.budgetMu.Unlock()
+
+	return s.subscriptionBufferBudget - s.bufferAllocated
+}
+
+// evictIdleSubscriptions frees the buffers of subscriptions that
+// have no connected streams.
+func (s *BoshMetricsServer) evictIdleSubscriptions() {
+	for _, sh := range s.registry.shards {
+		sh.mu.Lock()
+		for id, sub := range sh.subscriptions {
+			if sub.streamCount() > 0 {
+				continue
+			}
+
+			sub.close()
+			delete(sh.subscriptions, id)
+			deleteSubscriptionMetrics(id)
+			if sub.ring == nil {
+				s.releaseBuffer(sub.size())
+			}
+			egressSubscriptionEvicted.Add(1)
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// deleteSubscriptionMetrics removes the metrics of a subscription that
+// is no longer registered, so they are not exported forever.
+func deleteSubscriptionMetrics(id string) {
+	for _, m := range []*expvar.Map{
+		egressSubscriptionSent,
+		egressSubscriptionDropped,
+		egressSubscriptionQueueDepth,
+		egressSubscriptionGapsSent,
+		egressSlowConsumerEvicted,
+		egressSlowConsumerDegraded,
+		egressSubscriptionOwner,
+		egressSubscriptionOwnerRejected,
+	} {
+		m.Delete(id)
+	}
+}
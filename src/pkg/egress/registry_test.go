@@ -0,0 +1,105 @@
+package egress_test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/egress"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func TestShardedDispatchKeepsOrderPerSubscription(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithDispatchShards(4))
+
+	senders := make([]*spyEgressSender, 10)
+	for i := range senders {
+		senders[i] = newSpyEgressSender(validContext("test-token"), 100, withSendRate(0))
+		req := &definitions.EgressRequest{SubscriptionId: fmt.Sprintf("subscription-%d", i)}
+		go server.BoshMetrics(req, senders[i])
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	server.Start()
+	for i := 0; i < 100; i++ {
+		messages <- &definitions.Event{Id: fmt.Sprint(i)}
+	}
+
+	for _, s := range senders {
+		for i := 0; i < 100; i++ {
+			var e *definitions.Event
+			Eventually(s.received).Should(Receive(&e))
+			Expect(e.GetId()).To(Equal(fmt.Sprint(i)))
+		}
+	}
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	for _, shards := range []int{1, 8} {
+		for _, subscriptions := range []int{1, 10, 100} {
+			name := fmt.Sprintf("%d shards/%d subscriptions", shards, subscriptions)
+			b.Run(name, func(b *testing.B) {
+				benchmarkDispatch(b, shards, subscriptions)
+			})
+		}
+	}
+}
+
+func benchmarkDispatch(b *testing.B, shards, subscriptions int) {
+	messages := make(chan *definitions.Event, b.N)
+	server := egress.NewServer(
+		messages,
+		newSpyTokenChecker(nil),
+		egress.WithDispatchShards(shards),
+		egress.WithSubscriptionBufferSize(b.N),
+	)
+
+	senders := make([]*countingSender, subscriptions)
+	for i := range senders {
+		senders[i] = &countingSender{ctx: validContext("test-token")}
+		req := &definitions.EgressRequest{SubscriptionId: fmt.Sprintf("subscription-%d", i)}
+		go server.BoshMetrics(req, senders[i])
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	stop := server.Start()
+	for i := 0; i < b.N; i++ {
+		messages <- heartbeatEvent
+	}
+	close(messages)
+	stop()
+
+	b.StopTimer()
+	for _, s := range senders {
+		if n := atomic.LoadInt64(&s.sent); n != int64(b.N) {
+			b.Fatalf("expected %d events to be sent, got %d", b.N, n)
+		}
+	}
+}
+
+// countingSender is a stream that only counts what it is sent.
+type countingSender struct {
+	ctx  context.Context
+	sent int64
+
+	grpc.ServerStream
+}
+
+func (s *countingSender) Context() context.Context {
+	return s.ctx
+}
+
+func (s *countingSender) Send(*definitions.Event) error {
+	atomic.AddInt64(&s.sent, 1)
+	return nil
+}
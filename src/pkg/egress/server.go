@@ -3,13 +3,20 @@ package egress
 import (
 	"log"
 
+	"runtime"
+
 	"expvar"
 
 	"errors"
 
 	"sync"
 
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/audit"
 	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/tokenchecker"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
@@ -20,17 +27,56 @@ var (
 	invalidAuthErr          = func(err error) error {
 		return status.Errorf(codes.PermissionDenied, "Authorization token is invalid. It must include the bosh.system_metrics.read authority and not be expired: %s", err)
 	}
+	tokenCheckUnavailableErr = func(err error) error {
+		return status.Errorf(codes.Unavailable, "Unable to check authorization token: %s", err)
+	}
+	bufferBudgetExceededErr = func(subscription string, size, remaining int) error {
+		return status.Errorf(codes.ResourceExhausted, "Unable to subscribe to %q: a buffer of %d events exceeds the %d events left in the server's subscription buffer budget", subscription, size, remaining)
+	}
+	subscriptionBufferErr = func(subscription string, size int, policy definitions.DropPolicy, subSize int, subPolicy definitions.DropPolicy) error {
+		return status.Errorf(codes.FailedPrecondition, "Unable to subscribe to %q: requested a buffer of %d events with %s but the subscription has a buffer of %d events with %s", subscription, size, policy, subSize, subPolicy)
+	}
 )
 
 type BoshMetricsServer struct {
 	messages     chan *definitions.Event
+	alerts       chan *definitions.Event
 	tokenChecker tokenChecker
 
 	wg sync.WaitGroup
 
-	mu                     sync.RWMutex
-	registry               map[string]chan *definitions.Event
+	registry               *registry
+	dispatchShards         int
 	subscriptionBufferSize int
+	alertBufferSize        int
+	distribution           Distribution
+
+	maxSubscriptionBufferSize int
+	subscriptionBufferBudget  int
+
+	budgetMu        sync.Mutex
+	bufferAllocated int
+
+	sharedEncoding bool
+
+	slowConsumerPolicy SlowConsumerPolicy
+	streamCount        uint64
+
+	sinks []Sink
+
+	tokenRevalidationInterval time.Duration
+
+	authMode       AuthMode
+	certAuthorizer certAuthorizer
+
+	sharingPolicy *SharingPolicy
+
+	teamAuthority   string
+	deploymentTeams deploymentTeams
+
+	auditor auditor
+
+	sseKeepAliveInterval time.Duration
 }
 
 var (
@@ -39,6 +85,29 @@ var (
 	egressAuthErrCounter      *expvar.Int
 	egressSubscriptionDropped *expvar.Map
 	egressProcessedCounter    *expvar.Int
+	egressEncodedCounter      *expvar.Int
+
+	egressSubscriptionQueueDepth *expvar.Map
+	egressStreamSendLatency      *expvar.Map
+	egressSlowConsumerEvicted    *expvar.Map
+	egressSlowConsumerDegraded   *expvar.Map
+	egressSubscriptionGapsSent   *expvar.Map
+
+	egressSubscriptionBufferAllocated *expvar.Int
+	egressSubscriptionRejected        *expvar.Int
+	egressSubscriptionEvicted         *expvar.Int
+
+	egressTokenEndedCounter       *expvar.Int
+	egressTokenUnavailableCounter *expvar.Int
+
+	egressSubscriptionOwner         *expvar.Map
+	egressSubscriptionOwnerRejected *expvar.Map
+
+	egressTeamFiltered *expvar.Int
+	egressTeamRejected *expvar.Int
+
+	egressClientStreams *expvar.Map
+	egressClientSent    *expvar.Map
 )
 
 func init() {
@@ -47,12 +116,66 @@ func init() {
 	egressAuthErrCounter = expvar.NewInt("egress.auth_err")
 	egressSubscriptionDropped = expvar.NewMap("egress.subscription_dropped")
 	egressProcessedCounter = expvar.NewInt("egress.processed")
+	egressEncodedCounter = expvar.NewInt("egress.encoded")
+
+	egressSubscriptionQueueDepth = expvar.NewMap("egress.subscription_queue_depth")
+	egressStreamSendLatency = expvar.NewMap("egress.stream_send_latency_ms")
+	egressSlowConsumerEvicted = expvar.NewMap("egress.slow_consumer_evicted")
+	egressSlowConsumerDegraded = expvar.NewMap("egress.slow_consumer_degraded")
+	egressSubscriptionGapsSent = expvar.NewMap("egress.subscription_gaps_sent")
+
+	egressSubscriptionBufferAllocated = expvar.NewInt("egress.subscription_buffer_allocated")
+	egressSubscriptionRejected = expvar.NewInt("egress.subscription_rejected")
+	egressSubscriptionEvicted = expvar.NewInt("egress.subscription_evicted")
+
+	egressTokenEndedCounter = expvar.NewInt("egress.token_ended")
+	egressTokenUnavailableCounter = expvar.NewInt("egress.token_check_unavailable")
+
+	egressSubscriptionOwner = expvar.NewMap("egress.subscription_owner")
+	egressSubscriptionOwnerRejected = expvar.NewMap("egress.subscription_owner_rejected")
+
+	egressTeamFiltered = expvar.NewInt("egress.team_filtered")
+	egressTeamRejected = expvar.NewInt("egress.team_rejected")
+
+	egressClientStreams = expvar.NewMap("egress.client_streams")
+	egressClientSent = expvar.NewMap("egress.client_sent")
 }
 
 type tokenChecker interface {
 	CheckToken(token string) error
 }
 
+// contextTokenChecker is implemented by token checkers that
+// stop checking a token when the stream's context is done.
+type contextTokenChecker interface {
+	CheckTokenContext(ctx context.Context, token string) error
+}
+
+// claimsTokenChecker is implemented by token checkers that also
+// return the claims of the tokens they accept.
+type claimsTokenChecker interface {
+	CheckTokenClaims(ctx context.Context, token string) (*tokenchecker.Claims, error)
+}
+
+// revalidatingTokenChecker is implemented by token checkers that
+// cache results, to check a token again without the cached result.
+type revalidatingTokenChecker interface {
+	RevalidateTokenClaims(ctx context.Context, token string) (*tokenchecker.Claims, error)
+}
+
+// unavailableError is implemented by errors of token checkers that
+// could not check a token, rather than finding it invalid.
+type unavailableError interface {
+	Unavailable() bool
+}
+
+// Sink receives every event the server distributes, alongside the
+// grpc subscriptions. Write is called from the distributing go routine
+// so it must not block.
+type Sink interface {
+	Write(*definitions.Event)
+}
+
 type ServerOpt func(*BoshMetricsServer)
 
 func WithSubscriptionBufferSize(n int) ServerOpt {
@@ -61,127 +184,350 @@ func WithSubscriptionBufferSize(n int) ServerOpt {
 	}
 }
 
+// WithDispatchShards sets how many shards the subscription registry
+// is split into. Each shard distributes events to its subscriptions
+// on its own go routine.
+func WithDispatchShards(n int) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.dispatchShards = n
+	}
+}
+
+// WithAlerts configures a channel that carries only alerts.
+// Alerts read from it are distributed ahead of the events
+// on the main channel.
+func WithAlerts(a chan *definitions.Event) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.alerts = a
+	}
+}
+
+// WithAlertBufferSize sets how many alerts each subscription buffers
+// separately from heartbeats. The alert buffer counts against the
+// subscription buffer budget.
+func WithAlertBufferSize(n int) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.alertBufferSize = n
+	}
+}
+
+// WithMaxSubscriptionBufferSize limits the buffer size
+// clients can request for a subscription.
+func WithMaxSubscriptionBufferSize(n int) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.maxSubscriptionBufferSize = n
+	}
+}
+
+// WithSubscriptionBufferBudget limits the total number of events
+// buffered across all subscriptions. New subscriptions that do not
+// fit are rejected once idle subscriptions have been evicted. With
+// consistent hashing each stream has its own buffer, so every stream
+// that joins takes from the budget.
+func WithSubscriptionBufferBudget(n int) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.subscriptionBufferBudget = n
+	}
+}
+
+// WithDistribution configures how each subscription divides
+// its events between the streams that share it.
+func WithDistribution(d Distribution) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.distribution = d
+	}
+}
+
+// WithSharedEncoding encodes each event once and sends the same
+// payload to every subscription. The grpc server must be created
+// with grpc.ForceServerCodec(egress.Codec()).
+func WithSharedEncoding() ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.sharedEncoding = true
+	}
+}
+
+// WithSlowConsumerPolicy configures how the server treats streams
+// whose sends take longer than the policy threshold.
+func WithSlowConsumerPolicy(p SlowConsumerPolicy) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.slowConsumerPolicy = p
+	}
+}
+
+// WithSinks adds sinks that are given every event before it is
+// distributed to subscriptions.
+func WithSinks(sinks ...Sink) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.sinks = append(s.sinks, sinks...)
+	}
+}
+
 // NewServer returns a BoshMetricsServer.
 // It serves bosh metrics via a grpc connections from clients.
 func NewServer(m chan *definitions.Event, t tokenChecker, opts ...ServerOpt) *BoshMetricsServer {
 	s := &BoshMetricsServer{
 		messages:               m,
-		registry:               make(map[string]chan *definitions.Event),
 		tokenChecker:           t,
+		dispatchShards:         runtime.GOMAXPROCS(0),
 		subscriptionBufferSize: 1024,
+		alertBufferSize:        8192,
+		deploymentTeams:        make(deploymentTeams),
+		sseKeepAliveInterval:   15 * time.Second,
 	}
 
 	for _, o := range opts {
 		o(s)
 	}
 
+	s.registry = newRegistry(s.dispatchShards)
+
 	return s
 }
 
-// Start spins up a new go routine that distributes metrics to each subscription.
+// Start spins up a new go routine that hands metrics to each shard of the
+// registry, and a go routine per shard that distributes them to the shard's
+// subscriptions. Every subscription receives heartbeats in the order they
+// were read, and alerts ahead of any heartbeats still queued.
 // It returns a shutdown function which blocks until all subscriptions are
 // drained.
 func (s *BoshMetricsServer) Start() func() {
 	done := make(chan struct{})
 
 	go func() {
-		for message := range s.messages {
-			s.mu.RLock()
-			for subscription, ch := range s.registry {
-				select {
-				case ch <- message:
-				default:
-					egressSubscriptionDropped.Add(subscription, 1)
-				}
+		var workers sync.WaitGroup
+		for _, sh := range s.registry.shards {
+			workers.Add(1)
+			go func(sh *shard) {
+				defer workers.Done()
+				sh.dispatch()
+			}(sh)
+		}
+
+		in := lanes[*definitions.Event]{alerts: s.alerts, events: s.messages}
+		for {
+			message, ok := in.next(nil)
+			if !ok {
+				break
+			}
+
+			for _, sink := range s.sinks {
+				sink.Write(message)
+			}
+
+			f := newFrame(message)
+			if s.teamAuthority != "" {
+				f.teams = s.deploymentTeams.resolve(message)
+			}
+			for _, sh := range s.registry.shards {
+				sh.write(f)
 			}
 			egressProcessedCounter.Add(1)
-			s.mu.RUnlock()
 		}
+
+		for _, sh := range s.registry.shards {
+			sh.in.close()
+		}
+		workers.Wait()
 		close(done)
 	}()
 
 	return func() {
 		<-done
 
-		s.mu.RLock()
-		defer s.mu.RUnlock()
-		for _, subscriptionMsgs := range s.registry {
-			close(subscriptionMsgs)
-		}
+		s.registry.each(func(sub *subscription) {
+			sub.close()
+		})
 
 		s.wg.Wait()
 	}
 }
 
 // BoshMetrics is the grpc handler that serves EgressRequests.
-// It verifies auth tokens from the `authorization` metadata.
-// It returns an error if the auth token is missing or invalid.
+// It verifies auth tokens from the `authorization` metadata and/or
+// the client certificate, depending on the auth mode.
+// It returns an error if the client is not authorized.
 func (s *BoshMetricsServer) BoshMetrics(r *definitions.EgressRequest, srv definitions.Egress_BoshMetricsServer) error {
-	err := s.checkToken(srv)
+	p, err := s.authorize(srv.Context())
 	if err != nil {
+		s.audit(srv.Context(), r, principal{}, audit.Denied, err, 0)
 		return err
 	}
 
+	return s.serve(r, srv, p)
+}
+
+// serve sends the events of the requested subscription to an
+// authorized stream until the stream fails, its token is no longer
+// valid or the server shuts down.
+func (s *BoshMetricsServer) serve(r *definitions.EgressRequest, srv definitions.Egress_BoshMetricsServer, p principal) (err error) {
 	s.wg.Add(1)
 	defer s.wg.Done()
 
-	m := s.register(r.SubscriptionId)
-	for event := range m {
-		err := srv.Send(event)
+	st := s.newStream(r.SubscriptionId)
+	defer st.close()
+
+	sub, msgs, err := s.subscribe(r, st.key, p)
+	if err != nil {
+		s.audit(srv.Context(), r, p, audit.Denied, err, 0)
+		return err
+	}
+	defer sub.leave(st.key)
+
+	s.audit(srv.Context(), r, p, audit.Allowed, nil, 0)
+	connected := time.Now()
+	defer func() {
+		s.audit(srv.Context(), r, p, audit.Ended, err, time.Since(connected))
+	}()
+
+	if p.clientID != "" {
+		egressClientStreams.Add(p.clientID, 1)
+		defer egressClientStreams.Add(p.clientID, -1)
+	}
+
+	auth := s.watchToken(srv.Context(), p)
+	defer auth.stop()
+
+	ctx := auth.ctx
+	for {
+		f, ok := msgs.next(ctx.Done())
+		if !ok {
+			break
+		}
+		egressSubscriptionQueueDepth.Add(sub.id, -1)
+
+		if st.shouldShed(f.event, msgs.len()) {
+			sub.drop()
+			continue
+		}
+
+		if gap := sub.gaps.take(); gap != nil {
+			start := time.Now()
+			err := st.send(func() error {
+				return s.send(srv, newFrame(gap))
+			})
+			if err == errSendStalled {
+				return st.observeSend(time.Since(start))
+			}
+			if err != nil {
+				log.Printf("Send Error: %s\n", err)
+				egressSendErrCounter.Add(1)
+				sub.gaps.restore(gap.GetGap())
+				sub.leave(st.key)
+				sub.offer(f)
+				return err
+			}
+			egressSubscriptionGapsSent.Add(sub.id, 1)
+		}
+
+		start := time.Now()
+		err := st.send(func() error {
+			return s.send(srv, f)
+		})
+		if err == errSendStalled {
+			return st.observeSend(time.Since(start))
+		}
 		if err != nil {
 			log.Printf("Send Error: %s\n", err)
 			egressSendErrCounter.Add(1)
-			retryMessageOnSubscription(m, event, r.SubscriptionId)
+			sub.leave(st.key)
+			sub.offer(f)
 			return err
 		}
 		egressSubscriptionSent.Add(r.SubscriptionId, 1)
-	}
+		if p.clientID != "" {
+			egressClientSent.Add(p.clientID, 1)
+		}
 
-	return nil
-}
+		err = st.observeSend(time.Since(start))
+		if err != nil {
+			return err
+		}
+	}
 
-// TODO: Change retry strategy. The subscription channel
-// should be read only at this point. We could get a send on close channel
-// if this happens after shutdown.
-func retryMessageOnSubscription(subscriptionMsgs chan *definitions.Event, event *definitions.Event, subscription string) {
-	select {
-	case subscriptionMsgs <- event:
-	default:
-		egressSubscriptionDropped.Add(subscription, 1)
+	if err := auth.reason(); err != nil {
+		return err
+	}
+	if err := srv.Context().Err(); err != nil {
+		return status.FromContextError(err).Err()
 	}
-}
 
-func (s *BoshMetricsServer) register(subscriptionId string) chan *definitions.Event {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return nil
+}
 
-	msgs, ok := s.registry[subscriptionId]
-	if !ok {
-		msgs = make(chan *definitions.Event, s.subscriptionBufferSize)
-		s.registry[subscriptionId] = msgs
+// send writes the frame to the stream. With shared encoding the
+// frame's pre-encoded payload is sent as is, which requires the grpc
+// server to be using the codec returned by Codec.
+func (s *BoshMetricsServer) send(srv definitions.Egress_BoshMetricsServer, f *frame) error {
+	if s.sharedEncoding {
+		return srv.SendMsg(f)
 	}
 
-	return msgs
+	return srv.Send(f.event)
 }
 
-func (s *BoshMetricsServer) checkToken(srv definitions.Egress_BoshMetricsServer) error {
-	md, ok := metadata.FromIncomingContext(srv.Context())
+// checkToken verifies the token in the authorization metadata.
+func (s *BoshMetricsServer) checkToken(ctx context.Context) (principal, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
 		egressAuthErrCounter.Add(1)
-		return authorizationMissingErr
+		return principal{}, authorizationMissingErr
 	}
 
 	tokens := md["authorization"]
 	if len(tokens) == 0 {
 		egressAuthErrCounter.Add(1)
-		return authorizationMissingErr
+		return principal{}, authorizationMissingErr
 	}
 
-	err := s.tokenChecker.CheckToken(tokens[0])
+	claims, err := s.check(ctx, tokens[0])
 	if err != nil {
 		egressAuthErrCounter.Add(1)
-		return invalidAuthErr(err)
+		if ctx.Err() != nil {
+			return principal{}, status.FromContextError(ctx.Err()).Err()
+		}
+		if isUnavailable(err) {
+			egressTokenUnavailableCounter.Add(1)
+			return principal{}, tokenCheckUnavailableErr(err)
+		}
+		return principal{}, invalidAuthErr(err)
 	}
 
-	return nil
+	// Claims are read from the token when
+	// the checker does not return them.
+	if claims == nil {
+		parsed, _ := parseTokenClaims(tokens[0])
+		claims = &parsed
+	}
+
+	teams, err := s.teamsFor(claims.Scopes)
+	if err != nil {
+		egressAuthErrCounter.Add(1)
+		return principal{}, err
+	}
+
+	return principal{
+		token:    tokens[0],
+		clientID: claims.ClientID,
+		teams:    teams,
+		exp:      claims.Exp,
+	}, nil
+}
+
+// check checks the token with the token checker, giving up when ctx
+// is done and returning the token's claims if the checker supports it.
+func (s *BoshMetricsServer) check(ctx context.Context, token string) (*tokenchecker.Claims, error) {
+	switch c := s.tokenChecker.(type) {
+	case claimsTokenChecker:
+		return c.CheckTokenClaims(ctx, token)
+	case contextTokenChecker:
+		return nil, c.CheckTokenContext(ctx, token)
+	default:
+		return nil, s.tokenChecker.CheckToken(token)
+	}
+}
+
+func isUnavailable(err error) bool {
+	var u unavailableError
+	return errors.As(err, &u) && u.Unavailable()
 }
@@ -262,7 +262,29 @@ func TestSlowClientsDoesNotAffectFastClients(t *testing.T) {
 	Expect(len(sender2.received)).To(BeNumerically("<", 20))
 }
 
+func TestSinksReceiveEveryEvent(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 10)
+	sink := &spySink{received: make(chan *definitions.Event, 10)}
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithSinks(sink))
+
+	server.Start()
+	messages <- event
+	messages <- event
+
+	Eventually(sink.received).Should(HaveLen(2))
+}
+
 // ------ SPIES ------
+type spySink struct {
+	received chan *definitions.Event
+}
+
+func (s *spySink) Write(e *definitions.Event) {
+	s.received <- e
+}
+
 type spyEgressSender struct {
 	received       chan *definitions.Event
 	token          string
@@ -0,0 +1,30 @@
+package egress
+
+import (
+	"testing"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	. "github.com/onsi/gomega"
+)
+
+func TestFullShardDispatchesAlertsFirst(t *testing.T) {
+	RegisterTestingT(t)
+
+	sh := newRegistry(1).shards[0]
+	heartbeat := newFrame(&definitions.Event{Message: &definitions.Event_Heartbeat{Heartbeat: &definitions.Heartbeat{}}})
+	alert := newFrame(&definitions.Event{Message: &definitions.Event_Alert{Alert: &definitions.Alert{}}})
+	for i := 0; i < cap(sh.in.events); i++ {
+		sh.write(heartbeat)
+	}
+	sh.write(alert)
+
+	// Holding the shard lock stops the dispatcher
+	// after it has taken the first frame.
+	sh.mu.Lock()
+	go sh.dispatch()
+	defer sh.in.close()
+	defer sh.mu.Unlock()
+
+	Eventually(func() int { return len(sh.in.alerts) }).Should(BeZero())
+	Expect(sh.in.events).To(HaveLen(cap(sh.in.events)))
+}
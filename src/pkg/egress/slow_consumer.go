@@ -0,0 +1,156 @@
+package egress
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SlowConsumerAction is what the server does with a stream
+// whose send exceeded the SlowConsumerPolicy threshold.
+type SlowConsumerAction int
+
+const (
+	// SlowConsumerIgnore only records send latency.
+	SlowConsumerIgnore SlowConsumerAction = iota
+	// SlowConsumerDisconnect ends the stream with codes.ResourceExhausted,
+	// without waiting for a send that is still blocked.
+	SlowConsumerDisconnect
+	// SlowConsumerDegrade sheds heartbeats for the stream until its
+	// subscription backlog is drained. Alerts are always sent.
+	SlowConsumerDegrade
+)
+
+// SlowConsumerPolicy decides when a stream is considered slow
+// and what happens to it. A zero Threshold disables the policy.
+type SlowConsumerPolicy struct {
+	Threshold time.Duration
+	Action    SlowConsumerAction
+}
+
+// ParseSlowConsumerAction converts a configuration value into
+// a SlowConsumerAction. An empty string means SlowConsumerIgnore.
+func ParseSlowConsumerAction(s string) (SlowConsumerAction, error) {
+	switch s {
+	case "", "ignore":
+		return SlowConsumerIgnore, nil
+	case "disconnect":
+		return SlowConsumerDisconnect, nil
+	case "degrade":
+		return SlowConsumerDegrade, nil
+	default:
+		return SlowConsumerIgnore, fmt.Errorf("unknown slow consumer action %q: must be ignore, disconnect or degrade", s)
+	}
+}
+
+// errSendStalled is returned by stream.send when a send was abandoned.
+var errSendStalled = errors.New("send stalled")
+
+type stream struct {
+	subscription string
+	key          string
+	policy       SlowConsumerPolicy
+	latency      *expvar.Float
+	degraded     bool
+}
+
+func (s *BoshMetricsServer) newStream(subscription string) *stream {
+	id := atomic.AddUint64(&s.streamCount, 1)
+
+	st := &stream{
+		subscription: subscription,
+		key:          fmt.Sprintf("%s/%d", subscription, id),
+		policy:       s.slowConsumerPolicy,
+		latency:      new(expvar.Float),
+	}
+	egressStreamSendLatency.Set(st.key, st.latency)
+
+	return st
+}
+
+func (st *stream) close() {
+	egressStreamSendLatency.Delete(st.key)
+}
+
+// shouldShed reports whether the event should be dropped instead of
+// sent. A degraded stream recovers once its subscription has no backlog.
+func (st *stream) shouldShed(event *definitions.Event, backlog int) bool {
+	if !st.degraded {
+		return false
+	}
+
+	if backlog == 0 {
+		log.Printf("stream %s recovered from degraded mode\n", st.key)
+		st.degraded = false
+		return false
+	}
+
+	return event.GetHeartbeat() != nil
+}
+
+// send calls send and returns its error. With the disconnect action a
+// send still blocked once the threshold passes is abandoned and
+// errSendStalled is returned, as a client stalled by flow control may
+// never accept it. The abandoned send returns when the stream ends.
+func (st *stream) send(send func() error) error {
+	if st.policy.Threshold <= 0 || st.policy.Action != SlowConsumerDisconnect {
+		return send()
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- send()
+	}()
+
+	timer := time.NewTimer(st.policy.Threshold)
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return errSendStalled
+	}
+}
+
+// observeSend records how long a send took and applies the slow
+// consumer policy. It returns an error if the stream must be ended.
+func (st *stream) observeSend(d time.Duration) error {
+	st.latency.Set(float64(d) / float64(time.Millisecond))
+
+	if st.policy.Threshold <= 0 || d <= st.policy.Threshold {
+		return nil
+	}
+
+	switch st.policy.Action {
+	case SlowConsumerDisconnect:
+		return st.evict(d)
+	case SlowConsumerDegrade:
+		if !st.degraded {
+			log.Printf("stream %s entering degraded mode: send took %s\n", st.key, d)
+			egressSlowConsumerDegraded.Add(st.subscription, 1)
+			st.degraded = true
+		}
+	}
+
+	return nil
+}
+
+// evict returns the error that ends a stream whose send took d.
+func (st *stream) evict(d time.Duration) error {
+	log.Printf("evicting slow stream %s: send took %s\n", st.key, d)
+	egressSlowConsumerEvicted.Add(st.subscription, 1)
+	return status.Errorf(
+		codes.ResourceExhausted,
+		"Stream evicted as a slow consumer: send took %s which exceeds the threshold of %s",
+		d,
+		st.policy.Threshold,
+	)
+}
@@ -0,0 +1,195 @@
+package egress_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/egress"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSlowConsumerIsDisconnected(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	messages := make(chan *definitions.Event, 100)
+	sender := newSpyEgressSender(validContext("test-token"), 100, withSendRate(50*time.Millisecond))
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithSlowConsumerPolicy(egress.SlowConsumerPolicy{
+		Threshold: 10 * time.Millisecond,
+		Action:    egress.SlowConsumerDisconnect,
+	}))
+	req := &definitions.EgressRequest{SubscriptionId: "subscriptionA"}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.BoshMetrics(req, sender)
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	server.Start()
+	messages <- event
+
+	var err error
+	Eventually(errs, "2s").Should(Receive(&err))
+	st, _ := status.FromError(err)
+	Expect(st.Code()).To(Equal(codes.ResourceExhausted))
+	Eventually(sender.received).Should(HaveLen(1))
+}
+
+func TestSlowConsumerIsDisconnectedWhileItsSendIsBlocked(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	messages := make(chan *definitions.Event, 100)
+	sender := &blockingEgressSender{
+		spyEgressSender: newSpyEgressSender(validContext("test-token"), 100),
+		unblock:         make(chan struct{}),
+	}
+	defer close(sender.unblock)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithSlowConsumerPolicy(egress.SlowConsumerPolicy{
+		Threshold: 10 * time.Millisecond,
+		Action:    egress.SlowConsumerDisconnect,
+	}))
+	req := &definitions.EgressRequest{SubscriptionId: "subscriptionA"}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.BoshMetrics(req, sender)
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	server.Start()
+	messages <- event
+
+	var err error
+	Eventually(errs, "2s").Should(Receive(&err))
+	st, _ := status.FromError(err)
+	Expect(st.Code()).To(Equal(codes.ResourceExhausted))
+	Expect(sender.received).To(BeEmpty())
+}
+
+func TestSlowConsumerIsNotDisconnectedWhenUnderThreshold(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	sender := newSpyEgressSender(validContext("test-token"), 100)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithSlowConsumerPolicy(egress.SlowConsumerPolicy{
+		Threshold: time.Second,
+		Action:    egress.SlowConsumerDisconnect,
+	}))
+	req := &definitions.EgressRequest{SubscriptionId: "subscriptionA"}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.BoshMetrics(req, sender)
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	server.Start()
+	for i := 0; i < 10; i++ {
+		messages <- event
+	}
+
+	Eventually(func() int { return len(sender.received) }, "2s").Should(Equal(10))
+	Consistently(errs).ShouldNot(Receive())
+}
+
+func TestDegradedConsumerShedsHeartbeatsButKeepsAlerts(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	messages := make(chan *definitions.Event, 100)
+	sender := newSpyEgressSender(validContext("test-token"), 100, withSendRate(20*time.Millisecond))
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithSlowConsumerPolicy(egress.SlowConsumerPolicy{
+		Threshold: 10 * time.Millisecond,
+		Action:    egress.SlowConsumerDegrade,
+	}))
+	req := &definitions.EgressRequest{SubscriptionId: "subscriptionA"}
+
+	// A client that fails to send leaves the subscription registered
+	// so the events below queue up before the slow client connects.
+	failing := newSpyEgressSender(validContext("test-token"), 100)
+	failing.SendError(errors.New("unable to send"))
+	done := make(chan struct{})
+	go func() {
+		server.BoshMetrics(req, failing)
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	server.Start()
+	messages <- heartbeatEvent
+	Eventually(done).Should(BeClosed())
+	for i := 0; i < 9; i++ {
+		messages <- heartbeatEvent
+	}
+	messages <- event
+	Eventually(messages).Should(BeEmpty())
+	// giving the dispatcher a chance to queue the events on the subscription
+	time.Sleep(time.Millisecond * 100)
+
+	// The alert is sent first and degrades the stream while
+	// the heartbeats are still queued.
+	go server.BoshMetrics(req, sender)
+
+	var gap *definitions.Event
+	Eventually(sender.received, "2s").Should(Receive(Equal(event)))
+	Eventually(sender.received, "2s").Should(Receive(&gap))
+	Expect(gap.GetGap().GetDropped()).To(Equal(int64(9)))
+	Eventually(sender.received, "2s").Should(Receive(Equal(heartbeatEvent)))
+	Consistently(sender.received).ShouldNot(Receive())
+}
+
+func TestParseSlowConsumerAction(t *testing.T) {
+	RegisterTestingT(t)
+
+	for in, expected := range map[string]egress.SlowConsumerAction{
+		"":           egress.SlowConsumerIgnore,
+		"ignore":     egress.SlowConsumerIgnore,
+		"disconnect": egress.SlowConsumerDisconnect,
+		"degrade":    egress.SlowConsumerDegrade,
+	} {
+		a, err := egress.ParseSlowConsumerAction(in)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(a).To(Equal(expected))
+	}
+
+	_, err := egress.ParseSlowConsumerAction("explode")
+	Expect(err).To(HaveOccurred())
+}
+
+// blockingEgressSender blocks every send until unblock is closed,
+// like a client stalled by grpc flow control.
+type blockingEgressSender struct {
+	*spyEgressSender
+	unblock chan struct{}
+}
+
+func (s *blockingEgressSender) Send(e *definitions.Event) error {
+	<-s.unblock
+	return s.spyEgressSender.Send(e)
+}
+
+var heartbeatEvent = &definitions.Event{
+	Id:         "55b68400-f984-4f76-b341-cf849e07d4f9",
+	Timestamp:  1499293724,
+	Deployment: "loggregator",
+	Message: &definitions.Event_Heartbeat{
+		Heartbeat: &definitions.Heartbeat{
+			AgentId:    "2accd102-37e7-4dd6-b337-b3f87da97914",
+			Job:        "consul",
+			Index:      4,
+			InstanceId: "6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9",
+			JobState:   "running",
+			Metrics: []*definitions.Heartbeat_Metric{
+				{Name: "system.cpu.user", Value: 2.5, Timestamp: 1499293724},
+			},
+		},
+	},
+}
@@ -0,0 +1,378 @@
+package egress
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+)
+
+// Distribution is how a subscription divides its events
+// between the streams that share it.
+type Distribution int
+
+const (
+	// DistributeShared lets every stream of a subscription read from
+	// one buffer so each event goes to whichever stream is free.
+	DistributeShared Distribution = iota
+	// DistributeConsistentHash assigns events to streams by a consistent
+	// hash of the heartbeat instance id, or of the deployment for alerts.
+	DistributeConsistentHash
+)
+
+// ParseDistribution converts a configuration value into a
+// Distribution. An empty string means DistributeShared.
+func ParseDistribution(s string) (Distribution, error) {
+	switch s {
+	case "", "shared":
+		return DistributeShared, nil
+	case "consistent-hash":
+		return DistributeConsistentHash, nil
+	default:
+		return DistributeShared, fmt.Errorf("unknown distribution %q: must be shared or consistent-hash", s)
+	}
+}
+
+// subscription is the buffer shared by every stream that connected
+// with the same subscription id.
+type subscription struct {
+	id              string
+	bufferSize      int
+	alertBufferSize int
+	dropPolicy      definitions.DropPolicy
+	shared          *lanes[*frame]
+	gaps            gapTracker
+
+	// owner is the client id of the client that created the
+	// subscription, when subscription ownership is enforced.
+	owner string
+	// teams limit the subscription to the deployments they own.
+	// The subscription receives every event when they are nil.
+	teams []string
+
+	// reserve and release take and return buffer budget. With
+	// consistent hashing every stream has its own buffer, so budget
+	// is reserved as streams join and released as they leave.
+	reserve func(size int) bool
+	release func(size int)
+
+	mu      sync.RWMutex
+	closed  bool
+	ring    *hashRing
+	members map[string]*lanes[*frame]
+}
+
+func newSubscription(id string, bufferSize, alertBufferSize int, p definitions.DropPolicy, d Distribution) *subscription {
+	sub := &subscription{
+		id:              id,
+		bufferSize:      bufferSize,
+		alertBufferSize: alertBufferSize,
+		dropPolicy:      p,
+		members:         make(map[string]*lanes[*frame]),
+	}
+
+	switch d {
+	case DistributeConsistentHash:
+		sub.ring = newHashRing()
+	default:
+		sub.shared = newLanes[*frame](bufferSize, alertBufferSize)
+	}
+
+	return sub
+}
+
+// join returns the lanes the stream identified by key should read
+// events from. With consistent hashing the subscription is rebalanced
+// so the new stream takes its share of the hash ring. It returns false
+// if the budget has no room left for the stream's buffer.
+func (sub *subscription) join(key string) (lanes[*frame], bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.ring == nil {
+		sub.members[key] = sub.shared
+		return *sub.shared, true
+	}
+
+	if sub.closed {
+		l := newLanes[*frame](0, 0)
+		l.close()
+		return *l, true
+	}
+
+	if !sub.reserve(sub.size()) {
+		return lanes[*frame]{}, false
+	}
+
+	l := newLanes[*frame](sub.bufferSize, sub.alertBufferSize)
+	sub.members[key] = l
+	sub.ring.add(key)
+
+	return *l, true
+}
+
+// leave removes the stream identified by key from the subscription.
+// Events still queued for the stream are handed to the remaining
+// streams. It is safe to call leave more than once.
+func (sub *subscription) leave(key string) {
+	sub.mu.Lock()
+	l, ok := sub.members[key]
+	if !ok {
+		sub.mu.Unlock()
+		return
+	}
+	delete(sub.members, key)
+	if sub.ring == nil {
+		sub.mu.Unlock()
+		return
+	}
+	sub.ring.remove(key)
+	sub.mu.Unlock()
+	sub.release(sub.size())
+
+	for _, ch := range []chan *frame{l.alerts, l.events} {
+		sub.requeue(ch)
+	}
+}
+
+func (sub *subscription) requeue(ch chan *frame) {
+	for {
+		select {
+		case f, ok := <-ch:
+			if !ok {
+				return
+			}
+			egressSubscriptionQueueDepth.Add(sub.id, -1)
+			sub.offer(f)
+		default:
+			return
+		}
+	}
+}
+
+// offer queues the event without blocking. The event is dropped if
+// the buffer it belongs in is full or the subscription is closed.
+// Alerts are queued separately from heartbeats so they are only
+// dropped when the larger alert buffer is full.
+func (sub *subscription) offer(f *frame) {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+
+	if sub.closed {
+		sub.drop()
+		return
+	}
+
+	if !f.visible(sub.teams) {
+		egressTeamFiltered.Add(1)
+		return
+	}
+
+	l := sub.shared
+	if sub.ring != nil {
+		l = sub.members[sub.ring.get(distributionKey(f.event))]
+	}
+	if l == nil {
+		sub.drop()
+		return
+	}
+
+	ch := l.events
+	if f.event.GetAlert() != nil {
+		ch = l.alerts
+	}
+
+	select {
+	case ch <- f:
+		egressSubscriptionQueueDepth.Add(sub.id, 1)
+		return
+	default:
+	}
+
+	if sub.dropPolicy == definitions.DropPolicy_DROP_OLDEST {
+		select {
+		case <-ch:
+			egressSubscriptionQueueDepth.Add(sub.id, -1)
+			sub.drop()
+		default:
+		}
+
+		select {
+		case ch <- f:
+			egressSubscriptionQueueDepth.Add(sub.id, 1)
+			return
+		default:
+		}
+	}
+
+	sub.drop()
+}
+
+// size returns how many events a buffer of the subscription holds,
+// counting its alerts and heartbeats.
+func (sub *subscription) size() int {
+	return sub.bufferSize + sub.alertBufferSize
+}
+
+// streamCount returns the number of streams reading from the subscription.
+func (sub *subscription) streamCount() int {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+
+	return len(sub.members)
+}
+
+// close stops the subscription from accepting events. Streams
+// finish once they have drained what is already queued.
+func (sub *subscription) close() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+
+	if sub.ring == nil {
+		sub.shared.close()
+		return
+	}
+	for _, l := range sub.members {
+		l.close()
+	}
+}
+
+// lanes holds the alert and heartbeat buffers a stream reads from.
+type lanes[T any] struct {
+	alerts chan T
+	events chan T
+}
+
+func newLanes[T any](bufferSize, alertBufferSize int) *lanes[T] {
+	return &lanes[T]{
+		alerts: make(chan T, alertBufferSize),
+		events: make(chan T, bufferSize),
+	}
+}
+
+// next returns the next event to send, preferring pending alerts over
+// pending heartbeats. It returns false once both lanes are closed and
+// drained, or once done is closed. Each stream must call next on its
+// own copy of the lanes.
+func (l *lanes[T]) next(done <-chan struct{}) (T, bool) {
+	var zero T
+	for l.alerts != nil || l.events != nil {
+		select {
+		case event, ok := <-l.alerts:
+			if !ok {
+				l.alerts = nil
+				continue
+			}
+			return event, true
+		default:
+		}
+
+		select {
+		case event, ok := <-l.alerts:
+			if !ok {
+				l.alerts = nil
+				continue
+			}
+			return event, true
+		case event, ok := <-l.events:
+			if !ok {
+				l.events = nil
+				continue
+			}
+			return event, true
+		case <-done:
+			return zero, false
+		}
+	}
+
+	return zero, false
+}
+
+// len returns the number of events queued in both lanes.
+func (l *lanes[T]) len() int {
+	return len(l.alerts) + len(l.events)
+}
+
+func (l *lanes[T]) close() {
+	close(l.alerts)
+	close(l.events)
+}
+
+// drop records that an event was not delivered to the subscription.
+func (sub *subscription) drop() {
+	egressSubscriptionDropped.Add(sub.id, 1)
+	sub.gaps.record(time.Now())
+}
+
+func distributionKey(event *definitions.Event) string {
+	if hb := event.GetHeartbeat(); hb != nil {
+		return hb.GetInstanceId()
+	}
+
+	return event.GetDeployment()
+}
+
+// gapTracker accumulates drops for a subscription until
+// they are reported to a client.
+type gapTracker struct {
+	mu      sync.Mutex
+	dropped int64
+	start   time.Time
+	end     time.Time
+}
+
+func (g *gapTracker) record(t time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.dropped == 0 {
+		g.start = t
+	}
+	g.dropped++
+	g.end = t
+}
+
+// take returns a Gap event describing the drops since the last
+// call and resets the tracker. It returns nil if nothing was dropped.
+func (g *gapTracker) take() *definitions.Event {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.dropped == 0 {
+		return nil
+	}
+
+	gap := &definitions.Gap{
+		Dropped:        g.dropped,
+		StartTimestamp: g.start.UnixNano(),
+		EndTimestamp:   g.end.UnixNano(),
+	}
+	g.dropped = 0
+
+	return &definitions.Event{
+		Timestamp: time.Now().UnixNano(),
+		Message:   &definitions.Event_Gap{Gap: gap},
+	}
+}
+
+// restore puts back a gap that could not be delivered so it is
+// reported together with any later drops.
+func (g *gapTracker) restore(gap *definitions.Gap) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	start := time.Unix(0, gap.StartTimestamp)
+	if g.dropped == 0 || start.Before(g.start) {
+		g.start = start
+	}
+	if g.dropped == 0 {
+		g.end = time.Unix(0, gap.EndTimestamp)
+	}
+	g.dropped += gap.Dropped
+}
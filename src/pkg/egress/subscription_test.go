@@ -0,0 +1,411 @@
+package egress_test
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/egress"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDroppedEventsAreReportedAsAGap(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	sender := newSpyEgressSender(validContext("test-token"), 100, withSendRate(200*time.Millisecond))
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithSubscriptionBufferSize(1))
+	req := &definitions.EgressRequest{SubscriptionId: "subscriptionA"}
+
+	go server.BoshMetrics(req, sender)
+	time.Sleep(time.Millisecond * 100)
+
+	before := time.Now().UnixNano()
+	server.Start()
+	for i := 0; i < 5; i++ {
+		messages <- heartbeatEvent
+	}
+	Eventually(messages).Should(BeEmpty())
+	messages <- heartbeatEvent
+
+	var delivered, dropped int64
+	var gap *definitions.Gap
+	Eventually(func() int64 {
+		select {
+		case e := <-sender.received:
+			if e.GetGap() != nil {
+				gap = e.GetGap()
+				dropped += gap.GetDropped()
+			} else {
+				delivered++
+			}
+		default:
+		}
+		return delivered + dropped
+	}, "3s").Should(Equal(int64(6)))
+	after := time.Now().UnixNano()
+
+	Expect(gap).ToNot(BeNil())
+	Expect(gap.GetDropped()).To(BeNumerically(">", 0))
+	Expect(gap.GetStartTimestamp()).To(BeNumerically(">=", before))
+	Expect(gap.GetEndTimestamp()).To(BeNumerically("<=", after))
+	Expect(gap.GetStartTimestamp()).To(BeNumerically("<=", gap.GetEndTimestamp()))
+}
+
+func TestNoGapIsSentWhenNothingIsDropped(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	sender := newSpyEgressSender(validContext("test-token"), 100)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil))
+	req := &definitions.EgressRequest{SubscriptionId: "subscriptionA"}
+
+	go server.BoshMetrics(req, sender)
+	time.Sleep(time.Millisecond * 100)
+
+	server.Start()
+	for i := 0; i < 10; i++ {
+		messages <- event
+	}
+
+	for i := 0; i < 10; i++ {
+		Eventually(sender.received).Should(Receive(Equal(event)))
+	}
+	Consistently(sender.received).ShouldNot(Receive())
+}
+
+func TestConsistentHashSendsEachInstanceToOneStream(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	sender1 := newSpyEgressSender(validContext("test-token-a"), 1000)
+	sender2 := newSpyEgressSender(validContext("test-token-b"), 1000)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithDistribution(egress.DistributeConsistentHash))
+	req := &definitions.EgressRequest{SubscriptionId: "subscriptionA"}
+
+	go server.BoshMetrics(req, sender1)
+	go server.BoshMetrics(req, sender2)
+	time.Sleep(time.Millisecond * 100)
+
+	server.Start()
+	for i := 0; i < 200; i++ {
+		messages <- heartbeatFor(fmt.Sprintf("instance-%d", i%20))
+	}
+
+	Eventually(func() int { return len(sender1.received) + len(sender2.received) }, "2s").Should(Equal(200))
+
+	instances1 := receivedInstances(sender1)
+	instances2 := receivedInstances(sender2)
+	Expect(instances1).ToNot(BeEmpty())
+	Expect(instances2).ToNot(BeEmpty())
+	for id := range instances1 {
+		Expect(instances2).ToNot(HaveKey(id))
+	}
+}
+
+func TestConsistentHashRebalancesWhenAStreamLeaves(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	messages := make(chan *definitions.Event, 1000)
+	sender1 := newSpyEgressSender(validContext("test-token-a"), 1000)
+	sender2 := newSpyEgressSender(validContext("test-token-b"), 1000)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithDistribution(egress.DistributeConsistentHash))
+	req := &definitions.EgressRequest{SubscriptionId: "subscriptionA"}
+
+	done := make(chan struct{})
+	go func() {
+		server.BoshMetrics(req, sender1)
+		close(done)
+	}()
+	go server.BoshMetrics(req, sender2)
+	time.Sleep(time.Millisecond * 100)
+
+	sender1.SendError(errors.New("unable to send"))
+	server.Start()
+	for i := 0; i < 20; i++ {
+		messages <- heartbeatFor(fmt.Sprintf("instance-%d", i))
+	}
+	Eventually(done, "2s").Should(BeClosed())
+
+	for i := 0; i < 20; i++ {
+		messages <- heartbeatFor(fmt.Sprintf("instance-%d", i))
+	}
+
+	Eventually(func() int { return len(sender2.received) }, "2s").Should(Equal(40))
+	Expect(receivedInstances(sender2)).To(HaveLen(20))
+}
+
+func TestParseDistribution(t *testing.T) {
+	RegisterTestingT(t)
+
+	for in, expected := range map[string]egress.Distribution{
+		"":                egress.DistributeShared,
+		"shared":          egress.DistributeShared,
+		"consistent-hash": egress.DistributeConsistentHash,
+	} {
+		d, err := egress.ParseDistribution(in)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d).To(Equal(expected))
+	}
+
+	_, err := egress.ParseDistribution("round-robin")
+	Expect(err).To(HaveOccurred())
+}
+
+func heartbeatFor(instanceID string) *definitions.Event {
+	return &definitions.Event{
+		Deployment: "loggregator",
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{
+				Job:        "doppler",
+				InstanceId: instanceID,
+			},
+		},
+	}
+}
+
+func receivedInstances(s *spyEgressSender) map[string]bool {
+	instances := make(map[string]bool)
+	for {
+		select {
+		case e := <-s.received:
+			instances[e.GetHeartbeat().GetInstanceId()] = true
+		default:
+			return instances
+		}
+	}
+}
+
+func TestDropOldestKeepsTheNewestEvents(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	sender := newSpyEgressSender(validContext("test-token"), 100, withSendRate(100*time.Millisecond))
+	server := egress.NewServer(messages, newSpyTokenChecker(nil))
+	req := &definitions.EgressRequest{
+		SubscriptionId: "subscriptionA",
+		BufferSize:     2,
+		DropPolicy:     definitions.DropPolicy_DROP_OLDEST,
+	}
+
+	go server.BoshMetrics(req, sender)
+	time.Sleep(time.Millisecond * 100)
+
+	server.Start()
+	for i := 0; i < 10; i++ {
+		messages <- &definitions.Event{Id: fmt.Sprint(i)}
+	}
+
+	Eventually(sender.received, "2s").Should(Receive(WithTransform(
+		func(e *definitions.Event) string { return e.GetId() },
+		Equal("9"),
+	)))
+}
+
+func TestSubscriptionBufferSizeIsLimitedByTheBudget(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(
+		messages,
+		newSpyTokenChecker(nil),
+		egress.WithMaxSubscriptionBufferSize(5),
+		egress.WithAlertBufferSize(5),
+		egress.WithSubscriptionBufferBudget(20),
+	)
+
+	go server.BoshMetrics(
+		&definitions.EgressRequest{SubscriptionId: "subscriptionA", BufferSize: 100},
+		newSpyEgressSender(validContext("test-token"), 100),
+	)
+	go server.BoshMetrics(
+		&definitions.EgressRequest{SubscriptionId: "subscriptionB", BufferSize: 100},
+		newSpyEgressSender(validContext("test-token"), 100),
+	)
+	time.Sleep(time.Millisecond * 100)
+
+	err := server.BoshMetrics(
+		&definitions.EgressRequest{SubscriptionId: "subscriptionC", BufferSize: 1},
+		newSpyEgressSender(validContext("test-token"), 100),
+	)
+
+	Expect(err).To(HaveOccurred())
+	st, _ := status.FromError(err)
+	Expect(st.Code()).To(Equal(codes.ResourceExhausted))
+	Expect(st.Message()).To(ContainSubstring("subscriptionC"))
+}
+
+func TestIdleSubscriptionsAreEvictedToMakeRoomInTheBudget(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(
+		messages,
+		newSpyTokenChecker(nil),
+		egress.WithAlertBufferSize(5),
+		egress.WithSubscriptionBufferBudget(15),
+	)
+
+	idle := newSpyEgressSender(validContext("test-token"), 100)
+	idle.SendError(errors.New("unable to send"))
+	done := make(chan struct{})
+	go func() {
+		server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "idle-subscription", BufferSize: 10}, idle)
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	server.Start()
+	messages <- event
+	Eventually(done).Should(BeClosed())
+
+	sender := newSpyEgressSender(validContext("test-token"), 100)
+	go server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "subscriptionB", BufferSize: 10}, sender)
+	time.Sleep(time.Millisecond * 100)
+
+	messages <- event
+	Eventually(sender.received).Should(Receive())
+
+	for _, name := range []string{"egress.subscription_queue_depth", "egress.subscription_dropped", "egress.subscription_owner"} {
+		Expect(expvar.Get(name).(*expvar.Map).Get("idle-subscription")).To(BeNil())
+	}
+}
+
+func TestAlertsAreSentBeforePendingHeartbeatsAndNotDropped(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	messages := make(chan *definitions.Event, 100)
+	alerts := make(chan *definitions.Event, 100)
+	server := egress.NewServer(
+		messages,
+		newSpyTokenChecker(nil),
+		egress.WithAlerts(alerts),
+		egress.WithSubscriptionBufferSize(2),
+		egress.WithAlertBufferSize(10),
+	)
+	req := &definitions.EgressRequest{SubscriptionId: "subscriptionA"}
+
+	// A client that fails to send leaves the subscription registered
+	// so the events below queue up before the next client connects.
+	failing := newSpyEgressSender(validContext("test-token"), 100)
+	failing.SendError(errors.New("unable to send"))
+	done := make(chan struct{})
+	go func() {
+		server.BoshMetrics(req, failing)
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	server.Start()
+	messages <- heartbeatEvent
+	Eventually(done).Should(BeClosed())
+	for i := 0; i < 5; i++ {
+		messages <- heartbeatEvent
+		alerts <- event
+	}
+	Eventually(messages).Should(BeEmpty())
+	Eventually(alerts).Should(BeEmpty())
+	// giving the dispatcher a chance to queue the events on the subscription
+	time.Sleep(time.Millisecond * 100)
+
+	sender := newSpyEgressSender(validContext("test-token"), 100)
+	go server.BoshMetrics(req, sender)
+
+	var gap *definitions.Event
+	Eventually(sender.received).Should(Receive(&gap))
+	Expect(gap.GetGap().GetDropped()).To(Equal(int64(4)))
+	for i := 0; i < 5; i++ {
+		Expect(<-sender.received).To(Equal(event))
+	}
+	Expect(<-sender.received).To(Equal(heartbeatEvent))
+	Expect(<-sender.received).To(Equal(heartbeatEvent))
+	Consistently(sender.received).ShouldNot(Receive())
+}
+
+func TestConsistentHashReservesTheBudgetForEachStream(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(
+		messages,
+		newSpyTokenChecker(nil),
+		egress.WithDistribution(egress.DistributeConsistentHash),
+		egress.WithAlertBufferSize(5),
+		egress.WithSubscriptionBufferBudget(20),
+	)
+	req := &definitions.EgressRequest{SubscriptionId: "subscriptionA", BufferSize: 5}
+
+	ctx, cancel := context.WithCancel(validContext("test-token"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.BoshMetrics(req, newSpyEgressSender(ctx, 100))
+	}()
+	go server.BoshMetrics(req, newSpyEgressSender(validContext("test-token"), 100))
+	time.Sleep(time.Millisecond * 100)
+
+	err := server.BoshMetrics(req, newSpyEgressSender(validContext("test-token"), 100))
+	Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+
+	cancel()
+	Eventually(done).Should(BeClosed())
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.BoshMetrics(req, newSpyEgressSender(validContext("test-token"), 100))
+	}()
+	Consistently(errs, 100*time.Millisecond).ShouldNot(Receive())
+}
+
+func TestAlertBuffersCountAgainstTheBudget(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(
+		messages,
+		newSpyTokenChecker(nil),
+		egress.WithAlertBufferSize(10),
+		egress.WithSubscriptionBufferBudget(15),
+	)
+
+	err := server.BoshMetrics(
+		&definitions.EgressRequest{SubscriptionId: "subscriptionA", BufferSize: 10},
+		newSpyEgressSender(validContext("test-token"), 100),
+	)
+
+	Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+}
+
+func TestJoiningWithADifferentBufferIsRejected(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 100)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil))
+	go server.BoshMetrics(
+		&definitions.EgressRequest{SubscriptionId: "subscriptionA", BufferSize: 10},
+		newSpyEgressSender(validContext("test-token"), 100),
+	)
+	time.Sleep(time.Millisecond * 100)
+
+	for _, req := range []*definitions.EgressRequest{
+		{SubscriptionId: "subscriptionA", BufferSize: 20},
+		{SubscriptionId: "subscriptionA", BufferSize: 10, DropPolicy: definitions.DropPolicy_DROP_OLDEST},
+	} {
+		err := server.BoshMetrics(req, newSpyEgressSender(validContext("test-token"), 100))
+
+		st, _ := status.FromError(err)
+		Expect(st.Code()).To(Equal(codes.FailedPrecondition))
+		Expect(st.Message()).To(ContainSubstring("subscriptionA"))
+	}
+}
@@ -0,0 +1,137 @@
+package egress
+
+import (
+	"slices"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/tokenchecker"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	teamScopeMissingErr = func(authority string) error {
+		return status.Errorf(codes.PermissionDenied, "Authorization token does not include the %s authority or the read scope of a team", authority)
+	}
+	subscriptionTeamsErr = func(subscription string) error {
+		return status.Errorf(codes.PermissionDenied, "Unable to join subscription %q: it receives events of deployments the client's teams do not own", subscription)
+	}
+	subscriptionNarrowerErr = func(subscription string) error {
+		return status.Errorf(codes.PermissionDenied, "Unable to join subscription %q: it only receives events of some of the deployments the client may read", subscription)
+	}
+)
+
+// WithTeamScopes lets clients whose token has the read scope of a BOSH
+// team, bosh.teams.<team>.read, in place of the authority subscribe to
+// the events of the deployments their teams own. Deployment ownership
+// is learned from the teams reported in heartbeats. Clients with the
+// authority keep receiving every event.
+func WithTeamScopes(authority string) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.teamAuthority = authority
+	}
+}
+
+// teamsFor returns the teams of a client with the scopes. They are nil
+// if the client may read every deployment, or if team scopes are not
+// enabled.
+func (s *BoshMetricsServer) teamsFor(scopes []string) ([]string, error) {
+	if s.teamAuthority == "" {
+		return nil, nil
+	}
+
+	var teams []string
+	for _, scope := range scopes {
+		if scope == s.teamAuthority {
+			return nil, nil
+		}
+
+		if team, ok := tokenchecker.TeamFromScope(scope); ok {
+			teams = append(teams, team)
+		}
+	}
+
+	if len(teams) == 0 {
+		return nil, teamScopeMissingErr(s.teamAuthority)
+	}
+
+	return teams, nil
+}
+
+// deploymentTeams records the teams that own each deployment, as
+// reported by its heartbeats. It is only used by the go routine that
+// distributes events, so it is not locked.
+type deploymentTeams map[string][]string
+
+// resolve returns the teams that own the deployment of the event.
+// Alerts do not report teams so they take the teams of the last
+// heartbeat from their deployment.
+func (d deploymentTeams) resolve(e *definitions.Event) []string {
+	hb := e.GetHeartbeat()
+	if hb == nil {
+		return d[e.GetDeployment()]
+	}
+
+	if len(hb.GetTeams()) == 0 {
+		delete(d, e.GetDeployment())
+		return nil
+	}
+
+	d[e.GetDeployment()] = hb.GetTeams()
+
+	return hb.GetTeams()
+}
+
+// checkTeams returns an error if a client with the teams may not join
+// the existing subscription, because the subscription would send it
+// events of deployments its teams do not own, or would silently leave
+// out deployments the client may read.
+func (s *BoshMetricsServer) checkTeams(sub *subscription, teams []string) error {
+	if !readsWithin(sub.teams, teams) {
+		egressTeamRejected.Add(1)
+		return subscriptionTeamsErr(sub.id)
+	}
+
+	if !readsWithin(teams, sub.teams) {
+		egressTeamRejected.Add(1)
+		return subscriptionNarrowerErr(sub.id)
+	}
+
+	return nil
+}
+
+// readsWithin returns whether every deployment the teams may read
+// may also be read by the other teams. Nil teams may read every
+// deployment.
+func readsWithin(teams, other []string) bool {
+	if other == nil {
+		return true
+	}
+	if teams == nil {
+		return false
+	}
+
+	for _, t := range teams {
+		if !slices.Contains(other, t) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// visible returns whether the event belongs to a deployment
+// owned by one of the teams. Every event is visible without teams.
+func (f *frame) visible(teams []string) bool {
+	if teams == nil {
+		return true
+	}
+
+	for _, t := range f.teams {
+		if slices.Contains(teams, t) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,112 @@
+package egress_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/egress"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTeamScopedClientsOnlyReceiveEventsOfTheirDeployments(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithTeamScopes("bosh.system_metrics.read"))
+	defer server.Start()()
+	defer close(messages)
+
+	team := newSpyEgressSender(validContext(tokenWithScopes("bosh.teams.diego.read")), 50)
+	go server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "diego"}, team)
+	full := newSpyEgressSender(validContext(tokenWithScopes("bosh.system_metrics.read")), 50)
+	go server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "everything"}, full)
+	time.Sleep(100 * time.Millisecond)
+
+	diegoHeartbeat := teamHeartbeat("diego", "diego")
+	cfHeartbeat := teamHeartbeat("cf", "cf")
+	diegoAlert := &definitions.Event{
+		Deployment: "diego",
+		Message:    &definitions.Event_Alert{Alert: &definitions.Alert{Title: "diego alert"}},
+	}
+	directorAlert := &definitions.Event{
+		Message: &definitions.Event_Alert{Alert: &definitions.Alert{Title: "director alert"}},
+	}
+	for _, e := range []*definitions.Event{diegoHeartbeat, cfHeartbeat, diegoAlert, directorAlert} {
+		messages <- e
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	Eventually(func() int { return len(full.received) }).Should(Equal(4))
+	Eventually(func() int { return len(team.received) }).Should(Equal(2))
+	Consistently(func() int { return len(team.received) }, 100*time.Millisecond).Should(Equal(2))
+	Expect(<-team.received).To(Equal(diegoHeartbeat))
+	Expect(<-team.received).To(Equal(diegoAlert))
+}
+
+func TestTeamScopedClientsAreRejectedFromWiderSubscriptions(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithTeamScopes("bosh.system_metrics.read"))
+	defer server.Start()()
+	defer close(messages)
+
+	req := &definitions.EgressRequest{SubscriptionId: "shared"}
+	go server.BoshMetrics(req, newSpyEgressSender(validContext(tokenWithScopes("bosh.system_metrics.read")), 50))
+	time.Sleep(100 * time.Millisecond)
+
+	err := server.BoshMetrics(req, newSpyEgressSender(validContext(tokenWithScopes("bosh.teams.diego.read")), 50))
+	Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+
+	err = server.BoshMetrics(req, newSpyEgressSender(validContext(tokenWithScopes("openid")), 50))
+	Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+}
+
+func TestFullReadClientsAreRejectedFromTeamSubscriptions(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil), egress.WithTeamScopes("bosh.system_metrics.read"))
+	defer server.Start()()
+	defer close(messages)
+
+	req := &definitions.EgressRequest{SubscriptionId: "diego"}
+	go server.BoshMetrics(req, newSpyEgressSender(validContext(tokenWithScopes("bosh.teams.diego.read")), 50))
+	time.Sleep(100 * time.Millisecond)
+
+	err := server.BoshMetrics(req, newSpyEgressSender(validContext(tokenWithScopes("bosh.system_metrics.read")), 50))
+	Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+
+	err = server.BoshMetrics(req, newSpyEgressSender(validContext(tokenWithScopes("bosh.teams.diego.read", "bosh.teams.cf.read")), 50))
+	Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.BoshMetrics(req, newSpyEgressSender(validContext(tokenWithScopes("bosh.teams.diego.read")), 50))
+	}()
+	Consistently(errs, 100*time.Millisecond).ShouldNot(Receive())
+}
+
+func teamHeartbeat(deployment string, teams ...string) *definitions.Event {
+	return &definitions.Event{
+		Deployment: deployment,
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{Job: deployment, Teams: teams},
+		},
+	}
+}
+
+// tokenWithScopes returns an unsigned token with the scope claim.
+func tokenWithScopes(scopes ...string) string {
+	claims, _ := json.Marshal(map[string][]string{"scope": scopes})
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+
+	return fmt.Sprintf("bearer %s.%s.", header, payload)
+}
@@ -0,0 +1,159 @@
+package egress
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/tokenchecker"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	tokenExpiredErr = status.Error(codes.Unauthenticated, "Authorization token has expired")
+	tokenRevokedErr = func(err error) error {
+		return status.Errorf(codes.Unauthenticated, "Authorization token is no longer valid: %s", err)
+	}
+)
+
+// WithTokenRevalidation checks the token of every stream again at the
+// interval, ending the stream if it is no longer valid. A revoked token
+// is noticed within one interval, as revalidation does not use cached
+// results. Streams are always ended when their token expires.
+func WithTokenRevalidation(d time.Duration) ServerOpt {
+	return func(s *BoshMetricsServer) {
+		s.tokenRevalidationInterval = d
+	}
+}
+
+// tokenWatch ends a stream when its token expires
+// or fails revalidation.
+type tokenWatch struct {
+	ctx    context.Context
+	cancel func()
+
+	mu  sync.Mutex
+	err error
+}
+
+// watchToken returns a tokenWatch whose context is cancelled when the
+// token of the principal is no longer valid or ctx is done. It must be
+// stopped.
+func (s *BoshMetricsServer) watchToken(ctx context.Context, p principal) *tokenWatch {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &tokenWatch{ctx: ctx, cancel: cancel}
+
+	// Streams authenticated only by client certificate have no token.
+	if p.token == "" {
+		return w
+	}
+
+	expires := p.exp != 0
+	if !expires && s.tokenRevalidationInterval <= 0 {
+		return w
+	}
+
+	go func() {
+		var expired <-chan time.Time
+		if expires {
+			timer := time.NewTimer(time.Until(time.Unix(p.exp, 0)))
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		var revalidate <-chan time.Time
+		if s.tokenRevalidationInterval > 0 {
+			ticker := time.NewTicker(s.tokenRevalidationInterval)
+			defer ticker.Stop()
+			revalidate = ticker.C
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-expired:
+				w.end(tokenExpiredErr)
+				return
+			case <-revalidate:
+				_, err := s.revalidate(ctx, p.token)
+				if ctx.Err() != nil {
+					return
+				}
+				// Streams are kept while the token cannot be
+				// checked, and it is checked again next time.
+				if isUnavailable(err) {
+					egressTokenUnavailableCounter.Add(1)
+					continue
+				}
+				if err != nil {
+					w.end(tokenRevokedErr(err))
+					return
+				}
+			}
+		}
+	}()
+
+	return w
+}
+
+// revalidate checks the token again, bypassing the token checker's
+// cache so that a revoked token is noticed within one interval.
+func (s *BoshMetricsServer) revalidate(ctx context.Context, token string) (*tokenchecker.Claims, error) {
+	if c, ok := s.tokenChecker.(revalidatingTokenChecker); ok {
+		return c.RevalidateTokenClaims(ctx, token)
+	}
+
+	return s.check(ctx, token)
+}
+
+func (w *tokenWatch) end(err error) {
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+
+	egressTokenEndedCounter.Add(1)
+	w.cancel()
+}
+
+// reason returns why the stream was ended, if it was
+// ended because of its token.
+func (w *tokenWatch) reason() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+func (w *tokenWatch) stop() {
+	w.cancel()
+}
+
+// parseTokenClaims reads the claims of a JWT. The token has
+// already been verified by the token checker.
+func parseTokenClaims(token string) (tokenchecker.Claims, bool) {
+	token = strings.TrimPrefix(token, "bearer ")
+	token = strings.TrimPrefix(token, "Bearer ")
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenchecker.Claims{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return tokenchecker.Claims{}, false
+	}
+
+	var claims tokenchecker.Claims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return tokenchecker.Claims{}, false
+	}
+
+	return claims, true
+}
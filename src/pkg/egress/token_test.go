@@ -0,0 +1,232 @@
+package egress_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/egress"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/tokenchecker"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBoshMetricsEndsTheStreamWhenTheTokenExpires(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	token := jwtExpiringAt(time.Now().Add(200 * time.Millisecond))
+	sender := newSpyEgressSender(validContext(token), 50)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil))
+	defer server.Start()()
+	defer close(messages)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "subscriptionA"}, sender)
+	}()
+
+	var err error
+	Eventually(errs).Should(Receive(&err))
+	Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+}
+
+func TestBoshMetricsEndsTheStreamWhenRevalidationFails(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	sender := newSpyEgressSender(validContext("test-token"), 50)
+	checker := &revokableTokenChecker{}
+	server := egress.NewServer(messages, checker, egress.WithTokenRevalidation(10*time.Millisecond))
+	defer server.Start()()
+	defer close(messages)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "subscriptionA"}, sender)
+	}()
+	// giving the stream a chance to subscribe
+	time.Sleep(time.Millisecond * 100)
+
+	messages <- event
+	Eventually(sender.received).Should(Receive())
+	Consistently(errs, 50*time.Millisecond).ShouldNot(Receive())
+
+	checker.revoke()
+
+	var err error
+	Eventually(errs).Should(Receive(&err))
+	Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+}
+
+func TestBoshMetricsRevalidatesTokensWithoutTheCache(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	sender := newSpyEgressSender(validContext("test-token"), 50)
+	server := egress.NewServer(messages, &cachedTokenChecker{}, egress.WithTokenRevalidation(10*time.Millisecond))
+	defer server.Start()()
+	defer close(messages)
+
+	err := server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "subscriptionA"}, sender)
+	Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+}
+
+func TestBoshMetricsKeepsStreamsWhileTheTokenCannotBeRevalidated(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	sender := newSpyEgressSender(validContext("test-token"), 50)
+	checker := &revokableTokenChecker{}
+	server := egress.NewServer(messages, checker, egress.WithTokenRevalidation(10*time.Millisecond))
+	defer server.Start()()
+	defer close(messages)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "subscriptionA"}, sender)
+	}()
+	// giving the stream a chance to subscribe
+	time.Sleep(time.Millisecond * 100)
+
+	messages <- event
+	Eventually(sender.received).Should(Receive())
+
+	checker.becomeUnavailable()
+	Consistently(errs, 100*time.Millisecond).ShouldNot(Receive())
+
+	checker.revoke()
+
+	var err error
+	Eventually(errs).Should(Receive(&err))
+	Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+}
+
+func TestBoshMetricsReturnsUnavailableWhenTheTokenCannotBeChecked(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	checker := newSpyTokenChecker(&tokenchecker.UnavailableError{Err: errors.New("connection refused")})
+	server := egress.NewServer(messages, checker)
+	defer server.Start()()
+	defer close(messages)
+
+	err := server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "subscriptionA"}, newSpyEgressSender(validContext("test-token"), 50))
+	Expect(status.Code(err)).To(Equal(codes.Unavailable))
+}
+
+func TestBoshMetricsKeepsStreamsWithOpaqueTokens(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	sender := newSpyEgressSender(validContext("test-token"), 50)
+	server := egress.NewServer(messages, newSpyTokenChecker(nil))
+	defer server.Start()()
+	defer close(messages)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "subscriptionA"}, sender)
+	}()
+
+	Consistently(errs, 100*time.Millisecond).ShouldNot(Receive())
+}
+
+type revokableTokenChecker struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (c *revokableTokenChecker) CheckToken(token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+func (c *revokableTokenChecker) revoke() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = errors.New("token revoked")
+}
+
+func (c *revokableTokenChecker) becomeUnavailable() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = &tokenchecker.UnavailableError{Err: errors.New("connection refused")}
+}
+
+// jwtExpiringAt returns an unsigned token with the exp claim.
+func jwtExpiringAt(exp time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+
+	return fmt.Sprintf("bearer %s.%s.", header, payload)
+}
+
+func TestBoshMetricsReportsStreamsByTheClientIDOfTheTokenClaims(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *definitions.Event, 1000)
+	checker := &claimsTokenChecker{claims: &tokenchecker.Claims{ClientID: "opaque-forwarder"}}
+	server := egress.NewServer(messages, checker)
+	defer server.Start()()
+	defer close(messages)
+
+	ctx, cancel := context.WithCancel(validContext("opaque-token"))
+	sender := newSpyEgressSender(ctx, 50)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.BoshMetrics(&definitions.EgressRequest{SubscriptionId: "subscriptionA"}, sender)
+	}()
+
+	streams := expvar.Get("egress.client_streams").(*expvar.Map)
+	sent := expvar.Get("egress.client_sent").(*expvar.Map)
+	Eventually(func() string {
+		if v := streams.Get("opaque-forwarder"); v != nil {
+			return v.String()
+		}
+		return ""
+	}).Should(Equal("1"))
+
+	messages <- event
+	Eventually(sender.received).Should(Receive())
+	Expect(sent.Get("opaque-forwarder").String()).To(Equal("1"))
+
+	cancel()
+	Eventually(errs).Should(Receive())
+	Expect(streams.Get("opaque-forwarder").String()).To(Equal("0"))
+}
+
+// cachedTokenChecker accepts tokens from its cache
+// but rejects them when they are revalidated.
+type cachedTokenChecker struct{}
+
+func (c *cachedTokenChecker) CheckToken(token string) error {
+	return nil
+}
+
+func (c *cachedTokenChecker) RevalidateTokenClaims(ctx context.Context, token string) (*tokenchecker.Claims, error) {
+	return nil, errors.New("token revoked")
+}
+
+type claimsTokenChecker struct {
+	claims *tokenchecker.Claims
+}
+
+func (c *claimsTokenChecker) CheckToken(token string) error {
+	return nil
+}
+
+func (c *claimsTokenChecker) CheckTokenClaims(ctx context.Context, token string) (*tokenchecker.Claims, error) {
+	return c.claims, nil
+}
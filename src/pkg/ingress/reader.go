@@ -17,27 +17,57 @@ type Ingestor struct {
 	port         int
 	unmarshaller unmarshaller
 	output       chan *definitions.Event
+	alerts       chan *definitions.Event
+
+	shedHeartbeats bool
 }
 
 var (
 	ingressReceivedCounter      *expvar.Int
 	ingressUnmarshallErrCounter *expvar.Int
 	ingressReadErrCounter       *expvar.Int
+	ingressDroppedCounter       *expvar.Int
 )
 
 func init() {
 	ingressReceivedCounter = expvar.NewInt("ingress.received")
 	ingressUnmarshallErrCounter = expvar.NewInt("ingress.unmarshall_err")
 	ingressReadErrCounter = expvar.NewInt("ingress.read_err")
+	ingressDroppedCounter = expvar.NewInt("ingress.dropped")
+}
+
+type IngestorOpt func(*Ingestor)
+
+// WithAlertOutput sends alerts to their own channel so they
+// are not queued behind other events.
+func WithAlertOutput(a chan *definitions.Event) IngestorOpt {
+	return func(i *Ingestor) {
+		i.alerts = a
+	}
+}
+
+// WithHeartbeatShedding drops events other than alerts when their
+// output is full, instead of blocking the connection, so they cannot
+// hold up the alerts behind them. It only applies with WithAlertOutput.
+func WithHeartbeatShedding() IngestorOpt {
+	return func(i *Ingestor) {
+		i.shedHeartbeats = true
+	}
 }
 
 // New returns a new Ingestor.
-func New(p int, u unmarshaller, m chan *definitions.Event) *Ingestor {
-	return &Ingestor{
+func New(p int, u unmarshaller, m chan *definitions.Event, opts ...IngestorOpt) *Ingestor {
+	i := &Ingestor{
 		port:         p,
 		unmarshaller: u,
 		output:       m,
 	}
+
+	for _, o := range opts {
+		o(i)
+	}
+
+	return i
 }
 
 // Start spins up a go routine to listen for bosh events over tcp.
@@ -88,12 +118,32 @@ func (i *Ingestor) handleConnection(conn net.Conn, stop chan struct{}) {
 		if shouldStop(stop) {
 			return
 		} else {
-			i.output <- evt
-			ingressReceivedCounter.Add(1)
+			i.write(evt)
 		}
 	}
 }
 
+func (i *Ingestor) write(evt *definitions.Event) {
+	if i.alerts != nil && evt.GetAlert() != nil {
+		i.alerts <- evt
+		ingressReceivedCounter.Add(1)
+		return
+	}
+
+	if i.alerts == nil || !i.shedHeartbeats {
+		i.output <- evt
+		ingressReceivedCounter.Add(1)
+		return
+	}
+
+	select {
+	case i.output <- evt:
+		ingressReceivedCounter.Add(1)
+	default:
+		ingressDroppedCounter.Add(1)
+	}
+}
+
 func shouldStop(s chan struct{}) bool {
 	select {
 	case <-s:
@@ -188,3 +188,66 @@ func (r *spyReader) ReadBytes(byte) ([]byte, error) {
 func (r *spyReader) CallCount() int64 {
 	return atomic.LoadInt64(&r.callCount)
 }
+
+func TestAlertsAreWrittenToTheAlertOutput(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	port := 25598
+	fakeUnmarshaller := newFakeUnmarshaller()
+	fakeUnmarshaller.on("alert\n", event)
+	fakeUnmarshaller.on("heartbeat\n", heartbeat)
+	messages := make(chan *definitions.Event, 1)
+	alerts := make(chan *definitions.Event, 100)
+	ingestor := ingress.New(port, fakeUnmarshaller.f, messages, ingress.WithAlertOutput(alerts), ingress.WithHeartbeatShedding())
+
+	defer ingestor.Start()()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:25598")
+	Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+
+	// The second heartbeat is dropped instead of blocking the alert.
+	_, err = conn.Write([]byte("heartbeat\nheartbeat\nalert\n"))
+	Expect(err).ToNot(HaveOccurred())
+
+	Eventually(alerts).Should(Receive(Equal(event)))
+	Expect(messages).To(Receive(Equal(heartbeat)))
+	Consistently(messages).ShouldNot(Receive())
+}
+
+func TestHeartbeatsBlockWhenTheOutputIsFull(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	port := 25599
+	fakeUnmarshaller := newFakeUnmarshaller()
+	fakeUnmarshaller.on("heartbeat\n", heartbeat)
+	messages := make(chan *definitions.Event, 1)
+	alerts := make(chan *definitions.Event, 100)
+	ingestor := ingress.New(port, fakeUnmarshaller.f, messages, ingress.WithAlertOutput(alerts))
+
+	defer ingestor.Start()()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:25599")
+	Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("heartbeat\nheartbeat\n"))
+	Expect(err).ToNot(HaveOccurred())
+
+	Eventually(messages).Should(Receive(Equal(heartbeat)))
+	Eventually(messages).Should(Receive(Equal(heartbeat)))
+}
+
+var heartbeat = &definitions.Event{
+	Id:         "55b68400-f984-4f76-b341-cf849e07d4f9",
+	Timestamp:  1499293724,
+	Deployment: "loggregator",
+	Message: &definitions.Event_Heartbeat{
+		Heartbeat: &definitions.Heartbeat{
+			Job:        "consul",
+			InstanceId: "6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9",
+		},
+	},
+}
@@ -0,0 +1,50 @@
+// Package batch groups the events queued for a sink into batches.
+package batch
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+)
+
+// Run reads events from in and calls flush with batches of at most
+// size events. A batch that is not full is flushed every interval.
+// Once stop is closed, what is still queued in is flushed and Run
+// returns. The batch passed to flush is reused once flush returns.
+func Run(in <-chan *definitions.Event, size int, interval time.Duration, stop <-chan struct{}, flush func([]*definitions.Event)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]*definitions.Event, 0, size)
+	add := func(evt *definitions.Event) {
+		batch = append(batch, evt)
+		if len(batch) >= size {
+			flush(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case evt := <-in:
+			add(evt)
+		case <-ticker.C:
+			if len(batch) > 0 {
+				flush(batch)
+				batch = batch[:0]
+			}
+		case <-stop:
+			for {
+				select {
+				case evt := <-in:
+					add(evt)
+				default:
+					if len(batch) > 0 {
+						flush(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
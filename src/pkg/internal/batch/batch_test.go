@@ -0,0 +1,48 @@
+package batch_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/internal/batch"
+	. "github.com/onsi/gomega"
+)
+
+func TestRunFlushesFullBatchesAndWhatIsLeftOnStop(t *testing.T) {
+	RegisterTestingT(t)
+
+	in := make(chan *definitions.Event, 10)
+	for i := 0; i < 5; i++ {
+		in <- &definitions.Event{}
+	}
+	stop := make(chan struct{})
+	close(stop)
+
+	var sizes []int
+	batch.Run(in, 2, time.Hour, stop, func(b []*definitions.Event) {
+		sizes = append(sizes, len(b))
+	})
+
+	Expect(sizes).To(Equal([]int{2, 2, 1}))
+}
+
+func TestRunFlushesPartialBatchesEveryInterval(t *testing.T) {
+	RegisterTestingT(t)
+
+	in := make(chan *definitions.Event, 10)
+	stop := make(chan struct{})
+	flushed := make(chan int, 10)
+	go func() {
+		batch.Run(in, 100, 10*time.Millisecond, stop, func(b []*definitions.Event) {
+			flushed <- len(b)
+		})
+		close(flushed)
+	}()
+
+	in <- &definitions.Event{}
+	Eventually(flushed).Should(Receive(Equal(1)))
+
+	close(stop)
+	Eventually(flushed).Should(BeClosed())
+}
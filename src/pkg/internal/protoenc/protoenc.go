@@ -0,0 +1,61 @@
+// Package protoenc helps encode protobuf messages by hand, for sinks
+// that send to services whose protobuf definitions are not vendored,
+// and send them over grpc as is.
+package protoenc
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// AppendMessage appends the encoded message m as field num.
+func AppendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// AppendString appends s as field num.
+func AppendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// AppendFixed64 appends v as fixed64 field num.
+func AppendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+// AppendVarint appends v as varint field num.
+func AppendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// Codec is a grpc codec that passes already encoded
+// requests through and returns responses undecoded.
+type Codec struct{}
+
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("protoenc: unable to marshal %T", v)
+	}
+
+	return b, nil
+}
+
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("protoenc: unable to unmarshal into %T", v)
+	}
+	*b = append((*b)[:0], data...)
+
+	return nil
+}
+
+func (Codec) Name() string {
+	return "proto"
+}
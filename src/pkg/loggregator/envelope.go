@@ -0,0 +1,141 @@
+package loggregator
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/internal/protoenc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers are those of the loggregator.v2
+// messages named in the comments.
+
+const (
+	sourceID = "bosh-system-metrics-server"
+	origin   = "bosh-system-metrics-server"
+)
+
+// encodeBatch returns an EnvelopeBatch with a gauge envelope for every
+// heartbeat metric and an event envelope for every alert.
+func encodeBatch(events []*definitions.Event) ([]byte, int) {
+	var b []byte
+	var n int
+	for _, e := range events {
+		switch {
+		case e.GetHeartbeat() != nil:
+			hb := e.GetHeartbeat()
+			for _, m := range hb.GetMetrics() {
+				b = protoenc.AppendMessage(b, 1, gaugeEnvelope(e, hb, m))
+				n++
+			}
+		case e.GetAlert() != nil:
+			b = protoenc.AppendMessage(b, 1, eventEnvelope(e, e.GetAlert()))
+			n++
+		}
+	}
+
+	return b, n
+}
+
+// envelopeCount returns the number of envelopes the event is sent as.
+func envelopeCount(e *definitions.Event) int {
+	if hb := e.GetHeartbeat(); hb != nil {
+		return len(hb.GetMetrics())
+	}
+	if e.GetAlert() != nil {
+		return 1
+	}
+
+	return 0
+}
+
+func gaugeEnvelope(e *definitions.Event, hb *definitions.Heartbeat, m *definitions.Heartbeat_Metric) []byte {
+	tags := map[string]string{
+		"deployment": e.GetDeployment(),
+		"job":        hb.GetJob(),
+		"index":      strconv.Itoa(int(hb.GetIndex())),
+		"id":         hb.GetInstanceId(),
+		"origin":     origin,
+	}
+	for k, v := range m.GetTags() {
+		if _, ok := tags[k]; !ok {
+			tags[k] = v
+		}
+	}
+
+	// GaugeValue
+	var value []byte
+	value = protoenc.AppendString(value, 1, unit(m.GetName()))
+	value = protoenc.AppendFixed64(value, 2, math.Float64bits(m.GetValue()))
+
+	// Gauge.metrics map entry
+	var entry []byte
+	entry = protoenc.AppendString(entry, 1, m.GetName())
+	entry = protoenc.AppendMessage(entry, 2, value)
+
+	// Gauge
+	gauge := protoenc.AppendMessage(nil, 1, entry)
+
+	return envelope(m.GetTimestamp(), strconv.Itoa(int(hb.GetIndex())), tags, 6, gauge)
+}
+
+func eventEnvelope(e *definitions.Event, a *definitions.Alert) []byte {
+	tags := map[string]string{
+		"deployment": e.GetDeployment(),
+		"severity":   strconv.Itoa(int(a.GetSeverity())),
+		"category":   a.GetCategory(),
+		"source":     a.GetSource(),
+		"origin":     origin,
+	}
+
+	// Event
+	var event []byte
+	event = protoenc.AppendString(event, 1, a.GetTitle())
+	event = protoenc.AppendString(event, 2, a.GetSummary())
+
+	return envelope(e.GetTimestamp(), "", tags, 10, event)
+}
+
+// envelope returns an Envelope holding the message as field num.
+// Timestamps from bosh are in seconds.
+func envelope(timestamp int64, instanceID string, tags map[string]string, num protowire.Number, message []byte) []byte {
+	var b []byte
+	b = protoenc.AppendVarint(b, 1, uint64(timestamp*int64(time.Second)))
+	b = protoenc.AppendString(b, 2, sourceID)
+	b = protoenc.AppendMessage(b, num, message)
+	b = protoenc.AppendString(b, 8, instanceID)
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// Envelope.tags map entry
+		var entry []byte
+		entry = protoenc.AppendString(entry, 1, k)
+		entry = protoenc.AppendString(entry, 2, tags[k])
+		b = protoenc.AppendMessage(b, 9, entry)
+	}
+
+	return b
+}
+
+// unit guesses the unit of a bosh heartbeat metric from its name.
+func unit(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".percent"), strings.HasPrefix(name, "system.cpu."):
+		return "Percent"
+	case strings.HasSuffix(name, ".kb"):
+		return "Kb"
+	case strings.HasPrefix(name, "system.load."):
+		return "Load"
+	default:
+		return ""
+	}
+}
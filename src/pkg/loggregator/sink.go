@@ -0,0 +1,147 @@
+package loggregator
+
+import (
+	"crypto/tls"
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/internal/batch"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/internal/protoenc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const sendMethod = "/loggregator.v2.Ingress/Send"
+
+var (
+	loggregatorSent    *expvar.Int
+	loggregatorDropped *expvar.Int
+	loggregatorSendErr *expvar.Int
+)
+
+func init() {
+	loggregatorSent = expvar.NewInt("loggregator.sent")
+	loggregatorDropped = expvar.NewInt("loggregator.dropped")
+	loggregatorSendErr = expvar.NewInt("loggregator.send_err")
+}
+
+// Sink sends heartbeats as gauge envelopes and alerts as event
+// envelopes to a Loggregator agent's v2 ingress. Events are buffered
+// and sent in batches. Events that do not fit in the buffer, or that
+// are in a batch the agent does not accept, are dropped. Sent and
+// dropped are both counted in envelopes.
+type Sink struct {
+	conn   *grpc.ClientConn
+	events chan *definitions.Event
+
+	bufferSize    int
+	batchSize     int
+	flushInterval time.Duration
+	timeout       time.Duration
+}
+
+type SinkOpt func(*Sink)
+
+// WithBufferSize sets how many events are buffered while
+// waiting to be sent.
+func WithBufferSize(n int) SinkOpt {
+	return func(s *Sink) {
+		s.bufferSize = n
+	}
+}
+
+// WithBatchSize sets the most events sent in one batch.
+func WithBatchSize(n int) SinkOpt {
+	return func(s *Sink) {
+		s.batchSize = n
+	}
+}
+
+// WithFlushInterval sets how long events wait for a batch to fill
+// before they are sent.
+func WithFlushInterval(d time.Duration) SinkOpt {
+	return func(s *Sink) {
+		s.flushInterval = d
+	}
+}
+
+// New returns a Sink that sends to the agent at addr. The agent
+// requires mutual TLS, so tlsConfig must hold a client certificate.
+func New(addr string, tlsConfig *tls.Config, opts ...SinkOpt) (*Sink, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sink{
+		conn:          conn,
+		bufferSize:    10000,
+		batchSize:     100,
+		flushInterval: time.Second,
+		timeout:       5 * time.Second,
+	}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	s.events = make(chan *definitions.Event, s.bufferSize)
+
+	return s, nil
+}
+
+// Write queues heartbeats and alerts to be sent without blocking.
+func (s *Sink) Write(evt *definitions.Event) {
+	if evt.GetHeartbeat() == nil && evt.GetAlert() == nil {
+		return
+	}
+
+	select {
+	case s.events <- evt:
+	default:
+		loggregatorDropped.Add(int64(envelopeCount(evt)))
+	}
+}
+
+// Start spins up a go routine that sends the queued events.
+// It returns a shutdown function that sends what is still queued,
+// closes the connection to the agent and blocks until it is done.
+func (s *Sink) Start() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		batch.Run(s.events, s.batchSize, s.flushInterval, stop, s.send)
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		s.conn.Close()
+	}
+}
+
+func (s *Sink) send(batch []*definitions.Event) {
+	req, n := encodeBatch(batch)
+	if n == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var resp []byte
+	err := s.conn.Invoke(ctx, sendMethod, req, &resp, grpc.ForceCodec(protoenc.Codec{}))
+	if err != nil {
+		log.Printf("dropping %d envelopes, unable to send to loggregator agent: %s\n", n, err)
+		loggregatorSendErr.Add(1)
+		loggregatorDropped.Add(int64(n))
+		return
+	}
+
+	loggregatorSent.Add(int64(n))
+}
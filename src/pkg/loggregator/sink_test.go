@@ -0,0 +1,279 @@
+package loggregator_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"expvar"
+	"math"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/internal/protoenc"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/loggregator"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestSinkSendsHeartbeatMetricsAsGaugeEnvelopes(t *testing.T) {
+	RegisterTestingT(t)
+
+	agent := newFakeAgent()
+	defer agent.stop()
+
+	sink, err := loggregator.New(agent.addr, agent.clientTLSConfig, loggregator.WithFlushInterval(10*time.Millisecond))
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+	sink.Write(heartbeat)
+
+	var batch []byte
+	Eventually(agent.batches).Should(Receive(&batch))
+	envelopes := decode(batch)[1]
+	Expect(envelopes).To(HaveLen(2))
+
+	envelope := decode(envelopes[0].([]byte))
+	Expect(envelope[1][0]).To(Equal(uint64(1499293724 * time.Second)))
+	Expect(string(envelope[2][0].([]byte))).To(Equal("bosh-system-metrics-server"))
+	Expect(string(envelope[8][0].([]byte))).To(Equal("4"))
+	Expect(mapEntries(envelope[9])).To(Equal(map[string]string{
+		"deployment": "loggregator",
+		"job":        "consul",
+		"index":      "4",
+		"id":         "6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9",
+		"origin":     "bosh-system-metrics-server",
+		"cpu":        "total",
+	}))
+
+	metric := decode(decode(envelope[6][0].([]byte))[1][0].([]byte))
+	Expect(string(metric[1][0].([]byte))).To(Equal("system.cpu.user"))
+	value := decode(metric[2][0].([]byte))
+	Expect(string(value[1][0].([]byte))).To(Equal("Percent"))
+	Expect(math.Float64frombits(value[2][0].(uint64))).To(Equal(2.5))
+}
+
+func TestSinkSendsAlertsAsEventEnvelopes(t *testing.T) {
+	RegisterTestingT(t)
+
+	agent := newFakeAgent()
+	defer agent.stop()
+
+	sink, err := loggregator.New(agent.addr, agent.clientTLSConfig, loggregator.WithFlushInterval(10*time.Millisecond))
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+	sink.Write(alert)
+
+	var batch []byte
+	Eventually(agent.batches).Should(Receive(&batch))
+	envelope := decode(decode(batch)[1][0].([]byte))
+	Expect(mapEntries(envelope[9])).To(HaveKeyWithValue("severity", "4"))
+
+	event := decode(envelope[10][0].([]byte))
+	Expect(string(event[1][0].([]byte))).To(Equal("SSH Access Denied"))
+	Expect(string(event[2][0].([]byte))).To(Equal("Failed password for vcap from 10.244.0.1 port 38732 ssh2"))
+}
+
+func TestSinkSendsQueuedEventsOnShutdown(t *testing.T) {
+	RegisterTestingT(t)
+
+	agent := newFakeAgent()
+	defer agent.stop()
+
+	sink, err := loggregator.New(agent.addr, agent.clientTLSConfig, loggregator.WithBufferSize(2))
+	Expect(err).ToNot(HaveOccurred())
+	sink.Write(alert)
+	sink.Write(alert)
+	sink.Write(alert)
+	sink.Start()()
+
+	var batch []byte
+	Expect(agent.batches).To(Receive(&batch))
+	Expect(decode(batch)[1]).To(HaveLen(2))
+}
+
+func TestSinkCountsDroppedEnvelopes(t *testing.T) {
+	RegisterTestingT(t)
+
+	agent := newFakeAgent()
+	defer agent.stop()
+
+	sink, err := loggregator.New(agent.addr, agent.clientTLSConfig, loggregator.WithBufferSize(1))
+	Expect(err).ToNot(HaveOccurred())
+	dropped := expvar.Get("loggregator.dropped").(*expvar.Int).Value()
+	sink.Write(heartbeat)
+	sink.Write(heartbeat)
+
+	Expect(expvar.Get("loggregator.dropped").(*expvar.Int).Value() - dropped).To(Equal(int64(2)))
+}
+
+type fakeAgent struct {
+	addr            string
+	batches         chan []byte
+	clientTLSConfig *tls.Config
+	server          *grpc.Server
+}
+
+// newFakeAgent starts a grpc server that requires client certificates
+// and records the batches sent to loggregator.v2.Ingress/Send.
+func newFakeAgent() *fakeAgent {
+	ca, caKey := newCertificate(nil, nil, "ca")
+	serverCert := newKeyPair(ca, caKey, "metron")
+	clientCert := newKeyPair(ca, caKey, "system-metrics-server")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	a := &fakeAgent{
+		batches: make(chan []byte, 10),
+		clientTLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      pool,
+			ServerName:   "metron",
+		},
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	a.addr = lis.Addr().String()
+
+	a.server = grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})),
+		grpc.ForceServerCodec(protoenc.Codec{}),
+		grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+			method, _ := grpc.MethodFromServerStream(stream)
+			Expect(method).To(Equal("/loggregator.v2.Ingress/Send"))
+
+			var body []byte
+			if err := stream.RecvMsg(&body); err != nil {
+				return err
+			}
+			a.batches <- body
+
+			return stream.SendMsg([]byte{})
+		}),
+	)
+	go a.server.Serve(lis)
+
+	return a
+}
+
+func (a *fakeAgent) stop() {
+	a.server.Stop()
+}
+
+func newCertificate(parent *x509.Certificate, parentKey *ecdsa.PrivateKey, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	return cert, key
+}
+
+func newKeyPair(ca *x509.Certificate, caKey *ecdsa.PrivateKey, name string) tls.Certificate {
+	cert, key := newCertificate(ca, caKey, name)
+
+	return tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+	}
+}
+
+// decode returns the fields of a protobuf message. Length delimited
+// fields are []byte and all others are uint64.
+func decode(b []byte) map[protowire.Number][]interface{} {
+	m := make(map[protowire.Number][]interface{})
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		Expect(n).To(BeNumerically(">", 0))
+		b = b[n:]
+
+		var v interface{}
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		}
+		Expect(n).To(BeNumerically(">", 0))
+		b = b[n:]
+
+		m[num] = append(m[num], v)
+	}
+
+	return m
+}
+
+// mapEntries decodes the entries of a map<string, string> field.
+func mapEntries(entries []interface{}) map[string]string {
+	m := make(map[string]string)
+	for _, e := range entries {
+		entry := decode(e.([]byte))
+		m[string(entry[1][0].([]byte))] = string(entry[2][0].([]byte))
+	}
+
+	return m
+}
+
+var heartbeat = &definitions.Event{
+	Id:         "55b68400-f984-4f76-b341-cf849e07d4f9",
+	Timestamp:  1499293724,
+	Deployment: "loggregator",
+	Message: &definitions.Event_Heartbeat{
+		Heartbeat: &definitions.Heartbeat{
+			AgentId:    "2accd102-37e7-4dd6-b337-b3f87da97914",
+			Job:        "consul",
+			Index:      4,
+			InstanceId: "6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9",
+			JobState:   "running",
+			Metrics: []*definitions.Heartbeat_Metric{
+				{Name: "system.cpu.user", Value: 2.5, Timestamp: 1499293724, Tags: map[string]string{"cpu": "total"}},
+				{Name: "system.mem.kb", Value: 1024, Timestamp: 1499293724},
+			},
+		},
+	},
+}
+
+var alert = &definitions.Event{
+	Id:         "93eb25a4-9348-4232-6f71-69e1e01081d7",
+	Timestamp:  1499359162,
+	Deployment: "loggregator",
+	Message: &definitions.Event_Alert{
+		Alert: &definitions.Alert{
+			Severity: 4,
+			Title:    "SSH Access Denied",
+			Summary:  "Failed password for vcap from 10.244.0.1 port 38732 ssh2",
+		},
+	},
+}
@@ -0,0 +1,152 @@
+package otlp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/internal/protoenc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	metricsMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	logsMethod    = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+)
+
+// Client sends encoded OTLP export requests to a collector.
+type Client interface {
+	ExportMetrics(ctx context.Context, req []byte) error
+	ExportLogs(ctx context.Context, req []byte) error
+}
+
+type grpcClient struct {
+	conn *grpc.ClientConn
+}
+
+// NewGRPCClient returns a Client that exports over OTLP/gRPC to the
+// collector at addr. A nil tlsConfig disables TLS.
+func NewGRPCClient(addr string, tlsConfig *tls.Config) (Client, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpcClient{conn: conn}, nil
+}
+
+func (c *grpcClient) ExportMetrics(ctx context.Context, req []byte) error {
+	return c.export(ctx, metricsMethod, req)
+}
+
+func (c *grpcClient) ExportLogs(ctx context.Context, req []byte) error {
+	return c.export(ctx, logsMethod, req)
+}
+
+func (c *grpcClient) export(ctx context.Context, method string, req []byte) error {
+	var resp []byte
+	err := c.conn.Invoke(ctx, method, req, &resp, grpc.ForceCodec(protoenc.Codec{}))
+	if err == nil {
+		return nil
+	}
+
+	switch status.Code(err) {
+	case codes.Canceled,
+		codes.DeadlineExceeded,
+		codes.Aborted,
+		codes.OutOfRange,
+		codes.Unavailable,
+		codes.DataLoss,
+		codes.ResourceExhausted:
+		return err
+	default:
+		return permanent(err)
+	}
+}
+
+type httpClient struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewHTTPClient returns a Client that exports over OTLP/HTTP with
+// protobuf encoding. Requests are posted to the /v1/metrics and
+// /v1/logs paths of endpoint.
+func NewHTTPClient(endpoint string, tlsConfig *tls.Config) Client {
+	return &httpClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}
+}
+
+func (c *httpClient) ExportMetrics(ctx context.Context, req []byte) error {
+	return c.export(ctx, "/v1/metrics", req)
+}
+
+func (c *httpClient) ExportLogs(ctx context.Context, req []byte) error {
+	return c.export(ctx, "/v1/logs", req)
+}
+
+func (c *httpClient) export(ctx context.Context, path string, req []byte) error {
+	r, err := http.NewRequest(http.MethodPost, c.endpoint+path, bytes.NewReader(req))
+	if err != nil {
+		return permanent(err)
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := c.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	err = fmt.Errorf("otlp collector responded with %s", resp.Status)
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return err
+	default:
+		return permanent(err)
+	}
+}
+
+// permanentError is an export error that retrying will not fix.
+type permanentError struct {
+	err error
+}
+
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
@@ -0,0 +1,181 @@
+package otlp
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/internal/protoenc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers are those of the opentelemetry-proto
+// v1 messages named in the comments.
+
+const scopeName = "bosh-system-metrics-server"
+
+// OTLP SeverityNumber values.
+const (
+	severityUnspecified = 0
+	severityWarn        = 13
+	severityError       = 17
+	severityError3      = 19
+	severityFatal       = 21
+)
+
+// encodeMetrics returns an ExportMetricsServiceRequest with a
+// ResourceMetrics for each heartbeat.
+func encodeMetrics(events []*definitions.Event) []byte {
+	var b []byte
+	for _, e := range events {
+		hb := e.GetHeartbeat()
+		if hb == nil {
+			continue
+		}
+
+		// ResourceMetrics
+		var rm []byte
+		rm = protoenc.AppendMessage(rm, 1, heartbeatResource(e, hb))
+
+		// ScopeMetrics
+		var sm []byte
+		sm = protoenc.AppendMessage(sm, 1, scope())
+		for _, m := range hb.GetMetrics() {
+			sm = protoenc.AppendMessage(sm, 2, gaugeMetric(m))
+		}
+		rm = protoenc.AppendMessage(rm, 2, sm)
+
+		b = protoenc.AppendMessage(b, 1, rm)
+	}
+
+	return b
+}
+
+// encodeLogs returns an ExportLogsServiceRequest with a ResourceLogs
+// for each alert.
+func encodeLogs(events []*definitions.Event) []byte {
+	var b []byte
+	for _, e := range events {
+		a := e.GetAlert()
+		if a == nil {
+			continue
+		}
+
+		// Resource
+		var res []byte
+		res = appendAttribute(res, 1, "bosh.deployment", e.GetDeployment())
+
+		// ResourceLogs
+		var rl []byte
+		rl = protoenc.AppendMessage(rl, 1, res)
+
+		// ScopeLogs
+		var sl []byte
+		sl = protoenc.AppendMessage(sl, 1, scope())
+		sl = protoenc.AppendMessage(sl, 2, logRecord(e, a))
+		rl = protoenc.AppendMessage(rl, 2, sl)
+
+		b = protoenc.AppendMessage(b, 1, rl)
+	}
+
+	return b
+}
+
+func heartbeatResource(e *definitions.Event, hb *definitions.Heartbeat) []byte {
+	// Resource
+	var b []byte
+	b = appendAttribute(b, 1, "bosh.deployment", e.GetDeployment())
+	b = appendAttribute(b, 1, "bosh.job", hb.GetJob())
+	b = appendAttribute(b, 1, "bosh.instance.id", hb.GetInstanceId())
+	b = appendAttribute(b, 1, "bosh.instance.index", strconv.Itoa(int(hb.GetIndex())))
+	b = appendAttribute(b, 1, "bosh.agent.id", hb.GetAgentId())
+
+	return b
+}
+
+func scope() []byte {
+	// InstrumentationScope
+	return protoenc.AppendString(nil, 1, scopeName)
+}
+
+func gaugeMetric(m *definitions.Heartbeat_Metric) []byte {
+	// NumberDataPoint
+	var dp []byte
+	dp = protoenc.AppendFixed64(dp, 3, uint64(seconds(m.GetTimestamp())))
+	dp = protoenc.AppendFixed64(dp, 4, math.Float64bits(m.GetValue()))
+	for _, k := range sortedKeys(m.GetTags()) {
+		dp = appendAttribute(dp, 7, k, m.GetTags()[k])
+	}
+
+	// Gauge
+	gauge := protoenc.AppendMessage(nil, 1, dp)
+
+	// Metric
+	var b []byte
+	b = protoenc.AppendString(b, 1, m.GetName())
+	b = protoenc.AppendMessage(b, 5, gauge)
+
+	return b
+}
+
+func logRecord(e *definitions.Event, a *definitions.Alert) []byte {
+	number, text := severity(a.GetSeverity())
+
+	// LogRecord
+	var b []byte
+	b = protoenc.AppendFixed64(b, 1, uint64(seconds(e.GetTimestamp())))
+	b = protoenc.AppendVarint(b, 2, uint64(number))
+	b = protoenc.AppendString(b, 3, text)
+	b = protoenc.AppendMessage(b, 5, protoenc.AppendString(nil, 1, a.GetSummary()))
+	b = appendAttribute(b, 6, "bosh.alert.id", e.GetId())
+	b = appendAttribute(b, 6, "bosh.alert.title", a.GetTitle())
+	b = appendAttribute(b, 6, "bosh.alert.category", a.GetCategory())
+	b = appendAttribute(b, 6, "bosh.alert.source", a.GetSource())
+	b = protoenc.AppendFixed64(b, 11, uint64(time.Now().UnixNano()))
+
+	return b
+}
+
+// severity maps a bosh alert severity to an OTLP SeverityNumber and
+// SeverityText. Bosh uses 1 for alert, 2 for critical, 3 for error
+// and 4 for warning.
+func severity(s int32) (int, string) {
+	switch s {
+	case 1:
+		return severityFatal, "ALERT"
+	case 2:
+		return severityError3, "CRITICAL"
+	case 3:
+		return severityError, "ERROR"
+	case 4:
+		return severityWarn, "WARNING"
+	default:
+		return severityUnspecified, ""
+	}
+}
+
+// seconds converts a bosh timestamp, which is in seconds, to nanoseconds.
+func seconds(t int64) int64 {
+	return t * int64(time.Second)
+}
+
+// appendAttribute appends a KeyValue with a string AnyValue.
+func appendAttribute(b []byte, num protowire.Number, key, value string) []byte {
+	var kv []byte
+	kv = protoenc.AppendString(kv, 1, key)
+	kv = protoenc.AppendMessage(kv, 2, protoenc.AppendString(nil, 1, value))
+
+	return protoenc.AppendMessage(b, num, kv)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,192 @@
+package otlp
+
+import (
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/internal/batch"
+	"golang.org/x/net/context"
+)
+
+var (
+	otlpExported  *expvar.Int
+	otlpDropped   *expvar.Int
+	otlpRetries   *expvar.Int
+	otlpExportErr *expvar.Int
+)
+
+func init() {
+	otlpExported = expvar.NewInt("otlp.exported")
+	otlpDropped = expvar.NewInt("otlp.dropped")
+	otlpRetries = expvar.NewInt("otlp.retries")
+	otlpExportErr = expvar.NewInt("otlp.export_err")
+}
+
+// Exporter pushes heartbeats as OTLP gauge metrics and alerts as OTLP
+// log records to a collector. Events are buffered and sent in batches.
+// Events that do not fit in the buffer, or that could not be sent
+// after retrying, are dropped.
+type Exporter struct {
+	client Client
+	events chan *definitions.Event
+
+	bufferSize    int
+	batchSize     int
+	flushInterval time.Duration
+	timeout       time.Duration
+	retries       int
+	backoff       time.Duration
+	maxBackoff    time.Duration
+}
+
+type ExporterOpt func(*Exporter)
+
+// WithBufferSize sets how many events are buffered while
+// waiting to be exported.
+func WithBufferSize(n int) ExporterOpt {
+	return func(e *Exporter) {
+		e.bufferSize = n
+	}
+}
+
+// WithBatchSize sets the most events sent in one export.
+func WithBatchSize(n int) ExporterOpt {
+	return func(e *Exporter) {
+		e.batchSize = n
+	}
+}
+
+// WithFlushInterval sets how long events wait for a batch to fill
+// before they are exported.
+func WithFlushInterval(d time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.flushInterval = d
+	}
+}
+
+// WithRetries sets how many times a failed export is retried. The
+// wait between attempts starts at backoff and doubles each attempt.
+func WithRetries(n int, backoff time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.retries = n
+		e.backoff = backoff
+	}
+}
+
+// New returns an Exporter that sends to the given client.
+func New(c Client, opts ...ExporterOpt) *Exporter {
+	e := &Exporter{
+		client:        c,
+		bufferSize:    10000,
+		batchSize:     512,
+		flushInterval: time.Second,
+		timeout:       10 * time.Second,
+		retries:       5,
+		backoff:       500 * time.Millisecond,
+		maxBackoff:    30 * time.Second,
+	}
+
+	for _, o := range opts {
+		o(e)
+	}
+
+	e.events = make(chan *definitions.Event, e.bufferSize)
+
+	return e
+}
+
+// Write queues heartbeats and alerts for export without blocking.
+func (e *Exporter) Write(evt *definitions.Event) {
+	if evt.GetHeartbeat() == nil && evt.GetAlert() == nil {
+		return
+	}
+
+	select {
+	case e.events <- evt:
+	default:
+		otlpDropped.Add(1)
+	}
+}
+
+// Start spins up a go routine that exports the queued events.
+// It returns a shutdown function that exports what is still queued
+// without retrying and blocks until it is done.
+func (e *Exporter) Start() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		batch.Run(e.events, e.batchSize, e.flushInterval, stop, func(b []*definitions.Event) {
+			e.flush(b, stop)
+		})
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (e *Exporter) flush(batch []*definitions.Event, stop chan struct{}) {
+	var heartbeats, alerts int
+	for _, evt := range batch {
+		if evt.GetHeartbeat() != nil {
+			heartbeats++
+		} else {
+			alerts++
+		}
+	}
+
+	if heartbeats > 0 {
+		req := encodeMetrics(batch)
+		e.export(heartbeats, stop, func(ctx context.Context) error {
+			return e.client.ExportMetrics(ctx, req)
+		})
+	}
+
+	if alerts > 0 {
+		req := encodeLogs(batch)
+		e.export(alerts, stop, func(ctx context.Context) error {
+			return e.client.ExportLogs(ctx, req)
+		})
+	}
+}
+
+// export calls send until it succeeds, fails permanently or runs out of
+// retries. Retries stop once the exporter is shutting down.
+func (e *Exporter) export(n int, stop chan struct{}, send func(context.Context) error) {
+	backoff := e.backoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+		err := send(ctx)
+		cancel()
+		if err == nil {
+			otlpExported.Add(int64(n))
+			return
+		}
+		otlpExportErr.Add(1)
+
+		if _, ok := err.(permanentError); ok || attempt >= e.retries {
+			log.Printf("dropping %d events, unable to export to otlp collector: %s\n", n, err)
+			otlpDropped.Add(int64(n))
+			return
+		}
+
+		select {
+		case <-stop:
+			log.Printf("dropping %d events, unable to export to otlp collector while shutting down: %s\n", n, err)
+			otlpDropped.Add(int64(n))
+			return
+		case <-time.After(backoff):
+		}
+		otlpRetries.Add(1)
+
+		backoff *= 2
+		if backoff > e.maxBackoff {
+			backoff = e.maxBackoff
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package otlp_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/internal/protoenc"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/otlp"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestExporterSendsHeartbeatsAsGaugesOverHTTP(t *testing.T) {
+	RegisterTestingT(t)
+
+	collector := newFakeHTTPCollector()
+	defer collector.Close()
+
+	exporter := otlp.New(otlp.NewHTTPClient(collector.URL, nil), otlp.WithFlushInterval(10*time.Millisecond))
+	defer exporter.Start()()
+	exporter.Write(heartbeat)
+
+	var req *collectedRequest
+	Eventually(collector.requests).Should(Receive(&req))
+	Expect(req.path).To(Equal("/v1/metrics"))
+	Expect(req.contentType).To(Equal("application/x-protobuf"))
+
+	resourceMetrics := decode(req.body).message(1, 0)
+	Expect(attributes(resourceMetrics.message(1, 0), 1)).To(Equal(map[string]string{
+		"bosh.deployment":     "loggregator",
+		"bosh.job":            "consul",
+		"bosh.instance.id":    "6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9",
+		"bosh.instance.index": "4",
+		"bosh.agent.id":       "2accd102-37e7-4dd6-b337-b3f87da97914",
+	}))
+
+	scopeMetrics := resourceMetrics.message(2, 0)
+	Expect(scopeMetrics.message(1, 0).string(1)).To(Equal("bosh-system-metrics-server"))
+
+	metric := scopeMetrics.message(2, 0)
+	Expect(metric.string(1)).To(Equal("system.cpu.user"))
+	dataPoint := metric.message(5, 0).message(1, 0)
+	Expect(math.Float64frombits(dataPoint.fixed(4))).To(Equal(2.5))
+	Expect(dataPoint.fixed(3)).To(Equal(uint64(1499293724 * time.Second)))
+	Expect(attributes(dataPoint, 7)).To(Equal(map[string]string{"cpu": "total"}))
+}
+
+func TestExporterSendsAlertsAsLogRecordsOverHTTP(t *testing.T) {
+	RegisterTestingT(t)
+
+	collector := newFakeHTTPCollector()
+	defer collector.Close()
+
+	exporter := otlp.New(otlp.NewHTTPClient(collector.URL, nil), otlp.WithFlushInterval(10*time.Millisecond))
+	defer exporter.Start()()
+	exporter.Write(alert)
+
+	var req *collectedRequest
+	Eventually(collector.requests).Should(Receive(&req))
+	Expect(req.path).To(Equal("/v1/logs"))
+
+	resourceLogs := decode(req.body).message(1, 0)
+	Expect(attributes(resourceLogs.message(1, 0), 1)).To(Equal(map[string]string{
+		"bosh.deployment": "loggregator",
+	}))
+
+	record := resourceLogs.message(2, 0).message(2, 0)
+	Expect(record.varint(2)).To(Equal(uint64(13)))
+	Expect(record.string(3)).To(Equal("WARNING"))
+	Expect(record.message(5, 0).string(1)).To(Equal("Failed password for vcap from 10.244.0.1 port 38732 ssh2"))
+	Expect(attributes(record, 6)).To(HaveKeyWithValue("bosh.alert.title", "SSH Access Denied"))
+}
+
+func TestExporterRetriesTransientFailures(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	collector := newFakeHTTPCollector(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer collector.Close()
+
+	exporter := otlp.New(
+		otlp.NewHTTPClient(collector.URL, nil),
+		otlp.WithFlushInterval(10*time.Millisecond),
+		otlp.WithRetries(3, time.Millisecond),
+	)
+	defer exporter.Start()()
+	exporter.Write(heartbeat)
+
+	Eventually(collector.requests).Should(HaveLen(3))
+	Consistently(collector.requests).Should(HaveLen(3))
+}
+
+func TestExporterDoesNotRetryPermanentFailures(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	collector := newFakeHTTPCollector(http.StatusBadRequest)
+	defer collector.Close()
+
+	exporter := otlp.New(
+		otlp.NewHTTPClient(collector.URL, nil),
+		otlp.WithFlushInterval(10*time.Millisecond),
+		otlp.WithRetries(3, time.Millisecond),
+	)
+	defer exporter.Start()()
+	exporter.Write(heartbeat)
+
+	Eventually(collector.requests).Should(HaveLen(1))
+	Consistently(collector.requests).Should(HaveLen(1))
+}
+
+func TestExporterDropsEventsThatDoNotFitInTheBuffer(t *testing.T) {
+	RegisterTestingT(t)
+
+	collector := newFakeHTTPCollector()
+	defer collector.Close()
+
+	exporter := otlp.New(otlp.NewHTTPClient(collector.URL, nil), otlp.WithBufferSize(5))
+	for i := 0; i < 10; i++ {
+		exporter.Write(heartbeat)
+	}
+	exporter.Start()()
+
+	var req *collectedRequest
+	Expect(collector.requests).To(Receive(&req))
+	Expect(decode(req.body)[1]).To(HaveLen(5))
+}
+
+func TestExporterSendsOverGRPC(t *testing.T) {
+	RegisterTestingT(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	requests := make(chan *collectedRequest, 10)
+	server := grpc.NewServer(
+		grpc.ForceServerCodec(protoenc.Codec{}),
+		grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+			method, _ := grpc.MethodFromServerStream(stream)
+			var body []byte
+			if err := stream.RecvMsg(&body); err != nil {
+				return err
+			}
+			requests <- &collectedRequest{path: method, body: body}
+
+			return stream.SendMsg([]byte{})
+		}),
+	)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	client, err := otlp.NewGRPCClient(lis.Addr().String(), nil)
+	Expect(err).ToNot(HaveOccurred())
+	exporter := otlp.New(client, otlp.WithBatchSize(2))
+	defer exporter.Start()()
+	exporter.Write(heartbeat)
+	exporter.Write(alert)
+
+	var metrics, logs *collectedRequest
+	Eventually(requests).Should(Receive(&metrics))
+	Eventually(requests).Should(Receive(&logs))
+	Expect(metrics.path).To(Equal("/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"))
+	Expect(logs.path).To(Equal("/opentelemetry.proto.collector.logs.v1.LogsService/Export"))
+	Expect(decode(metrics.body)[1]).To(HaveLen(1))
+	Expect(decode(logs.body)[1]).To(HaveLen(1))
+}
+
+type collectedRequest struct {
+	path        string
+	contentType string
+	body        []byte
+}
+
+type fakeHTTPCollector struct {
+	*httptest.Server
+	requests chan *collectedRequest
+
+	mu       sync.Mutex
+	statuses []int
+}
+
+// newFakeHTTPCollector returns a collector that responds with the
+// given statuses, in order, and then with 200 OK.
+func newFakeHTTPCollector(statuses ...int) *fakeHTTPCollector {
+	c := &fakeHTTPCollector{
+		requests: make(chan *collectedRequest, 100),
+		statuses: statuses,
+	}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		c.requests <- &collectedRequest{
+			path:        r.URL.Path,
+			contentType: r.Header.Get("Content-Type"),
+			body:        body,
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if len(c.statuses) > 0 {
+			w.WriteHeader(c.statuses[0])
+			c.statuses = c.statuses[1:]
+		}
+	}))
+
+	return c
+}
+
+// message holds the decoded fields of a protobuf message. Length
+// delimited fields are []byte and all others are uint64.
+type message map[protowire.Number][]interface{}
+
+func decode(b []byte) message {
+	m := message{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		Expect(n).To(BeNumerically(">", 0))
+		b = b[n:]
+
+		var v interface{}
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		default:
+			panic(fmt.Sprintf("unexpected wire type %d", typ))
+		}
+		Expect(n).To(BeNumerically(">", 0))
+		b = b[n:]
+
+		m[num] = append(m[num], v)
+	}
+
+	return m
+}
+
+func (m message) message(num protowire.Number, i int) message {
+	return decode(m[num][i].([]byte))
+}
+
+func (m message) string(num protowire.Number) string {
+	return string(m[num][0].([]byte))
+}
+
+func (m message) varint(num protowire.Number) uint64 {
+	return m[num][0].(uint64)
+}
+
+func (m message) fixed(num protowire.Number) uint64 {
+	return m[num][0].(uint64)
+}
+
+// attributes decodes the repeated KeyValue field num
+// with string values.
+func attributes(m message, num protowire.Number) map[string]string {
+	attrs := make(map[string]string)
+	for i := range m[num] {
+		kv := m.message(num, i)
+		attrs[kv.string(1)] = kv.message(2, 0).string(1)
+	}
+
+	return attrs
+}
+
+var heartbeat = &definitions.Event{
+	Id:         "55b68400-f984-4f76-b341-cf849e07d4f9",
+	Timestamp:  1499293724,
+	Deployment: "loggregator",
+	Message: &definitions.Event_Heartbeat{
+		Heartbeat: &definitions.Heartbeat{
+			AgentId:    "2accd102-37e7-4dd6-b337-b3f87da97914",
+			Job:        "consul",
+			Index:      4,
+			InstanceId: "6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9",
+			JobState:   "running",
+			Metrics: []*definitions.Heartbeat_Metric{
+				{Name: "system.cpu.user", Value: 2.5, Timestamp: 1499293724, Tags: map[string]string{"cpu": "total"}},
+			},
+		},
+	},
+}
+
+var alert = &definitions.Event{
+	Id:         "93eb25a4-9348-4232-6f71-69e1e01081d7",
+	Timestamp:  1499359162,
+	Deployment: "loggregator",
+	Message: &definitions.Event_Alert{
+		Alert: &definitions.Alert{
+			Severity: 4,
+			Title:    "SSH Access Denied",
+			Summary:  "Failed password for vcap from 10.244.0.1 port 38732 ssh2",
+			Source:   "loggregator: log-api(6f721317-2399-4e38-b38c-9d1b213c2d67)",
+		},
+	},
+}
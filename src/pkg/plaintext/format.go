@@ -0,0 +1,125 @@
+package plaintext
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+)
+
+// template is a metric name template split into literal text
+// and placeholders.
+type template struct {
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal     string
+	placeholder string
+}
+
+func parseTemplate(t string) *template {
+	tmpl := &template{}
+	for len(t) > 0 {
+		start := strings.Index(t, "{")
+		end := strings.Index(t, "}")
+		if start < 0 || end < start {
+			tmpl.parts = append(tmpl.parts, templatePart{literal: t})
+			break
+		}
+
+		if start > 0 {
+			tmpl.parts = append(tmpl.parts, templatePart{literal: t[:start]})
+		}
+		tmpl.parts = append(tmpl.parts, templatePart{placeholder: t[start+1 : end]})
+		t = t[end+1:]
+	}
+
+	return tmpl
+}
+
+// execute builds the metric name. Values other than the metric name
+// are sanitized so they cannot add levels to the name.
+func (t *template) execute(evt *definitions.Event, hb *definitions.Heartbeat, m *definitions.Heartbeat_Metric) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch p.placeholder {
+		case "":
+			b.WriteString(p.literal)
+		case "deployment":
+			b.WriteString(sanitize(evt.GetDeployment(), true))
+		case "job":
+			b.WriteString(sanitize(hb.GetJob(), true))
+		case "index":
+			b.WriteString(strconv.Itoa(int(hb.GetIndex())))
+		case "instance_id":
+			b.WriteString(sanitize(hb.GetInstanceId(), true))
+		case "agent_id":
+			b.WriteString(sanitize(hb.GetAgentId(), true))
+		case "metric":
+			b.WriteString(sanitize(m.GetName(), false))
+		default:
+			b.WriteString("{" + p.placeholder + "}")
+		}
+	}
+
+	return b.String()
+}
+
+// sanitize replaces characters that have a meaning in the StatsD or
+// Graphite formats. Dots are only replaced if replaceDots is true.
+func sanitize(s string, replaceDots bool) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', ':', '|', '@', '#', ';', '=', ',', '/':
+			return '_'
+		case '.':
+			if replaceDots {
+				return '_'
+			}
+		}
+		return r
+	}, s)
+}
+
+func dogStatsDTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(tags))
+	for _, k := range sortedKeys(tags) {
+		pairs = append(pairs, sanitize(k, false)+":"+sanitize(tags[k], false))
+	}
+
+	return "|#" + strings.Join(pairs, ",")
+}
+
+func graphiteTags(tags map[string]string) string {
+	var b strings.Builder
+	for _, k := range sortedKeys(tags) {
+		v := sanitize(tags[k], false)
+		if v == "" {
+			// Graphite does not accept empty tag values.
+			continue
+		}
+		b.WriteString(";" + sanitize(k, false) + "=" + v)
+	}
+
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
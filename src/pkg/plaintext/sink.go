@@ -0,0 +1,265 @@
+package plaintext
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+)
+
+var (
+	plaintextSent    *expvar.Map
+	plaintextDropped *expvar.Map
+	plaintextErrors  *expvar.Map
+)
+
+func init() {
+	plaintextSent = expvar.NewMap("plaintext.sent")
+	plaintextDropped = expvar.NewMap("plaintext.dropped")
+	plaintextErrors = expvar.NewMap("plaintext.errors")
+}
+
+// Protocol is the line format a Sink writes.
+type Protocol int
+
+const (
+	// StatsD writes gauges as `name:value|g`, with DogStatsD
+	// tags when tags are enabled.
+	StatsD Protocol = iota
+	// Graphite writes `name value timestamp`, with Graphite
+	// tags when tags are enabled.
+	Graphite
+)
+
+// DefaultTemplate names metrics after the instance that reported them.
+const DefaultTemplate = "bosh.{deployment}.{job}.{index}.{metric}"
+
+// Sink writes every heartbeat metric as a gauge over UDP or TCP.
+// Lines are batched into packets of at most the maximum packet size
+// for UDP, or written together for TCP. Metrics that do not fit in
+// the buffer, or that could not be written, are dropped.
+type Sink struct {
+	name     string
+	protocol Protocol
+	network  string
+	addr     string
+	template *template
+	tags     bool
+
+	events        chan *definitions.Event
+	bufferSize    int
+	flushInterval time.Duration
+	maxPacketSize int
+
+	conn    net.Conn
+	pending []byte
+	lines   int64
+}
+
+type SinkOpt func(*Sink)
+
+// WithTemplate sets how metric names are built. The placeholders
+// {deployment}, {job}, {index}, {instance_id}, {agent_id} and {metric}
+// are replaced with values from the heartbeat.
+func WithTemplate(t string) SinkOpt {
+	return func(s *Sink) {
+		s.template = parseTemplate(t)
+	}
+}
+
+// WithTags includes the metric tags in every line, in the tag
+// style of the protocol.
+func WithTags() SinkOpt {
+	return func(s *Sink) {
+		s.tags = true
+	}
+}
+
+// WithBufferSize sets how many events are buffered while
+// waiting to be written.
+func WithBufferSize(n int) SinkOpt {
+	return func(s *Sink) {
+		s.bufferSize = n
+	}
+}
+
+// WithFlushInterval sets how long lines wait for a batch
+// to fill before they are written.
+func WithFlushInterval(d time.Duration) SinkOpt {
+	return func(s *Sink) {
+		s.flushInterval = d
+	}
+}
+
+// WithMaxPacketSize sets the most bytes written in one UDP packet.
+func WithMaxPacketSize(n int) SinkOpt {
+	return func(s *Sink) {
+		s.maxPacketSize = n
+	}
+}
+
+// New returns a Sink that writes to addr over network, which is
+// udp or tcp. The name identifies the sink in its counters.
+func New(name string, p Protocol, network, addr string, opts ...SinkOpt) (*Sink, error) {
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("unknown network %q: must be udp or tcp", network)
+	}
+
+	s := &Sink{
+		name:          name,
+		protocol:      p,
+		network:       network,
+		addr:          addr,
+		template:      parseTemplate(DefaultTemplate),
+		bufferSize:    10000,
+		flushInterval: time.Second,
+		maxPacketSize: 1432,
+	}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	if network == "tcp" {
+		s.maxPacketSize = 64 * 1024
+	}
+	s.events = make(chan *definitions.Event, s.bufferSize)
+
+	return s, nil
+}
+
+// Write queues heartbeats to be written without blocking.
+func (s *Sink) Write(evt *definitions.Event) {
+	if evt.GetHeartbeat() == nil {
+		return
+	}
+
+	select {
+	case s.events <- evt:
+	default:
+		plaintextDropped.Add(s.name, int64(len(evt.GetHeartbeat().GetMetrics())))
+	}
+}
+
+// Start spins up a go routine that writes the queued events.
+// It returns a shutdown function that writes what is still queued
+// and blocks until it is done.
+func (s *Sink) Start() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(s.flushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case evt := <-s.events:
+				s.add(evt)
+			case <-ticker.C:
+				s.flush()
+			case <-stop:
+				for {
+					select {
+					case evt := <-s.events:
+						s.add(evt)
+					default:
+						s.flush()
+						if s.conn != nil {
+							s.conn.Close()
+						}
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// add appends a line for each metric of the heartbeat, writing the
+// pending lines first whenever the next line would not fit.
+func (s *Sink) add(evt *definitions.Event) {
+	hb := evt.GetHeartbeat()
+	for _, m := range hb.GetMetrics() {
+		line := s.format(evt, hb, m)
+		if len(s.pending) > 0 && len(s.pending)+len(line) > s.maxPacketSize {
+			s.flush()
+		}
+
+		s.pending = append(s.pending, line...)
+		s.lines++
+	}
+}
+
+func (s *Sink) format(evt *definitions.Event, hb *definitions.Heartbeat, m *definitions.Heartbeat_Metric) []byte {
+	name := s.template.execute(evt, hb, m)
+	value := formatValue(m.GetValue())
+
+	switch s.protocol {
+	case Graphite:
+		if s.tags {
+			name += graphiteTags(m.GetTags())
+		}
+		return []byte(fmt.Sprintf("%s %s %d\n", name, value, m.GetTimestamp()))
+	default:
+		var tags string
+		if s.tags {
+			tags = dogStatsDTags(m.GetTags())
+		}
+		line := fmt.Sprintf("%s:%s|g%s\n", name, value, tags)
+		// StatsD reads a signed gauge as a change to its value,
+		// so the gauge is set to zero before a negative value.
+		if m.GetValue() < 0 {
+			line = fmt.Sprintf("%s:0|g%s\n", name, tags) + line
+		}
+		return []byte(line)
+	}
+}
+
+// flush writes the pending lines. A failed write drops them and
+// closes the connection so it is dialed again on the next flush.
+func (s *Sink) flush() {
+	if len(s.pending) == 0 {
+		return
+	}
+	defer func() {
+		s.pending = s.pending[:0]
+		s.lines = 0
+	}()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.addr, 5*time.Second)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := s.conn.Write(s.pending)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.fail(err)
+		return
+	}
+
+	plaintextSent.Add(s.name, s.lines)
+}
+
+func (s *Sink) fail(err error) {
+	log.Printf("dropping %d metrics, unable to write to %s sink: %s\n", s.lines, s.name, err)
+	plaintextErrors.Add(s.name, 1)
+	plaintextDropped.Add(s.name, s.lines)
+}
@@ -0,0 +1,234 @@
+package plaintext_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/plaintext"
+	. "github.com/onsi/gomega"
+)
+
+func TestStatsDSinkWritesGaugesOverUDP(t *testing.T) {
+	RegisterTestingT(t)
+
+	packets := listenUDP()
+	sink, err := plaintext.New("statsd", plaintext.StatsD, "udp", packets.addr, plaintext.WithFlushInterval(10*time.Millisecond))
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(heartbeat)
+	sink.Write(alert)
+
+	Eventually(packets.received).Should(Receive(Equal(
+		"bosh.cf_loggregator.consul.4.system.cpu.user:2.5|g\n" +
+			"bosh.cf_loggregator.consul.4.system.mem.kb:1024|g\n",
+	)))
+}
+
+func TestStatsDSinkWritesDogStatsDTags(t *testing.T) {
+	RegisterTestingT(t)
+
+	packets := listenUDP()
+	sink, err := plaintext.New(
+		"statsd", plaintext.StatsD, "udp", packets.addr,
+		plaintext.WithFlushInterval(10*time.Millisecond),
+		plaintext.WithTemplate("{deployment}.{instance_id}.{metric}"),
+		plaintext.WithTags(),
+	)
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(heartbeat)
+
+	var packet string
+	Eventually(packets.received).Should(Receive(&packet))
+	Expect(packet).To(HavePrefix("cf_loggregator.6f60a3ce.system.cpu.user:2.5|g|#cpu:total,name:a_b\n"))
+}
+
+func TestStatsDSinkSplitsBatchesIntoPackets(t *testing.T) {
+	RegisterTestingT(t)
+
+	packets := listenUDP()
+	sink, err := plaintext.New(
+		"statsd", plaintext.StatsD, "udp", packets.addr,
+		plaintext.WithFlushInterval(time.Hour),
+		plaintext.WithMaxPacketSize(60),
+	)
+	Expect(err).ToNot(HaveOccurred())
+
+	sink.Write(heartbeat)
+	sink.Start()()
+
+	Eventually(packets.received).Should(Receive(Equal("bosh.cf_loggregator.consul.4.system.cpu.user:2.5|g\n")))
+	Eventually(packets.received).Should(Receive(Equal("bosh.cf_loggregator.consul.4.system.mem.kb:1024|g\n")))
+}
+
+func TestGraphiteSinkWritesTaggedLinesOverTCP(t *testing.T) {
+	RegisterTestingT(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	defer lis.Close()
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	sink, err := plaintext.New(
+		"graphite", plaintext.Graphite, "tcp", lis.Addr().String(),
+		plaintext.WithFlushInterval(10*time.Millisecond),
+		plaintext.WithTags(),
+	)
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(heartbeat)
+
+	Eventually(lines).Should(Receive(Equal("bosh.cf_loggregator.consul.4.system.cpu.user;cpu=total;name=a_b 2.5 1499293724")))
+	Eventually(lines).Should(Receive(Equal("bosh.cf_loggregator.consul.4.system.mem.kb 1024 1499293724")))
+}
+
+func TestSinkRecoversWhenTheTCPListenerComesBack(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	addr := lis.Addr().String()
+	lis.Close()
+
+	sink, err := plaintext.New("graphite", plaintext.Graphite, "tcp", addr, plaintext.WithFlushInterval(10*time.Millisecond))
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(heartbeat)
+	time.Sleep(50 * time.Millisecond)
+
+	lis, err = net.Listen("tcp", addr)
+	Expect(err).ToNot(HaveOccurred())
+	defer lis.Close()
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	sink.Write(heartbeat)
+	Eventually(lines).Should(Receive(HavePrefix("bosh.cf_loggregator.consul.4.system.cpu.user 2.5")))
+}
+
+func TestNewRejectsUnknownNetworks(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := plaintext.New("statsd", plaintext.StatsD, "unix", "/tmp/statsd.sock")
+	Expect(err).To(HaveOccurred())
+}
+
+func TestStatsDSinkResetsGaugesBeforeNegativeValues(t *testing.T) {
+	RegisterTestingT(t)
+
+	packets := listenUDP()
+	sink, err := plaintext.New("statsd", plaintext.StatsD, "udp", packets.addr, plaintext.WithFlushInterval(10*time.Millisecond))
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(&definitions.Event{
+		Deployment: "loggregator",
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{
+				Job:   "consul",
+				Index: 4,
+				Metrics: []*definitions.Heartbeat_Metric{
+					{Name: "system.temperature", Value: -3.5, Timestamp: 1499293724},
+				},
+			},
+		},
+	})
+
+	Eventually(packets.received).Should(Receive(Equal(
+		"bosh.loggregator.consul.4.system.temperature:0|g\n" +
+			"bosh.loggregator.consul.4.system.temperature:-3.5|g\n",
+	)))
+}
+
+type udpListener struct {
+	addr     string
+	received chan string
+}
+
+func listenUDP() *udpListener {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+
+	l := &udpListener{
+		addr:     conn.LocalAddr().String(),
+		received: make(chan string, 10),
+	}
+	go func() {
+		defer conn.Close()
+
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			l.received <- string(buf[:n])
+		}
+	}()
+
+	return l
+}
+
+var heartbeat = &definitions.Event{
+	Id:         "55b68400-f984-4f76-b341-cf849e07d4f9",
+	Timestamp:  1499293724,
+	Deployment: "cf.loggregator",
+	Message: &definitions.Event_Heartbeat{
+		Heartbeat: &definitions.Heartbeat{
+			AgentId:    "2accd102-37e7-4dd6-b337-b3f87da97914",
+			Job:        "consul",
+			Index:      4,
+			InstanceId: "6f60a3ce",
+			JobState:   "running",
+			Metrics: []*definitions.Heartbeat_Metric{
+				{Name: "system.cpu.user", Value: 2.5, Timestamp: 1499293724, Tags: map[string]string{"cpu": "total", "name": "a|b"}},
+				{Name: "system.mem.kb", Value: 1024, Timestamp: 1499293724},
+			},
+		},
+	},
+}
+
+var alert = &definitions.Event{
+	Id:         "93eb25a4-9348-4232-6f71-69e1e01081d7",
+	Timestamp:  1499359162,
+	Deployment: "loggregator",
+	Message: &definitions.Event_Alert{
+		Alert: &definitions.Alert{
+			Severity: 4,
+			Title:    "SSH Access Denied",
+		},
+	},
+}
@@ -0,0 +1,275 @@
+package prometheus
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+)
+
+const (
+	textContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+var (
+	prometheusInstances *expvar.Int
+	prometheusExpired   *expvar.Int
+	prometheusScrapes   *expvar.Int
+)
+
+func init() {
+	prometheusInstances = expvar.NewInt("prometheus.instances")
+	prometheusExpired = expvar.NewInt("prometheus.expired")
+	prometheusScrapes = expvar.NewInt("prometheus.scrapes")
+}
+
+// Exporter keeps the latest heartbeat metrics of every instance and
+// serves them in the Prometheus text or OpenMetrics exposition format.
+//
+// Samples are exposed without timestamps. When an instance stops
+// heartbeating its series are removed once the TTL has passed, so
+// Prometheus marks them stale on the next scrape.
+type Exporter struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	instances map[string]*instance
+}
+
+type instance struct {
+	labels  []label
+	metrics []*definitions.Heartbeat_Metric
+	updated time.Time
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+type ExporterOpt func(*Exporter)
+
+// WithTTL sets how long the metrics of an instance are exposed after
+// its last heartbeat.
+func WithTTL(d time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.ttl = d
+	}
+}
+
+// New returns an Exporter. Series expire 90 seconds after their
+// instance's last heartbeat unless configured otherwise.
+func New(opts ...ExporterOpt) *Exporter {
+	e := &Exporter{
+		ttl:       90 * time.Second,
+		instances: make(map[string]*instance),
+	}
+
+	for _, o := range opts {
+		o(e)
+	}
+
+	return e
+}
+
+// Write records the metrics of heartbeat events, replacing the previous
+// metrics of the instance. Other events are ignored. Expired instances
+// are only removed when scraped so Write does not block the dispatcher.
+func (e *Exporter) Write(evt *definitions.Event) {
+	hb := evt.GetHeartbeat()
+	if hb == nil {
+		return
+	}
+
+	key := hb.GetInstanceId()
+	if key == "" {
+		key = fmt.Sprintf("%s/%s/%d", evt.GetDeployment(), hb.GetJob(), hb.GetIndex())
+	}
+
+	i := &instance{
+		labels: []label{
+			{"deployment", evt.GetDeployment()},
+			{"job", hb.GetJob()},
+			{"index", strconv.Itoa(int(hb.GetIndex()))},
+			{"instance_id", hb.GetInstanceId()},
+		},
+		metrics: hb.GetMetrics(),
+		updated: time.Now(),
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.instances[key] = i
+	prometheusInstances.Set(int64(len(e.instances)))
+}
+
+// expire removes instances that have not heartbeated within the TTL.
+// It must be called with the lock held.
+func (e *Exporter) expire(now time.Time) {
+	for key, i := range e.instances {
+		if now.Sub(i.updated) > e.ttl {
+			delete(e.instances, key)
+			prometheusExpired.Add(1)
+		}
+	}
+	prometheusInstances.Set(int64(len(e.instances)))
+}
+
+// snapshot removes expired instances and returns the others. Instances
+// are replaced rather than modified by Write, so they can be read after
+// the lock is released.
+func (e *Exporter) snapshot() []*instance {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.expire(time.Now())
+
+	instances := make([]*instance, 0, len(e.instances))
+	for _, i := range e.instances {
+		instances = append(instances, i)
+	}
+
+	return instances
+}
+
+// ServeHTTP writes the current metrics. OpenMetrics is used when the
+// scraper accepts it, otherwise the Prometheus text format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prometheusScrapes.Add(1)
+
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", textContentType)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, f := range e.families() {
+		fmt.Fprintf(bw, "# TYPE %s gauge\n", f.name)
+		for _, s := range f.samples {
+			fmt.Fprintf(bw, "%s{%s} %s\n", f.name, s.labels, formatValue(s.value))
+		}
+	}
+	if openMetrics {
+		fmt.Fprint(bw, "# EOF\n")
+	}
+	bw.Flush()
+}
+
+type family struct {
+	name    string
+	samples []sample
+}
+
+type sample struct {
+	labels string
+	value  float64
+}
+
+// families groups the latest metrics by name. Families and the
+// samples within them are sorted so scrapes are stable.
+func (e *Exporter) families() []*family {
+	byName := make(map[string]*family)
+	for _, i := range e.snapshot() {
+		for _, m := range i.metrics {
+			name := sanitize(m.GetName())
+			f, ok := byName[name]
+			if !ok {
+				f = &family{name: name}
+				byName[name] = f
+			}
+
+			f.samples = append(f.samples, sample{
+				labels: formatLabels(i.labels, m.GetTags()),
+				value:  m.GetValue(),
+			})
+		}
+	}
+
+	families := make([]*family, 0, len(byName))
+	for _, f := range byName {
+		sort.Slice(f.samples, func(a, b int) bool {
+			return f.samples[a].labels < f.samples[b].labels
+		})
+		families = append(families, f)
+	}
+	sort.Slice(families, func(a, b int) bool {
+		return families[a].name < families[b].name
+	})
+
+	return families
+}
+
+// formatLabels joins the instance labels with the metric tags. Tags
+// that collide with an instance label are ignored.
+func formatLabels(labels []label, tags map[string]string) string {
+	all := append([]label(nil), labels...)
+
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		l := label{sanitize(name), tags[name]}
+		if l.name == "" || strings.HasPrefix(l.name, "__") || hasLabel(all, l.name) {
+			continue
+		}
+		all = append(all, l)
+	}
+
+	pairs := make([]string, len(all))
+	for n, l := range all {
+		pairs[n] = fmt.Sprintf("%s=\"%s\"", l.name, escape(l.value))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func hasLabel(labels []label, name string) bool {
+	for _, l := range labels {
+		if l.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sanitize converts a bosh metric or tag name, such as system.cpu.user,
+// into a valid Prometheus name.
+func sanitize(name string) string {
+	b := []byte(name)
+	for n, c := range b {
+		valid := c == '_' ||
+			(c >= 'a' && c <= 'z') ||
+			(c >= 'A' && c <= 'Z') ||
+			(n > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[n] = '_'
+		}
+	}
+
+	return string(b)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,132 @@
+package prometheus_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/prometheus"
+	. "github.com/onsi/gomega"
+)
+
+func TestExporterServesLatestHeartbeatMetrics(t *testing.T) {
+	RegisterTestingT(t)
+
+	exporter := prometheus.New()
+	exporter.Write(heartbeat("6f60a3ce", 0, 1.5))
+	exporter.Write(heartbeat("6f60a3ce", 0, 2.5))
+	exporter.Write(heartbeat("a1b2c3d4", 1, 3))
+	exporter.Write(alert)
+
+	body, contentType := scrape(exporter, "")
+
+	Expect(contentType).To(Equal("text/plain; version=0.0.4; charset=utf-8"))
+	Expect(body).To(Equal(`# TYPE system_cpu_user gauge
+system_cpu_user{deployment="loggregator",job="consul",index="0",instance_id="6f60a3ce",cpu="total",quoted="say \"hi\""} 2.5
+system_cpu_user{deployment="loggregator",job="consul",index="1",instance_id="a1b2c3d4",cpu="total",quoted="say \"hi\""} 3
+# TYPE system_load_1m gauge
+system_load_1m{deployment="loggregator",job="consul",index="0",instance_id="6f60a3ce"} 0.25
+system_load_1m{deployment="loggregator",job="consul",index="1",instance_id="a1b2c3d4"} 0.25
+`))
+}
+
+func TestExporterServesOpenMetricsWhenAccepted(t *testing.T) {
+	RegisterTestingT(t)
+
+	exporter := prometheus.New()
+	exporter.Write(heartbeat("6f60a3ce", 0, 1.5))
+
+	body, contentType := scrape(exporter, "application/openmetrics-text; version=1.0.0")
+
+	Expect(contentType).To(HavePrefix("application/openmetrics-text"))
+	Expect(body).To(HaveSuffix("# EOF\n"))
+}
+
+func TestExporterExpiresInstancesThatStopHeartbeating(t *testing.T) {
+	RegisterTestingT(t)
+
+	exporter := prometheus.New(prometheus.WithTTL(50 * time.Millisecond))
+	exporter.Write(heartbeat("6f60a3ce", 0, 1.5))
+
+	body, _ := scrape(exporter, "")
+	Expect(body).To(ContainSubstring(`instance_id="6f60a3ce"`))
+
+	time.Sleep(100 * time.Millisecond)
+	exporter.Write(heartbeat("a1b2c3d4", 1, 3))
+
+	body, _ = scrape(exporter, "")
+	Expect(body).ToNot(ContainSubstring(`instance_id="6f60a3ce"`))
+	Expect(body).To(ContainSubstring(`instance_id="a1b2c3d4"`))
+}
+
+func TestExporterIgnoresTagsThatCollideWithInstanceLabels(t *testing.T) {
+	RegisterTestingT(t)
+
+	exporter := prometheus.New()
+	exporter.Write(&definitions.Event{
+		Deployment: "loggregator",
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{
+				Job:        "consul",
+				InstanceId: "6f60a3ce",
+				Metrics: []*definitions.Heartbeat_Metric{
+					{Name: "system.healthy", Value: 1, Tags: map[string]string{"job": "other", "__name__": "x"}},
+				},
+			},
+		},
+	})
+
+	body, _ := scrape(exporter, "")
+	Expect(body).To(ContainSubstring(`system_healthy{deployment="loggregator",job="consul",index="0",instance_id="6f60a3ce"} 1`))
+}
+
+func scrape(e *prometheus.Exporter, accept string) (string, string) {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	body, err := ioutil.ReadAll(rec.Body)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(rec.Code).To(Equal(http.StatusOK))
+
+	return string(body), rec.Header().Get("Content-Type")
+}
+
+func heartbeat(instanceID string, index int32, cpu float64) *definitions.Event {
+	return &definitions.Event{
+		Id:         "55b68400-f984-4f76-b341-cf849e07d4f9",
+		Timestamp:  1499293724,
+		Deployment: "loggregator",
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{
+				AgentId:    "2accd102-37e7-4dd6-b337-b3f87da97914",
+				Job:        "consul",
+				Index:      index,
+				InstanceId: instanceID,
+				JobState:   "running",
+				Metrics: []*definitions.Heartbeat_Metric{
+					{Name: "system.cpu.user", Value: cpu, Timestamp: 1499293724, Tags: map[string]string{"cpu": "total", "quoted": `say "hi"`}},
+					{Name: "system.load.1m", Value: 0.25, Timestamp: 1499293724},
+				},
+			},
+		},
+	}
+}
+
+var alert = &definitions.Event{
+	Id:         "93eb25a4-9348-4232-6f71-69e1e01081d7",
+	Timestamp:  1499359162,
+	Deployment: "loggregator",
+	Message: &definitions.Event_Alert{
+		Alert: &definitions.Alert{
+			Severity: 4,
+			Title:    "SSH Access Denied",
+		},
+	},
+}
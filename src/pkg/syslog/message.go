@@ -0,0 +1,198 @@
+package syslog
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+)
+
+// Structured data IDs use the Cloud Foundry Foundation's
+// private enterprise number, as Loggregator does.
+const enterpriseNumber = "47450"
+
+const appName = "bosh-system-metrics-server"
+
+// Syslog severities.
+const (
+	severityAlert    = 1
+	severityCritical = 2
+	severityError    = 3
+	severityWarning  = 4
+	severityNotice   = 5
+	severityInfo     = 6
+)
+
+// message is an RFC 5424 syslog message.
+type message struct {
+	severity  int
+	timestamp time.Time
+	msgID     string
+	sd        []sdElement
+	msg       string
+}
+
+type sdElement struct {
+	id     string
+	params []sdParam
+}
+
+type sdParam struct {
+	name  string
+	value string
+}
+
+// alertMessage returns the message for an alert. Bosh severities 1 to 4
+// (alert, critical, error and warning) map to the syslog severities of
+// the same name.
+func alertMessage(evt *definitions.Event, a *definitions.Alert) message {
+	severity := severityNotice
+	switch a.GetSeverity() {
+	case 1:
+		severity = severityAlert
+	case 2:
+		severity = severityCritical
+	case 3:
+		severity = severityError
+	case 4:
+		severity = severityWarning
+	}
+
+	return message{
+		severity:  severity,
+		timestamp: time.Unix(evt.GetTimestamp(), 0),
+		msgID:     "alert",
+		sd: []sdElement{
+			{id: "instance@" + enterpriseNumber, params: []sdParam{
+				{"deployment", evt.GetDeployment()},
+			}},
+			{id: "alert@" + enterpriseNumber, params: []sdParam{
+				{"id", evt.GetId()},
+				{"severity", strconv.Itoa(int(a.GetSeverity()))},
+				{"category", a.GetCategory()},
+				{"title", a.GetTitle()},
+				{"source", a.GetSource()},
+			}},
+		},
+		msg: fmt.Sprintf("%s: %s", a.GetTitle(), a.GetSummary()),
+	}
+}
+
+// metricMessages returns a message for every metric of a heartbeat,
+// with the metric as gauge structured data.
+func metricMessages(evt *definitions.Event, hb *definitions.Heartbeat) []message {
+	instance := sdElement{id: "instance@" + enterpriseNumber, params: []sdParam{
+		{"deployment", evt.GetDeployment()},
+		{"job", hb.GetJob()},
+		{"index", strconv.Itoa(int(hb.GetIndex()))},
+		{"instance_id", hb.GetInstanceId()},
+		{"agent_id", hb.GetAgentId()},
+	}}
+
+	messages := make([]message, 0, len(hb.GetMetrics()))
+	for _, m := range hb.GetMetrics() {
+		sd := []sdElement{
+			instance,
+			{id: "gauge@" + enterpriseNumber, params: []sdParam{
+				{"name", m.GetName()},
+				{"value", strconv.FormatFloat(m.GetValue(), 'g', -1, 64)},
+			}},
+		}
+		if len(m.GetTags()) > 0 {
+			tags := sdElement{id: "tags@" + enterpriseNumber}
+			for _, k := range sortedKeys(m.GetTags()) {
+				tags.params = append(tags.params, sdParam{k, m.GetTags()[k]})
+			}
+			sd = append(sd, tags)
+		}
+
+		messages = append(messages, message{
+			severity:  severityInfo,
+			timestamp: time.Unix(m.GetTimestamp(), 0),
+			msgID:     "heartbeat",
+			sd:        sd,
+		})
+	}
+
+	return messages
+}
+
+// format returns the message as
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD [MSG]
+func (m message) format(facility int, hostname string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s - %s ",
+		facility*8+m.severity,
+		m.timestamp.UTC().Format(time.RFC3339),
+		header(hostname, 255),
+		appName,
+		header(m.msgID, 32),
+	)
+
+	for _, e := range m.sd {
+		b.WriteString("[" + e.id)
+		for _, p := range e.params {
+			b.WriteString(" " + sdName(p.name) + `="` + sdValueEscaper.Replace(p.value) + `"`)
+		}
+		b.WriteString("]")
+	}
+	if len(m.sd) == 0 {
+		b.WriteString("-")
+	}
+
+	if m.msg != "" {
+		b.WriteString(" " + m.msg)
+	}
+
+	return []byte(b.String())
+}
+
+// header makes s a valid header field: printable US-ASCII
+// without spaces, at most max characters, and - when empty.
+func header(s string, max int) string {
+	s = printable(s, nil)
+	if len(s) > max {
+		s = s[:max]
+	}
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// sdName makes s a valid SD-NAME. It may not contain =, ] or ".
+func sdName(s string) string {
+	s = printable(s, func(r rune) bool {
+		return r == '=' || r == ']' || r == '"'
+	})
+	if len(s) > 32 {
+		s = s[:32]
+	}
+
+	return s
+}
+
+func printable(s string, invalid func(rune) bool) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || (invalid != nil && invalid(r)) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+var sdValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,251 @@
+package syslog
+
+import (
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+)
+
+var (
+	syslogSent       *expvar.Int
+	syslogDropped    *expvar.Int
+	syslogWriteErr   *expvar.Int
+	syslogReconnects *expvar.Int
+)
+
+func init() {
+	syslogSent = expvar.NewInt("syslog.sent")
+	syslogDropped = expvar.NewInt("syslog.dropped")
+	syslogWriteErr = expvar.NewInt("syslog.write_err")
+	syslogReconnects = expvar.NewInt("syslog.reconnects")
+}
+
+// Sink forwards alerts, and optionally heartbeat metrics, as RFC 5424
+// syslog messages over UDP, TCP or TLS. TCP and TLS use octet-counting
+// framing (RFC 6587). While the connection is down events are buffered,
+// and events that do not fit in the buffer are dropped.
+type Sink struct {
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+	facility  int
+	hostname  string
+
+	heartbeats bool
+
+	events     chan *definitions.Event
+	bufferSize int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	conn net.Conn
+}
+
+type SinkOpt func(*Sink)
+
+// WithHeartbeats sends every heartbeat metric as a message
+// with gauge structured data.
+func WithHeartbeats() SinkOpt {
+	return func(s *Sink) {
+		s.heartbeats = true
+	}
+}
+
+// WithFacility sets the syslog facility of every message.
+// It defaults to 1, user-level messages.
+func WithFacility(f int) SinkOpt {
+	return func(s *Sink) {
+		s.facility = f
+	}
+}
+
+// WithTLSConfig configures the tls network.
+func WithTLSConfig(c *tls.Config) SinkOpt {
+	return func(s *Sink) {
+		s.tlsConfig = c
+	}
+}
+
+// WithBufferSize sets how many events are buffered while
+// waiting to be sent.
+func WithBufferSize(n int) SinkOpt {
+	return func(s *Sink) {
+		s.bufferSize = n
+	}
+}
+
+// WithReconnectBackoff sets the wait before reconnecting after a
+// failure. It doubles on each failed attempt up to max.
+func WithReconnectBackoff(backoff, max time.Duration) SinkOpt {
+	return func(s *Sink) {
+		s.backoff = backoff
+		s.maxBackoff = max
+	}
+}
+
+// New returns a Sink that sends to addr over network,
+// which is udp, tcp or tls.
+func New(network, addr string, opts ...SinkOpt) (*Sink, error) {
+	if network != "udp" && network != "tcp" && network != "tls" {
+		return nil, fmt.Errorf("unknown syslog network %q: must be udp, tcp or tls", network)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+
+	s := &Sink{
+		network:    network,
+		addr:       addr,
+		facility:   1,
+		hostname:   hostname,
+		bufferSize: 10000,
+		backoff:    100 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+	}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	if s.facility < 0 || s.facility > 23 {
+		return nil, fmt.Errorf("invalid syslog facility %d: must be between 0 and 23", s.facility)
+	}
+	s.events = make(chan *definitions.Event, s.bufferSize)
+
+	return s, nil
+}
+
+// Write queues alerts, and heartbeats if enabled, without blocking.
+func (s *Sink) Write(evt *definitions.Event) {
+	if evt.GetAlert() == nil && (!s.heartbeats || evt.GetHeartbeat() == nil) {
+		return
+	}
+
+	select {
+	case s.events <- evt:
+	default:
+		syslogDropped.Add(1)
+	}
+}
+
+// Start spins up a go routine that sends the queued events.
+// It returns a shutdown function that sends what is still queued
+// without reconnecting and blocks until it is done.
+func (s *Sink) Start() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case evt := <-s.events:
+				s.send(evt, stop)
+			case <-stop:
+				for {
+					select {
+					case evt := <-s.events:
+						s.send(evt, stop)
+					default:
+						if s.conn != nil {
+							s.conn.Close()
+						}
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (s *Sink) send(evt *definitions.Event, stop chan struct{}) {
+	var messages []message
+	if a := evt.GetAlert(); a != nil {
+		messages = append(messages, alertMessage(evt, a))
+	}
+	if hb := evt.GetHeartbeat(); hb != nil {
+		messages = metricMessages(evt, hb)
+	}
+
+	for _, m := range messages {
+		s.write(m.format(s.facility, s.hostname), stop)
+	}
+}
+
+// write sends one message, reconnecting until it succeeds or the sink
+// is shutting down. A message is written again on a new connection if
+// writing it failed.
+func (s *Sink) write(msg []byte, stop chan struct{}) {
+	if s.network != "udp" {
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+
+	backoff := s.backoff
+	for {
+		err := s.connect()
+		if err == nil {
+			s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			_, err = s.conn.Write(msg)
+			if err == nil {
+				syslogSent.Add(1)
+				return
+			}
+			s.conn.Close()
+			s.conn = nil
+		}
+
+		log.Printf("unable to write to syslog %s: %s\n", s.addr, err)
+		syslogWriteErr.Add(1)
+
+		select {
+		case <-stop:
+			syslogDropped.Add(1)
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+		syslogReconnects.Add(1)
+	}
+}
+
+func (s *Sink) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	var conn net.Conn
+	var err error
+	switch s.network {
+	case "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsConfig)
+	default:
+		conn, err = dialer.Dial(s.network, s.addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+
+	return nil
+}
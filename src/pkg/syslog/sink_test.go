@@ -0,0 +1,281 @@
+package syslog_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/syslog"
+	. "github.com/onsi/gomega"
+)
+
+func TestSinkSendsAlertsOverUDP(t *testing.T) {
+	RegisterTestingT(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+
+	sink, err := syslog.New("udp", conn.LocalAddr().String(), syslog.WithFacility(16))
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(heartbeat)
+	sink.Write(alert)
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	Expect(err).ToNot(HaveOccurred())
+
+	hostname, _ := os.Hostname()
+	Expect(string(buf[:n])).To(Equal(
+		"<132>1 2017-07-06T16:39:22Z " + hostname + " bosh-system-metrics-server - alert " +
+			`[instance@47450 deployment="loggregator"]` +
+			`[alert@47450 id="93eb25a4" severity="4" category="" title="SSH Access Denied" source="log-api [id=1\]"]` +
+			" SSH Access Denied: Failed password for vcap",
+	))
+}
+
+func TestSinkAcceptsTheKernFacility(t *testing.T) {
+	RegisterTestingT(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+
+	sink, err := syslog.New("udp", conn.LocalAddr().String(), syslog.WithFacility(0))
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(alert)
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(string(buf[:n])).To(HavePrefix("<4>1 "))
+}
+
+func TestSinkSendsHeartbeatMetricsWhenEnabled(t *testing.T) {
+	RegisterTestingT(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+
+	sink, err := syslog.New("udp", conn.LocalAddr().String(), syslog.WithHeartbeats())
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(heartbeat)
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	Expect(err).ToNot(HaveOccurred())
+
+	msg := string(buf[:n])
+	Expect(msg).To(HavePrefix("<14>1 2017-07-05T22:28:44Z "))
+	Expect(msg).To(ContainSubstring(" bosh-system-metrics-server - heartbeat "))
+	Expect(msg).To(HaveSuffix(
+		`[instance@47450 deployment="loggregator" job="consul" index="4" instance_id="6f60a3ce" agent_id="2accd102"]` +
+			`[gauge@47450 name="system.cpu.user" value="2.5"]` +
+			`[tags@47450 cpu="total"]`,
+	))
+}
+
+func TestSinkUsesOctetCountingOverTCP(t *testing.T) {
+	RegisterTestingT(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	defer lis.Close()
+	messages := acceptFramed(lis)
+
+	sink, err := syslog.New("tcp", lis.Addr().String())
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(alert)
+	sink.Write(alert)
+
+	Eventually(messages).Should(Receive(HavePrefix("<12>1 ")))
+	Eventually(messages).Should(Receive(HaveSuffix("SSH Access Denied: Failed password for vcap")))
+}
+
+func TestSinkSendsOverTLS(t *testing.T) {
+	RegisterTestingT(t)
+
+	cert, pool := newServerCertificate()
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	Expect(err).ToNot(HaveOccurred())
+	defer lis.Close()
+	messages := acceptFramed(lis)
+
+	sink, err := syslog.New("tls", lis.Addr().String(), syslog.WithTLSConfig(&tls.Config{
+		RootCAs:    pool,
+		ServerName: "syslog",
+	}))
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(alert)
+
+	Eventually(messages).Should(Receive(HaveSuffix("SSH Access Denied: Failed password for vcap")))
+}
+
+func TestSinkReconnectsAfterTheConnectionIsLost(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	defer lis.Close()
+
+	sink, err := syslog.New("tcp", lis.Addr().String(), syslog.WithReconnectBackoff(time.Millisecond, 10*time.Millisecond))
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(alert)
+	conn, err := lis.Accept()
+	Expect(err).ToNot(HaveOccurred())
+	_, err = readFrame(bufio.NewReader(conn))
+	Expect(err).ToNot(HaveOccurred())
+	conn.Close()
+
+	messages := acceptFramed(lis)
+	Eventually(func() <-chan string {
+		sink.Write(alert)
+		return messages
+	}, "2s").Should(Receive())
+}
+
+func TestNewRejectsInvalidConfiguration(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := syslog.New("unix", "/dev/log")
+	Expect(err).To(HaveOccurred())
+
+	_, err = syslog.New("udp", "127.0.0.1:514", syslog.WithFacility(24))
+	Expect(err).To(HaveOccurred())
+}
+
+// acceptFramed accepts connections and returns the
+// octet-counted messages read from them.
+func acceptFramed(lis net.Listener) chan string {
+	messages := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				for {
+					msg, err := readFrame(r)
+					if err != nil {
+						return
+					}
+					messages <- msg
+				}
+			}()
+		}
+	}()
+
+	return messages
+}
+
+func readFrame(r *bufio.Reader) (string, error) {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", fmt.Errorf("invalid frame length %q", length)
+	}
+
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+
+	return string(msg), err
+}
+
+func newServerCertificate() (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "syslog"},
+		DNSNames:              []string{"syslog"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+var heartbeat = &definitions.Event{
+	Id:         "55b68400",
+	Timestamp:  1499293724,
+	Deployment: "loggregator",
+	Message: &definitions.Event_Heartbeat{
+		Heartbeat: &definitions.Heartbeat{
+			AgentId:    "2accd102",
+			Job:        "consul",
+			Index:      4,
+			InstanceId: "6f60a3ce",
+			JobState:   "running",
+			Metrics: []*definitions.Heartbeat_Metric{
+				{Name: "system.cpu.user", Value: 2.5, Timestamp: 1499293724, Tags: map[string]string{"cpu": "total"}},
+			},
+		},
+	},
+}
+
+var alert = &definitions.Event{
+	Id:         "93eb25a4",
+	Timestamp:  1499359162,
+	Deployment: "loggregator",
+	Message: &definitions.Event_Alert{
+		Alert: &definitions.Alert{
+			Severity: 4,
+			Title:    "SSH Access Denied",
+			Summary:  "Failed password for vcap",
+			Source:   "log-api [id=1]",
+		},
+	},
+}
@@ -0,0 +1,80 @@
+package tokenchecker
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+var breakerOpened *expvar.Int
+
+func init() {
+	breakerOpened = expvar.NewInt("tokenchecker.check_token_breaker_opened")
+}
+
+var errBreakerOpen = errors.New("circuit breaker is open after repeated failures")
+
+// breaker is a circuit breaker for the requests to UAA. It opens
+// after threshold failures in a row and stays open for the cooldown.
+// Then it lets a single probe through, which closes it again if it
+// succeeds.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow returns whether a request may be made. Every allowed
+// request must be followed by success, failure or release.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+
+	if b.now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+
+	return true
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.threshold > 0 && b.failures >= b.threshold {
+		if b.failures == b.threshold || b.now().After(b.openUntil) {
+			breakerOpened.Add(1)
+		}
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// release gives up a request that neither
+// succeeded nor failed, such as a cancelled one.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
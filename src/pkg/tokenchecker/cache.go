@@ -0,0 +1,257 @@
+package tokenchecker
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	cacheHits      *expvar.Int
+	cacheMisses    *expvar.Int
+	cacheEvictions *expvar.Int
+)
+
+func init() {
+	cacheHits = expvar.NewInt("tokenchecker.cache_hits")
+	cacheMisses = expvar.NewInt("tokenchecker.cache_misses")
+	cacheEvictions = expvar.NewInt("tokenchecker.cache_evictions")
+}
+
+type checker interface {
+	CheckToken(token string) error
+}
+
+type contextChecker interface {
+	CheckTokenContext(ctx context.Context, token string) error
+}
+
+type claimsChecker interface {
+	CheckTokenClaims(ctx context.Context, token string) (*Claims, error)
+}
+
+// Cache remembers the results of another checker so that clients
+// reconnecting with the same token do not each cost a call to UAA.
+// Valid tokens are remembered until they expire and rejected tokens
+// for a short while. Concurrent checks of a token that is not cached
+// share a single call. Tokens are only kept as hashes.
+type Cache struct {
+	checker     checker
+	maxEntries  int
+	negativeTTL time.Duration
+	maxTTL      time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	entries  map[[sha256.Size]byte]*list.Element
+	lru      *list.List
+	inflight map[[sha256.Size]byte]*call
+}
+
+type entry struct {
+	key     [sha256.Size]byte
+	claims  *Claims
+	err     error
+	expires time.Time
+}
+
+// call is a check of a token that is in progress.
+type call struct {
+	done   chan struct{}
+	claims *Claims
+	err    error
+}
+
+type CacheOpt func(*Cache)
+
+// WithMaxEntries sets how many results are cached. The least
+// recently used result is evicted to make room for a new one.
+func WithMaxEntries(n int) CacheOpt {
+	return func(c *Cache) {
+		c.maxEntries = n
+	}
+}
+
+// WithNegativeTTL sets how long a rejected token is remembered.
+func WithNegativeTTL(d time.Duration) CacheOpt {
+	return func(c *Cache) {
+		c.negativeTTL = d
+	}
+}
+
+// WithMaxTTL limits how long a valid token is remembered,
+// so that revoked tokens are noticed before they expire.
+func WithMaxTTL(d time.Duration) CacheOpt {
+	return func(c *Cache) {
+		c.maxTTL = d
+	}
+}
+
+// WithClock sets the function used to tell the time.
+func WithClock(now func() time.Time) CacheOpt {
+	return func(c *Cache) {
+		c.now = now
+	}
+}
+
+// NewCache returns a Cache in front of c.
+func NewCache(c checker, opts ...CacheOpt) *Cache {
+	cache := &Cache{
+		checker:     c,
+		maxEntries:  10000,
+		negativeTTL: 10 * time.Second,
+		now:         time.Now,
+		entries:     make(map[[sha256.Size]byte]*list.Element),
+		lru:         list.New(),
+		inflight:    make(map[[sha256.Size]byte]*call),
+	}
+
+	for _, o := range opts {
+		o(cache)
+	}
+
+	return cache
+}
+
+// CheckToken returns the cached result for the token
+// or checks it with the underlying checker.
+func (c *Cache) CheckToken(token string) error {
+	return c.CheckTokenContext(context.Background(), token)
+}
+
+// CheckTokenContext is CheckToken that stops waiting for the
+// underlying checker when ctx is done. The check itself carries on
+// for the other callers waiting on it and is cached.
+func (c *Cache) CheckTokenContext(ctx context.Context, token string) error {
+	_, err := c.CheckTokenClaims(ctx, token)
+	return err
+}
+
+// CheckTokenClaims is CheckTokenContext that also returns the claims
+// of a valid token, if the underlying checker returns them.
+func (c *Cache) CheckTokenClaims(ctx context.Context, token string) (*Claims, error) {
+	return c.lookup(ctx, token, true)
+}
+
+// RevalidateTokenClaims is CheckTokenClaims that ignores the cached
+// result, so that a token that has been revoked since it was cached
+// is not accepted again. The result is cached for later checks.
+func (c *Cache) RevalidateTokenClaims(ctx context.Context, token string) (*Claims, error) {
+	return c.lookup(ctx, token, false)
+}
+
+func (c *Cache) lookup(ctx context.Context, token string, cached bool) (*Claims, error) {
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry)
+		if cached && c.now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			cacheHits.Add(1)
+			return e.claims, e.err
+		}
+		c.remove(el)
+	}
+	cacheMisses.Add(1)
+
+	cl, ok := c.inflight[key]
+	if !ok {
+		cl = &call{done: make(chan struct{})}
+		c.inflight[key] = cl
+		go c.check(key, token, cl)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-cl.done:
+		return cl.claims, cl.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// check runs a call with the underlying checker. It is not bound to
+// the context of any one caller, so it relies on the checker's own
+// timeouts.
+func (c *Cache) check(key [sha256.Size]byte, token string, cl *call) {
+	switch cc := c.checker.(type) {
+	case claimsChecker:
+		cl.claims, cl.err = cc.CheckTokenClaims(context.Background(), token)
+	case contextChecker:
+		cl.err = cc.CheckTokenContext(context.Background(), token)
+	default:
+		cl.err = c.checker.CheckToken(token)
+	}
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.store(key, token, cl.claims, cl.err)
+	c.mu.Unlock()
+	close(cl.done)
+}
+
+func (c *Cache) store(key [sha256.Size]byte, token string, claims *Claims, err error) {
+	// A token that could not be checked is not known to be invalid.
+	var unavailable *UnavailableError
+	if errors.As(err, &unavailable) {
+		return
+	}
+
+	expires := c.now().Add(c.negativeTTL)
+	if err == nil {
+		exp, ok := expiry(token)
+		if claims != nil && claims.Exp != 0 {
+			exp, ok = time.Unix(claims.Exp, 0), true
+		}
+		if !ok {
+			return
+		}
+		expires = exp
+		if c.maxTTL > 0 && expires.After(c.now().Add(c.maxTTL)) {
+			expires = c.now().Add(c.maxTTL)
+		}
+	}
+	if !c.now().Before(expires) || c.maxEntries <= 0 {
+		return
+	}
+
+	for c.lru.Len() >= c.maxEntries {
+		c.remove(c.lru.Back())
+		cacheEvictions.Add(1)
+	}
+	c.entries[key] = c.lru.PushFront(&entry{key: key, claims: claims, err: err, expires: expires})
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*entry).key)
+}
+
+// expiry reads the exp claim of a JWT without verifying it. The
+// signature is verified by the underlying checker.
+func expiry(token string) (time.Time, bool) {
+	token = strings.TrimPrefix(token, "bearer ")
+	token = strings.TrimPrefix(token, "Bearer ")
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	err := decodeSegment(parts[1], &claims)
+	if err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(claims.Exp, 0), true
+}
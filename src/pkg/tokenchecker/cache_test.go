@@ -0,0 +1,237 @@
+package tokenchecker_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/tokenchecker"
+	. "github.com/onsi/gomega"
+)
+
+func TestCacheRemembersValidTokensUntilTheyExpire(t *testing.T) {
+	RegisterTestingT(t)
+
+	clock := newFakeClock()
+	spy := &spyChecker{}
+	cache := tokenchecker.NewCache(spy, tokenchecker.WithClock(clock.Now))
+	token := jwt(clock.Now().Add(time.Minute))
+
+	Expect(cache.CheckToken(token)).To(Succeed())
+	Expect(cache.CheckToken(token)).To(Succeed())
+	Expect(spy.count()).To(Equal(1))
+
+	clock.Add(time.Minute)
+	Expect(cache.CheckToken(token)).To(Succeed())
+	Expect(spy.count()).To(Equal(2))
+}
+
+func TestCacheRemembersValidTokensForTheMaxTTL(t *testing.T) {
+	RegisterTestingT(t)
+
+	clock := newFakeClock()
+	spy := &spyChecker{}
+	cache := tokenchecker.NewCache(spy, tokenchecker.WithClock(clock.Now), tokenchecker.WithMaxTTL(time.Second))
+	token := jwt(clock.Now().Add(time.Hour))
+
+	Expect(cache.CheckToken(token)).To(Succeed())
+	Expect(cache.CheckToken(token)).To(Succeed())
+	Expect(spy.count()).To(Equal(1))
+
+	clock.Add(time.Second)
+	Expect(cache.CheckToken(token)).To(Succeed())
+	Expect(spy.count()).To(Equal(2))
+}
+
+func TestCacheRevalidationIgnoresTheCachedResult(t *testing.T) {
+	RegisterTestingT(t)
+
+	spy := &spyChecker{}
+	cache := tokenchecker.NewCache(spy)
+	token := jwt(time.Now().Add(time.Hour))
+
+	Expect(cache.CheckToken(token)).To(Succeed())
+
+	spy.err = errors.New("token revoked")
+	_, err := cache.RevalidateTokenClaims(context.Background(), token)
+	Expect(err).To(MatchError("token revoked"))
+	Expect(cache.CheckToken(token)).To(MatchError("token revoked"))
+	Expect(spy.count()).To(Equal(2))
+}
+
+func TestCacheDoesNotRememberValidTokensWithoutExpiry(t *testing.T) {
+	RegisterTestingT(t)
+
+	spy := &spyChecker{}
+	cache := tokenchecker.NewCache(spy)
+
+	Expect(cache.CheckToken("opaque-token")).To(Succeed())
+	Expect(cache.CheckToken("opaque-token")).To(Succeed())
+	Expect(spy.count()).To(Equal(2))
+}
+
+func TestCacheRemembersRejectedTokensForTheNegativeTTL(t *testing.T) {
+	RegisterTestingT(t)
+
+	clock := newFakeClock()
+	spy := &spyChecker{err: errors.New("invalid token")}
+	cache := tokenchecker.NewCache(
+		spy,
+		tokenchecker.WithClock(clock.Now),
+		tokenchecker.WithNegativeTTL(5*time.Second),
+	)
+
+	Expect(cache.CheckToken("bad-token")).To(MatchError("invalid token"))
+	Expect(cache.CheckToken("bad-token")).To(MatchError("invalid token"))
+	Expect(spy.count()).To(Equal(1))
+
+	clock.Add(5 * time.Second)
+	Expect(cache.CheckToken("bad-token")).To(HaveOccurred())
+	Expect(spy.count()).To(Equal(2))
+}
+
+func TestCacheEvictsTheLeastRecentlyUsedToken(t *testing.T) {
+	RegisterTestingT(t)
+
+	clock := newFakeClock()
+	spy := &spyChecker{}
+	cache := tokenchecker.NewCache(spy, tokenchecker.WithClock(clock.Now), tokenchecker.WithMaxEntries(2))
+	a := jwt(clock.Now().Add(time.Hour))
+	b := jwt(clock.Now().Add(2 * time.Hour))
+	c := jwt(clock.Now().Add(3 * time.Hour))
+
+	cache.CheckToken(a)
+	cache.CheckToken(b)
+	cache.CheckToken(a)
+	cache.CheckToken(c)
+	Expect(spy.count()).To(Equal(3))
+
+	cache.CheckToken(a)
+	Expect(spy.count()).To(Equal(3))
+	cache.CheckToken(b)
+	Expect(spy.count()).To(Equal(4))
+}
+
+func TestCacheMergesConcurrentChecksOfATokenIntoOne(t *testing.T) {
+	RegisterTestingT(t)
+
+	spy := &spyChecker{block: make(chan struct{})}
+	cache := tokenchecker.NewCache(spy)
+	token := jwt(time.Now().Add(time.Hour))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Expect(cache.CheckToken(token)).To(Succeed())
+		}()
+	}
+	Eventually(spy.count).Should(Equal(1))
+	close(spy.block)
+	wg.Wait()
+
+	Expect(spy.count()).To(Equal(1))
+}
+
+func TestCacheRemembersTheClaimsOfOpaqueTokens(t *testing.T) {
+	RegisterTestingT(t)
+
+	clock := newFakeClock()
+	claims := &tokenchecker.Claims{ClientID: "metrics-forwarder", Exp: clock.Now().Add(time.Minute).Unix()}
+	spy := &spyChecker{claims: claims}
+	cache := tokenchecker.NewCache(spy, tokenchecker.WithClock(clock.Now))
+
+	Expect(cache.CheckTokenClaims(context.Background(), "opaque-token")).To(Equal(claims))
+	Expect(cache.CheckTokenClaims(context.Background(), "opaque-token")).To(Equal(claims))
+	Expect(spy.count()).To(Equal(1))
+
+	clock.Add(time.Minute)
+	Expect(cache.CheckToken("opaque-token")).To(Succeed())
+	Expect(spy.count()).To(Equal(2))
+}
+
+func TestCacheDoesNotRememberTokensThatCouldNotBeChecked(t *testing.T) {
+	RegisterTestingT(t)
+
+	spy := &spyChecker{err: &tokenchecker.UnavailableError{Err: errors.New("connection refused")}}
+	cache := tokenchecker.NewCache(spy)
+
+	Expect(cache.CheckToken("opaque-token")).ToNot(Succeed())
+	Expect(cache.CheckToken("opaque-token")).ToNot(Succeed())
+	Expect(spy.count()).To(Equal(2))
+}
+
+func TestCacheStopsWaitingWhenTheContextIsDone(t *testing.T) {
+	RegisterTestingT(t)
+
+	spy := &spyChecker{block: make(chan struct{})}
+	defer close(spy.block)
+	cache := tokenchecker.NewCache(spy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	Expect(cache.CheckTokenContext(ctx, jwt(time.Now().Add(time.Hour)))).To(Equal(context.Canceled))
+}
+
+type spyChecker struct {
+	calls  int64
+	claims *tokenchecker.Claims
+	err    error
+	block  chan struct{}
+}
+
+func (s *spyChecker) CheckToken(token string) error {
+	_, err := s.CheckTokenClaims(context.Background(), token)
+	return err
+}
+
+func (s *spyChecker) CheckTokenClaims(ctx context.Context, token string) (*tokenchecker.Claims, error) {
+	atomic.AddInt64(&s.calls, 1)
+	if s.block != nil {
+		<-s.block
+	}
+
+	return s.claims, s.err
+}
+
+func (s *spyChecker) count() int {
+	return int(atomic.LoadInt64(&s.calls))
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1499293724, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// jwt returns an unsigned token with the exp claim.
+func jwt(exp time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+
+	return fmt.Sprintf("bearer %s.%s.", header, payload)
+}
@@ -0,0 +1,228 @@
+package tokenchecker
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ClientAuthMethod is how the introspection client
+// authenticates to the introspection endpoint.
+type ClientAuthMethod string
+
+const (
+	// ClientSecretBasic sends the client credentials with
+	// HTTP basic authentication.
+	ClientSecretBasic ClientAuthMethod = "client_secret_basic"
+	// ClientSecretPost sends the client credentials
+	// in the form body.
+	ClientSecretPost ClientAuthMethod = "client_secret_post"
+	// BearerToken sends a fixed bearer token.
+	BearerToken ClientAuthMethod = "bearer"
+	// NoClientAuth sends no credentials.
+	NoClientAuth ClientAuthMethod = "none"
+)
+
+type IntrospectionConfig struct {
+	// URL is the RFC 7662 introspection endpoint.
+	URL       string
+	TLSConfig *tls.Config
+
+	ClientAuth   ClientAuthMethod
+	ClientID     string
+	ClientSecret string
+	// ClientToken is sent with the BearerToken client auth method.
+	ClientToken string
+
+	Authority string
+	// AuthorityClaim is the claim that must contain the Authority.
+	// It defaults to scope. The claim can be a space separated
+	// string or a list of strings.
+	AuthorityClaim string
+}
+
+// IntrospectionChecker checks tokens with an OAuth 2.0 token
+// introspection endpoint (RFC 7662).
+type IntrospectionChecker struct {
+	cfg        *IntrospectionConfig
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// NewIntrospectionChecker returns an IntrospectionChecker that has
+// been configured with the IntrospectionConfig.
+func NewIntrospectionChecker(cfg *IntrospectionConfig) (*IntrospectionChecker, error) {
+	switch cfg.ClientAuth {
+	case "":
+		cfg.ClientAuth = ClientSecretBasic
+	case ClientSecretBasic, ClientSecretPost, BearerToken, NoClientAuth:
+	default:
+		return nil, fmt.Errorf("unknown client auth method %q: must be client_secret_basic, client_secret_post, bearer or none", cfg.ClientAuth)
+	}
+	if cfg.AuthorityClaim == "" {
+		cfg.AuthorityClaim = "scope"
+	}
+
+	return &IntrospectionChecker{
+		cfg: cfg,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: cfg.TLSConfig,
+			},
+			Timeout: 30 * time.Second,
+		},
+		now: time.Now,
+	}, nil
+}
+
+// introspection is the response of the introspection endpoint. Only
+// active is required, other claims are present for active tokens.
+type introspection struct {
+	Active   bool      `json:"active"`
+	Scope    spaceList `json:"scope"`
+	Exp      int64     `json:"exp"`
+	ClientID string    `json:"client_id"`
+	Zone     string    `json:"zid"`
+
+	// claims holds every claim, so that the
+	// authority claim can be configured.
+	claims map[string]json.RawMessage
+}
+
+// CheckToken verifies that the token is active, not expired and that
+// its authority claim contains the IntrospectionConfig.Authority.
+func (c *IntrospectionChecker) CheckToken(token string) error {
+	_, err := c.CheckTokenClaims(context.Background(), token)
+	return err
+}
+
+// CheckTokenClaims is CheckToken that returns the claims of a valid
+// token and gives up when ctx is done.
+func (c *IntrospectionChecker) CheckTokenClaims(ctx context.Context, token string) (*Claims, error) {
+	in, err := c.introspect(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if !in.Active {
+		return nil, errors.New("token is not active")
+	}
+
+	if in.Exp != 0 && !c.now().Before(time.Unix(in.Exp, 0)) {
+		return nil, errors.New("token is expired")
+	}
+
+	if !slices.Contains(in.authorities(c.cfg.AuthorityClaim), c.cfg.Authority) {
+		return nil, fmt.Errorf("token %s does not include the %s authority", c.cfg.AuthorityClaim, c.cfg.Authority)
+	}
+
+	return &Claims{
+		ClientID:    in.ClientID,
+		Scopes:      in.Scope,
+		Authorities: in.authorities("authorities"),
+		Exp:         in.Exp,
+		Zone:        in.Zone,
+	}, nil
+}
+
+func (c *IntrospectionChecker) introspect(ctx context.Context, token string) (*introspection, error) {
+	token = strings.TrimPrefix(token, "bearer ")
+	token = strings.TrimPrefix(token, "Bearer ")
+
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+	if c.cfg.ClientAuth == ClientSecretPost {
+		form.Set("client_id", c.cfg.ClientID)
+		form.Set("client_secret", c.cfg.ClientSecret)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.cfg.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	switch c.cfg.ClientAuth {
+	case ClientSecretBasic:
+		req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+	case BearerToken:
+		req.Header.Set("Authorization", "Bearer "+c.cfg.ClientToken)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &UnavailableError{Err: err}
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+		return nil, &UnavailableError{Err: fmt.Errorf("Received bad introspection status: %d", res.StatusCode)}
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("Received bad introspection status: %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, &UnavailableError{Err: err}
+	}
+
+	in := &introspection{}
+	err = json.Unmarshal(body, in)
+	if err == nil {
+		err = json.Unmarshal(body, &in.claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode introspection response: %s", err)
+	}
+
+	return in, nil
+}
+
+// authorities returns the values of the claim. Claims that are not
+// a space separated string or a list of strings have no values.
+func (in *introspection) authorities(claim string) []string {
+	var l spaceList
+	if json.Unmarshal(in.claims[claim], &l) != nil {
+		return nil
+	}
+
+	return l
+}
+
+// spaceList is a claim that is either a space separated
+// string, like scope, or a list of strings.
+type spaceList []string
+
+func (l *spaceList) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*l = strings.Fields(s)
+		return nil
+	}
+
+	var list []string
+	err := json.Unmarshal(b, &list)
+	*l = list
+
+	return err
+}
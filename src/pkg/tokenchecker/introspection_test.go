@@ -0,0 +1,239 @@
+package tokenchecker_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/tokenchecker"
+	. "github.com/onsi/gomega"
+)
+
+func TestIntrospectionCheckerAcceptsActiveTokensWithTheAuthority(t *testing.T) {
+	RegisterTestingT(t)
+
+	idp := newFakeIntrospectionEndpoint(map[string]interface{}{
+		"active":    true,
+		"scope":     "openid bosh.system_metrics.read",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"client_id": "metrics-forwarder",
+	})
+	defer idp.Close()
+
+	checker, err := tokenchecker.NewIntrospectionChecker(&tokenchecker.IntrospectionConfig{
+		URL:          idp.URL + "/introspect",
+		ClientID:     "system-metrics-server",
+		ClientSecret: "secret",
+		Authority:    "bosh.system_metrics.read",
+	})
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(checker.CheckToken("bearer opaque-token")).To(Succeed())
+
+	r := idp.lastRequest()
+	Expect(r.Method).To(Equal(http.MethodPost))
+	Expect(r.URL.Path).To(Equal("/introspect"))
+	Expect(r.Form.Get("token")).To(Equal("opaque-token"))
+	Expect(r.Form.Get("token_type_hint")).To(Equal("access_token"))
+	user, password, ok := r.BasicAuth()
+	Expect(ok).To(BeTrue())
+	Expect(user).To(Equal("system-metrics-server"))
+	Expect(password).To(Equal("secret"))
+}
+
+func TestIntrospectionCheckerRejectsTokens(t *testing.T) {
+	RegisterTestingT(t)
+
+	for name, response := range map[string]map[string]interface{}{
+		"inactive": {"active": false},
+		"expired": {
+			"active": true,
+			"scope":  "bosh.system_metrics.read",
+			"exp":    time.Now().Add(-time.Minute).Unix(),
+		},
+		"without authority": {
+			"active": true,
+			"scope":  "openid",
+		},
+	} {
+		idp := newFakeIntrospectionEndpoint(response)
+
+		checker, err := tokenchecker.NewIntrospectionChecker(&tokenchecker.IntrospectionConfig{
+			URL:       idp.URL,
+			Authority: "bosh.system_metrics.read",
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(checker.CheckToken("opaque-token")).ToNot(Succeed(), name)
+		idp.Close()
+	}
+}
+
+func TestIntrospectionCheckerReturnsTheClaimsOfTheToken(t *testing.T) {
+	RegisterTestingT(t)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	idp := newFakeIntrospectionEndpoint(map[string]interface{}{
+		"active":      true,
+		"scope":       "openid bosh.system_metrics.read",
+		"authorities": []string{"uaa.resource"},
+		"exp":         exp,
+		"client_id":   "metrics-forwarder",
+		"zid":         "uaa",
+	})
+	defer idp.Close()
+
+	checker, err := tokenchecker.NewIntrospectionChecker(&tokenchecker.IntrospectionConfig{
+		URL:       idp.URL,
+		Authority: "bosh.system_metrics.read",
+	})
+	Expect(err).ToNot(HaveOccurred())
+
+	claims, err := checker.CheckTokenClaims(context.Background(), "opaque-token")
+	Expect(err).ToNot(HaveOccurred())
+	Expect(claims).To(Equal(&tokenchecker.Claims{
+		ClientID:    "metrics-forwarder",
+		Scopes:      []string{"openid", "bosh.system_metrics.read"},
+		Authorities: []string{"uaa.resource"},
+		Exp:         exp,
+		Zone:        "uaa",
+	}))
+}
+
+func TestIntrospectionCheckerChecksTheConfiguredAuthorityClaim(t *testing.T) {
+	RegisterTestingT(t)
+
+	idp := newFakeIntrospectionEndpoint(map[string]interface{}{
+		"active": true,
+		"scope":  "openid",
+		"groups": []string{"operators", "bosh.system_metrics.read"},
+	})
+	defer idp.Close()
+
+	checker, err := tokenchecker.NewIntrospectionChecker(&tokenchecker.IntrospectionConfig{
+		URL:            idp.URL,
+		Authority:      "bosh.system_metrics.read",
+		AuthorityClaim: "groups",
+	})
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(checker.CheckToken("opaque-token")).To(Succeed())
+}
+
+func TestIntrospectionCheckerClientAuthMethods(t *testing.T) {
+	RegisterTestingT(t)
+
+	idp := newFakeIntrospectionEndpoint(map[string]interface{}{"active": true, "scope": "bosh.system_metrics.read"})
+	defer idp.Close()
+
+	checker, err := tokenchecker.NewIntrospectionChecker(&tokenchecker.IntrospectionConfig{
+		URL:          idp.URL,
+		ClientAuth:   tokenchecker.ClientSecretPost,
+		ClientID:     "system-metrics-server",
+		ClientSecret: "secret",
+		Authority:    "bosh.system_metrics.read",
+	})
+	Expect(err).ToNot(HaveOccurred())
+	Expect(checker.CheckToken("opaque-token")).To(Succeed())
+	Expect(idp.lastRequest().Form.Get("client_id")).To(Equal("system-metrics-server"))
+	Expect(idp.lastRequest().Form.Get("client_secret")).To(Equal("secret"))
+	Expect(idp.lastRequest().Header.Get("Authorization")).To(BeEmpty())
+
+	checker, err = tokenchecker.NewIntrospectionChecker(&tokenchecker.IntrospectionConfig{
+		URL:         idp.URL,
+		ClientAuth:  tokenchecker.BearerToken,
+		ClientToken: "introspection-token",
+		Authority:   "bosh.system_metrics.read",
+	})
+	Expect(err).ToNot(HaveOccurred())
+	Expect(checker.CheckToken("opaque-token")).To(Succeed())
+	Expect(idp.lastRequest().Header.Get("Authorization")).To(Equal("Bearer introspection-token"))
+
+	_, err = tokenchecker.NewIntrospectionChecker(&tokenchecker.IntrospectionConfig{
+		URL:        idp.URL,
+		ClientAuth: "private_key_jwt",
+	})
+	Expect(err).To(HaveOccurred())
+}
+
+func TestIntrospectionCheckerFailsOnBadResponses(t *testing.T) {
+	RegisterTestingT(t)
+
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer idp.Close()
+
+	checker, err := tokenchecker.NewIntrospectionChecker(&tokenchecker.IntrospectionConfig{URL: idp.URL})
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(checker.CheckToken("opaque-token")).ToNot(Succeed())
+}
+
+func TestIntrospectionCheckerIsUnavailableWhenTheEndpointFails(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, code := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}))
+
+		checker, err := tokenchecker.NewIntrospectionChecker(&tokenchecker.IntrospectionConfig{URL: idp.URL})
+		Expect(err).ToNot(HaveOccurred())
+
+		var unavailable *tokenchecker.UnavailableError
+		Expect(errors.As(checker.CheckToken("opaque-token"), &unavailable)).To(BeTrue())
+		idp.Close()
+	}
+}
+
+func TestIntrospectionCheckerIsUnavailableWhenTheEndpointCannotBeReached(t *testing.T) {
+	RegisterTestingT(t)
+
+	idp := httptest.NewServer(http.NotFoundHandler())
+	idp.Close()
+
+	checker, err := tokenchecker.NewIntrospectionChecker(&tokenchecker.IntrospectionConfig{URL: idp.URL})
+	Expect(err).ToNot(HaveOccurred())
+
+	var unavailable *tokenchecker.UnavailableError
+	Expect(errors.As(checker.CheckToken("opaque-token"), &unavailable)).To(BeTrue())
+}
+
+type fakeIntrospectionEndpoint struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	response map[string]interface{}
+	last     *http.Request
+}
+
+func newFakeIntrospectionEndpoint(response map[string]interface{}) *fakeIntrospectionEndpoint {
+	e := &fakeIntrospectionEndpoint{response: response}
+	e.Server = httptest.NewServer(e)
+
+	return e
+}
+
+func (e *fakeIntrospectionEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	r.ParseForm()
+	e.last = r
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e.response)
+}
+
+func (e *fakeIntrospectionEndpoint) lastRequest() *http.Request {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.last
+}
@@ -0,0 +1,456 @@
+package tokenchecker
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	jwtKeyRefreshes  *expvar.Int
+	jwtKeyRefreshErr *expvar.Int
+)
+
+func init() {
+	jwtKeyRefreshes = expvar.NewInt("tokenchecker.key_refreshes")
+	jwtKeyRefreshErr = expvar.NewInt("tokenchecker.key_refresh_err")
+}
+
+var (
+	errMalformedToken = errors.New("token is not a well formed JWT")
+	errUnknownKey     = errors.New("token is signed with an unknown key")
+	errBadSignature   = errors.New("token signature is invalid")
+	errNoKeys         = errors.New("token_keys has no usable keys")
+)
+
+type JWTCheckerConfig struct {
+	UaaURL    string
+	TLSConfig *tls.Config
+	// Issuer is the expected iss claim.
+	// It defaults to UaaURL/oauth/token.
+	Issuer string
+	// Audience must be one of the aud claims when set.
+	Audience  string
+	Authority string
+	// TeamScopes also accepts tokens with the read scope of a BOSH
+	// team, bosh.teams.<team>.read, in place of the Authority.
+	TeamScopes bool
+}
+
+// JWTChecker verifies tokens locally against the signing keys
+// published by UAA at /token_keys, so that checking a token does
+// not depend on UAA being reachable.
+type JWTChecker struct {
+	cfg        *JWTCheckerConfig
+	issuer     string
+	httpClient *http.Client
+	now        func() time.Time
+
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+
+	mu   sync.RWMutex
+	keys map[string]*rsa.PublicKey
+
+	refreshMu   sync.Mutex
+	lastRefresh time.Time
+}
+
+type JWTCheckerOpt func(*JWTChecker)
+
+// WithRefreshInterval sets how often the signing keys are fetched.
+func WithRefreshInterval(d time.Duration) JWTCheckerOpt {
+	return func(c *JWTChecker) {
+		c.refreshInterval = d
+	}
+}
+
+// WithMinRefreshInterval limits how often a token signed with an
+// unknown key causes the signing keys to be fetched.
+func WithMinRefreshInterval(d time.Duration) JWTCheckerOpt {
+	return func(c *JWTChecker) {
+		c.minRefreshInterval = d
+	}
+}
+
+// WithJWTClock sets the function used to tell the time.
+func WithJWTClock(now func() time.Time) JWTCheckerOpt {
+	return func(c *JWTChecker) {
+		c.now = now
+	}
+}
+
+// NewJWTChecker returns a JWTChecker that has been
+// configured with the JWTCheckerConfig.
+func NewJWTChecker(cfg *JWTCheckerConfig, opts ...JWTCheckerOpt) *JWTChecker {
+	c := &JWTChecker{
+		cfg:    cfg,
+		issuer: cfg.Issuer,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: cfg.TLSConfig,
+			},
+			Timeout: 30 * time.Second,
+		},
+		now:                time.Now,
+		refreshInterval:    5 * time.Minute,
+		minRefreshInterval: 10 * time.Second,
+		keys:               make(map[string]*rsa.PublicKey),
+	}
+	if c.issuer == "" {
+		c.issuer = strings.TrimSuffix(cfg.UaaURL, "/") + "/oauth/token"
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c
+}
+
+// Start fetches the signing keys and spins up a go routine that
+// refreshes them periodically. It returns a function that stops it.
+func (c *JWTChecker) Start() func() {
+	c.refresh(true)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(c.refreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.refresh(true)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// CheckToken verifies the signature, issuer, audience and expiry of
+// the token and that its scope contains the JWTCheckerConfig.Authority,
+// or a team scope, like the check_token endpoint does.
+func (c *JWTChecker) CheckToken(token string) error {
+	_, err := c.CheckTokenClaims(context.Background(), token)
+	return err
+}
+
+// CheckTokenClaims is CheckToken that returns the claims of a
+// valid token. Tokens are checked locally so ctx is not used.
+func (c *JWTChecker) CheckTokenClaims(ctx context.Context, token string) (*Claims, error) {
+	token = strings.TrimPrefix(token, "bearer ")
+	token = strings.TrimPrefix(token, "Bearer ")
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, errMalformedToken
+	}
+
+	hash, ok := signingHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("token is signed with unsupported algorithm %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+
+	key, err := c.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature)
+	if err != nil {
+		return nil, errBadSignature
+	}
+
+	var claims jwtClaims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, errMalformedToken
+	}
+
+	err = c.checkClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &claims.Claims, nil
+}
+
+type jwtClaims struct {
+	Claims
+	Iss string   `json:"iss"`
+	Aud audience `json:"aud"`
+}
+
+func (c *JWTChecker) checkClaims(claims jwtClaims) error {
+	if claims.Iss != c.issuer {
+		return fmt.Errorf("token issuer %q is not %q", claims.Iss, c.issuer)
+	}
+
+	if c.cfg.Audience != "" && !slices.Contains(claims.Aud, c.cfg.Audience) {
+		return fmt.Errorf("token audience does not include %q", c.cfg.Audience)
+	}
+
+	if claims.Exp == 0 || !c.now().Before(time.Unix(claims.Exp, 0)) {
+		return errors.New("token is expired")
+	}
+
+	if !hasAuthority(claims.Scopes, c.cfg.Authority, c.cfg.TeamScopes) {
+		return fmt.Errorf("token does not include the %s authority", c.cfg.Authority)
+	}
+
+	return nil
+}
+
+// key returns the signing key with the id, fetching the keys again
+// if it is unknown. Tokens without a key id use the only key.
+func (c *JWTChecker) key(kid string) (*rsa.PublicKey, error) {
+	key, ok := c.lookup(kid)
+	if ok {
+		return key, nil
+	}
+
+	c.refresh(false)
+
+	key, ok = c.lookup(kid)
+	if !ok {
+		return nil, errUnknownKey
+	}
+
+	return key, nil
+}
+
+func (c *JWTChecker) lookup(kid string) (*rsa.PublicKey, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+
+	return key, ok
+}
+
+// refresh fetches the signing keys. Unless forced, it does nothing if
+// they were fetched within the minimum refresh interval or are being
+// fetched already, so checks do not queue behind each other's fetch.
+// The known keys are kept when the fetch fails.
+func (c *JWTChecker) refresh(force bool) {
+	if force {
+		c.refreshMu.Lock()
+	} else if !c.refreshMu.TryLock() {
+		return
+	}
+	defer c.refreshMu.Unlock()
+
+	if !force && c.now().Sub(c.lastRefresh) < c.minRefreshInterval {
+		return
+	}
+	c.lastRefresh = c.now()
+
+	keys, err := c.fetchKeys()
+	if err != nil {
+		log.Printf("unable to fetch token keys from uaa: %s\n", err)
+		jwtKeyRefreshErr.Add(1)
+		return
+	}
+	jwtKeyRefreshes.Add(1)
+
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+}
+
+func (c *JWTChecker) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	res, err := c.httpClient.Get(fmt.Sprintf("%s/token_keys", c.cfg.UaaURL))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Received bad token_keys status from uaa: %d", res.StatusCode)
+	}
+
+	var body struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(body.Keys))
+	for _, k := range body.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("skipping token key %q: %s\n", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errNoKeys
+	}
+
+	return keys, nil
+}
+
+// jsonWebKey is a key as returned by UAA. RSA keys have the modulus
+// and exponent and also the key in PEM format as the value.
+type jsonWebKey struct {
+	Kty   string `json:"kty"`
+	Kid   string `json:"kid"`
+	N     string `json:"n"`
+	E     string `json:"e"`
+	Value string `json:"value"`
+}
+
+func (k jsonWebKey) publicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+
+	if k.N != "" && k.E != "" {
+		n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.N, "="))
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.E, "="))
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	}
+
+	block, _ := pem.Decode([]byte(k.Value))
+	if block == nil {
+		return nil, errors.New("key has no modulus and no PEM value")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("key value is not an RSA public key")
+	}
+
+	return key, nil
+}
+
+var signingHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// audience is the aud claim, which is either a string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+
+	var l []string
+	err := json.Unmarshal(b, &l)
+	*a = l
+
+	return err
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// hasAuthority returns whether the scopes include the authority or,
+// when teamScopes is set, the read scope of a BOSH team.
+func hasAuthority(scopes []string, authority string, teamScopes bool) bool {
+	if slices.Contains(scopes, authority) {
+		return true
+	}
+
+	if teamScopes {
+		for _, s := range scopes {
+			if _, ok := TeamFromScope(s); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// TeamFromScope returns the team of a bosh.teams.<team>.read scope.
+func TeamFromScope(scope string) (string, bool) {
+	if !strings.HasPrefix(scope, "bosh.teams.") || !strings.HasSuffix(scope, ".read") {
+		return "", false
+	}
+
+	team := strings.TrimSuffix(strings.TrimPrefix(scope, "bosh.teams."), ".read")
+	if team == "" {
+		return "", false
+	}
+
+	return team, true
+}
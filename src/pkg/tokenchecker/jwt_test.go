@@ -0,0 +1,344 @@
+package tokenchecker_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/tokenchecker"
+	. "github.com/onsi/gomega"
+)
+
+func TestJWTCheckerAcceptsValidTokens(t *testing.T) {
+	RegisterTestingT(t)
+
+	uaa := newFakeUAA(newSigningKey("key-1"))
+	defer uaa.Close()
+
+	checker := newJWTChecker(uaa)
+	defer checker.Start()()
+
+	Expect(checker.CheckToken(uaa.token("key-1", uaa.claims()))).To(Succeed())
+}
+
+func TestJWTCheckerAcceptsKeysInPEMFormat(t *testing.T) {
+	RegisterTestingT(t)
+
+	key := newSigningKey("key-1")
+	key.pemOnly = true
+	uaa := newFakeUAA(key)
+	defer uaa.Close()
+
+	checker := newJWTChecker(uaa)
+	defer checker.Start()()
+
+	Expect(checker.CheckToken(uaa.token("key-1", uaa.claims()))).To(Succeed())
+}
+
+func TestJWTCheckerRejectsInvalidClaims(t *testing.T) {
+	RegisterTestingT(t)
+
+	uaa := newFakeUAA(newSigningKey("key-1"))
+	defer uaa.Close()
+
+	checker := newJWTChecker(uaa)
+	defer checker.Start()()
+
+	for name, change := range map[string]func(map[string]interface{}){
+		"issuer":    func(c map[string]interface{}) { c["iss"] = "https://other-uaa/oauth/token" },
+		"audience":  func(c map[string]interface{}) { c["aud"] = []string{"cloud_controller"} },
+		"expiry":    func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"authority": func(c map[string]interface{}) { c["scope"] = []string{"bosh.read"} },
+	} {
+		claims := uaa.claims()
+		change(claims)
+
+		err := checker.CheckToken(uaa.token("key-1", claims))
+		Expect(err).To(HaveOccurred(), name)
+	}
+}
+
+func TestJWTCheckerAcceptsTeamScopesWhenEnabled(t *testing.T) {
+	RegisterTestingT(t)
+
+	uaa := newFakeUAA(newSigningKey("key-1"))
+	defer uaa.Close()
+
+	claims := uaa.claims()
+	claims["scope"] = []string{"openid", "bosh.teams.diego.read"}
+	token := uaa.token("key-1", claims)
+
+	checker := newJWTChecker(uaa)
+	defer checker.Start()()
+	Expect(checker.CheckToken(token)).ToNot(Succeed())
+
+	checker = tokenchecker.NewJWTChecker(&tokenchecker.JWTCheckerConfig{
+		UaaURL:     uaa.URL,
+		Authority:  "bosh.system_metrics.read",
+		TeamScopes: true,
+	})
+	defer checker.Start()()
+	Expect(checker.CheckToken(token)).To(Succeed())
+
+	claims["scope"] = []string{"bosh.teams.diego.admin", "bosh.teams..read"}
+	Expect(checker.CheckToken(uaa.token("key-1", claims))).ToNot(Succeed())
+}
+
+func TestJWTCheckerRejectsInvalidSignatures(t *testing.T) {
+	RegisterTestingT(t)
+
+	uaa := newFakeUAA(newSigningKey("key-1"))
+	defer uaa.Close()
+
+	checker := newJWTChecker(uaa)
+	defer checker.Start()()
+
+	other := newSigningKey("key-1")
+	token := other.sign(uaa.claims())
+	Expect(checker.CheckToken(token)).To(MatchError("token signature is invalid"))
+
+	Expect(checker.CheckToken("not-a-jwt")).To(HaveOccurred())
+}
+
+func TestJWTCheckerFetchesKeysWhenTheKeyIDIsUnknown(t *testing.T) {
+	RegisterTestingT(t)
+
+	uaa := newFakeUAA(newSigningKey("key-1"))
+	defer uaa.Close()
+
+	checker := newJWTChecker(uaa, tokenchecker.WithMinRefreshInterval(0))
+	defer checker.Start()()
+	Expect(uaa.fetches()).To(Equal(1))
+
+	uaa.setKeys(newSigningKey("key-1"), newSigningKey("key-2"))
+
+	Expect(checker.CheckToken(uaa.token("key-2", uaa.claims()))).To(Succeed())
+	Expect(uaa.fetches()).To(Equal(2))
+}
+
+func TestJWTCheckerLimitsFetchesForUnknownKeyIDs(t *testing.T) {
+	RegisterTestingT(t)
+
+	uaa := newFakeUAA(newSigningKey("key-1"))
+	defer uaa.Close()
+
+	checker := newJWTChecker(uaa, tokenchecker.WithMinRefreshInterval(time.Hour))
+	defer checker.Start()()
+
+	unknown := newSigningKey("key-3")
+	for i := 0; i < 5; i++ {
+		Expect(checker.CheckToken(unknown.sign(uaa.claims()))).To(MatchError("token is signed with an unknown key"))
+	}
+	Expect(uaa.fetches()).To(Equal(1))
+}
+
+func TestJWTCheckerKeepsTheKeysWhenTheFetchIsEmpty(t *testing.T) {
+	RegisterTestingT(t)
+
+	uaa := newFakeUAA(newSigningKey("key-1"))
+	defer uaa.Close()
+	token := uaa.token("key-1", uaa.claims())
+
+	checker := newJWTChecker(uaa, tokenchecker.WithRefreshInterval(10*time.Millisecond))
+	defer checker.Start()()
+
+	uaa.setKeys()
+	fetches := uaa.fetches()
+	Eventually(uaa.fetches).Should(BeNumerically(">", fetches+1))
+
+	Expect(checker.CheckToken(token)).To(Succeed())
+}
+
+func TestJWTCheckerDoesNotWaitForFetchesInProgress(t *testing.T) {
+	RegisterTestingT(t)
+
+	uaa := newFakeUAA(newSigningKey("key-1"))
+	defer uaa.Close()
+
+	checker := newJWTChecker(uaa, tokenchecker.WithMinRefreshInterval(0))
+	defer checker.Start()()
+
+	uaa.setDelay(time.Second)
+	go checker.CheckToken(newSigningKey("key-2").sign(uaa.claims()))
+	Eventually(uaa.fetches).Should(Equal(2))
+
+	start := time.Now()
+	err := checker.CheckToken(newSigningKey("key-3").sign(uaa.claims()))
+	Expect(err).To(MatchError("token is signed with an unknown key"))
+	Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+}
+
+func TestJWTCheckerRefreshesKeysPeriodically(t *testing.T) {
+	RegisterTestingT(t)
+
+	uaa := newFakeUAA(newSigningKey("key-1"))
+	defer uaa.Close()
+
+	checker := newJWTChecker(uaa, tokenchecker.WithRefreshInterval(10*time.Millisecond))
+	defer checker.Start()()
+
+	Eventually(uaa.fetches).Should(BeNumerically(">=", 3))
+}
+
+func newJWTChecker(uaa *fakeUAA, opts ...tokenchecker.JWTCheckerOpt) *tokenchecker.JWTChecker {
+	return tokenchecker.NewJWTChecker(&tokenchecker.JWTCheckerConfig{
+		UaaURL:    uaa.URL,
+		Audience:  "bosh.system_metrics",
+		Authority: "bosh.system_metrics.read",
+	}, opts...)
+}
+
+type signingKey struct {
+	kid     string
+	key     *rsa.PrivateKey
+	pemOnly bool
+}
+
+func newSigningKey(kid string) *signingKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).ToNot(HaveOccurred())
+
+	return &signingKey{kid: kid, key: key}
+}
+
+func (k *signingKey) sign(claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": k.kid, "typ": "JWT"})
+	Expect(err).ToNot(HaveOccurred())
+	payload, err := json.Marshal(claims)
+	Expect(err).ToNot(HaveOccurred())
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, digest[:])
+	Expect(err).ToNot(HaveOccurred())
+
+	return "bearer " + signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (k *signingKey) jwk() map[string]string {
+	der, err := x509.MarshalPKIXPublicKey(&k.key.PublicKey)
+	Expect(err).ToNot(HaveOccurred())
+
+	jwk := map[string]string{
+		"kty":   "RSA",
+		"kid":   k.kid,
+		"alg":   "RS256",
+		"use":   "sig",
+		"value": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}
+	if !k.pemOnly {
+		jwk["n"] = base64.RawURLEncoding.EncodeToString(k.key.N.Bytes())
+		jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.E)).Bytes())
+	}
+
+	return jwk
+}
+
+// fakeUAA serves /token_keys.
+type fakeUAA struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    []*signingKey
+	fetched int
+	delay   time.Duration
+}
+
+func newFakeUAA(keys ...*signingKey) *fakeUAA {
+	uaa := &fakeUAA{keys: keys}
+	uaa.Server = httptest.NewServer(uaa)
+
+	return uaa
+}
+
+func (u *fakeUAA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/token_keys" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	u.mu.Lock()
+	u.fetched++
+	delay := u.delay
+	var keys []map[string]string
+	for _, k := range u.keys {
+		keys = append(keys, k.jwk())
+	}
+	u.mu.Unlock()
+
+	time.Sleep(delay)
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (u *fakeUAA) setKeys(keys ...*signingKey) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.keys = keys
+}
+
+// setDelay makes /token_keys respond after d.
+func (u *fakeUAA) setDelay(d time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.delay = d
+}
+
+func (u *fakeUAA) fetches() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.fetched
+}
+
+func (u *fakeUAA) token(kid string, claims map[string]interface{}) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var key *signingKey
+	for _, k := range u.keys {
+		if k.kid == kid {
+			key = k
+		}
+	}
+	Expect(key).ToNot(BeNil(), "no key "+kid)
+
+	return key.sign(claims)
+}
+
+func (u *fakeUAA) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":         strings.TrimSuffix(u.URL, "/") + "/oauth/token",
+		"aud":         []string{"system-metrics-forwarder", "bosh.system_metrics"},
+		"exp":         time.Now().Add(time.Hour).Unix(),
+		"client_id":   "system-metrics-forwarder",
+		"scope":       []string{"bosh.system_metrics.read"},
+		"authorities": []string{"bosh.system_metrics.read"},
+	}
+}
+
+func TestTeamFromScope(t *testing.T) {
+	RegisterTestingT(t)
+
+	team, ok := tokenchecker.TeamFromScope("bosh.teams.ops.read")
+	Expect(ok).To(BeTrue())
+	Expect(team).To(Equal("ops"))
+
+	for _, scope := range []string{"bosh.teams..read", "bosh.teams.ops.admin", "bosh.system_metrics.read"} {
+		_, ok := tokenchecker.TeamFromScope(scope)
+		Expect(ok).To(BeFalse(), scope)
+	}
+}
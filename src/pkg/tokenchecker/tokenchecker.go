@@ -1,68 +1,256 @@
 package tokenchecker
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"expvar"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 )
 
+var (
+	checkTokenValid          *expvar.Int
+	checkTokenRejected       *expvar.Int
+	checkTokenFailed         *expvar.Int
+	checkTokenCanceled       *expvar.Int
+	checkTokenShortCircuited *expvar.Int
+	checkTokenFailovers      *expvar.Int
+)
+
+func init() {
+	checkTokenValid = expvar.NewInt("tokenchecker.check_token_valid")
+	checkTokenRejected = expvar.NewInt("tokenchecker.check_token_rejected")
+	checkTokenFailed = expvar.NewInt("tokenchecker.check_token_failed")
+	checkTokenCanceled = expvar.NewInt("tokenchecker.check_token_canceled")
+	checkTokenShortCircuited = expvar.NewInt("tokenchecker.check_token_short_circuited")
+	checkTokenFailovers = expvar.NewInt("tokenchecker.check_token_failovers")
+}
+
+// UnavailableError is returned when a token could not be checked
+// because UAA or the introspection endpoint could not be reached,
+// rather than because the token is invalid. Clients should try
+// again later.
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("token issuer is unavailable: %s", e.Err)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// Unavailable reports that the error is temporary.
+func (e *UnavailableError) Unavailable() bool {
+	return true
+}
+
+// Claims are the claims of a valid token.
+type Claims struct {
+	ClientID    string   `json:"client_id"`
+	Scopes      []string `json:"scope"`
+	Authorities []string `json:"authorities"`
+	Exp         int64    `json:"exp"`
+	Zone        string   `json:"zid"`
+}
+
 type TokenChecker struct {
 	cfg        *TokenCheckerConfig
 	httpClient *http.Client
+	timeout    time.Duration
+	breaker    *breaker
 }
 
 type TokenCheckerConfig struct {
-	UaaURL      string
-	TLSConfig   *tls.Config
-	UaaClient   string
-	UaaPassword string
-	Authority   string
+	UaaURL string
+	// FailoverURLs are tried in order when UaaURL
+	// cannot be reached or fails.
+	FailoverURLs []string
+	TLSConfig    *tls.Config
+	UaaClient    string
+	UaaPassword  string
+	Authority    string
+	// TeamScopes also accepts tokens with the read scope of a BOSH
+	// team, bosh.teams.<team>.read, in place of the Authority.
+	TeamScopes bool
+}
+
+type TokenCheckerOpt func(*TokenChecker)
+
+// WithTimeout limits how long each request to a UAA URL may take.
+func WithTimeout(d time.Duration) TokenCheckerOpt {
+	return func(t *TokenChecker) {
+		t.timeout = d
+	}
+}
+
+// WithCircuitBreaker fails checks fast, without a request, once
+// threshold checks in a row could not reach any UAA URL. After the
+// cooldown a single check is let through to probe UAA.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) TokenCheckerOpt {
+	return func(t *TokenChecker) {
+		t.breaker.threshold = threshold
+		t.breaker.cooldown = cooldown
+	}
 }
 
 // New returns a TokenChecker that has been
 // configured with the TokenCheckerConfig.
-func New(cfg *TokenCheckerConfig) *TokenChecker {
-	return &TokenChecker{
+func New(cfg *TokenCheckerConfig, opts ...TokenCheckerOpt) *TokenChecker {
+	t := &TokenChecker{
 		cfg: cfg,
 		httpClient: &http.Client{
 			Transport: &http.Transport{
 				TLSClientConfig: cfg.TLSConfig,
 			},
-			Timeout: 30 * time.Second,
 		},
+		timeout: 10 * time.Second,
+		breaker: &breaker{
+			threshold: 5,
+			cooldown:  30 * time.Second,
+			now:       time.Now,
+		},
+	}
+
+	for _, o := range opts {
+		o(t)
 	}
+
+	return t
 }
 
 // CheckToken verifies that the token contains
 // the appropriate TokenCheckerConfig.Authority.
 func (t *TokenChecker) CheckToken(token string) error {
+	_, err := t.CheckTokenClaims(context.Background(), token)
+	return err
+}
+
+// CheckTokenContext is CheckToken that gives up when ctx is done.
+func (t *TokenChecker) CheckTokenContext(ctx context.Context, token string) error {
+	_, err := t.CheckTokenClaims(ctx, token)
+	return err
+}
+
+// CheckTokenClaims checks the token with UAA and returns the claims
+// UAA reports for it. It gives up when ctx is done, and returns an
+// UnavailableError if no UAA URL could check the token or the circuit
+// breaker is open.
+func (t *TokenChecker) CheckTokenClaims(ctx context.Context, token string) (*Claims, error) {
+	if !t.breaker.allow() {
+		checkTokenShortCircuited.Add(1)
+		return nil, &UnavailableError{Err: errBreakerOpen}
+	}
+
+	var err error
+	for i, u := range append([]string{t.cfg.UaaURL}, t.cfg.FailoverURLs...) {
+		if i > 0 {
+			checkTokenFailovers.Add(1)
+		}
+
+		var (
+			claims *Claims
+			retry  bool
+		)
+		claims, retry, err = t.check(ctx, u, token)
+		if ctx.Err() != nil {
+			t.breaker.release()
+			checkTokenCanceled.Add(1)
+			return nil, ctx.Err()
+		}
+		if !retry {
+			t.breaker.success()
+			if err != nil {
+				checkTokenRejected.Add(1)
+				return nil, err
+			}
+			checkTokenValid.Add(1)
+			return claims, nil
+		}
+	}
+
+	t.breaker.failure()
+	checkTokenFailed.Add(1)
+
+	return nil, &UnavailableError{Err: err}
+}
+
+// check asks the UAA at uaaURL to check the token. It returns true
+// if the UAA failed and the next URL should be tried.
+func (t *TokenChecker) check(ctx context.Context, uaaURL, token string) (*Claims, bool, error) {
 	form := url.Values{}
 	form.Set("token", token)
-	form.Set("scopes", t.cfg.Authority)
+	// UAA requires every scope it is given, so team scopes
+	// are checked against the scopes it returns instead.
+	if !t.cfg.TeamScopes {
+		form.Set("scopes", t.cfg.Authority)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
 
 	req, err := http.NewRequest(
 		http.MethodPost,
-		fmt.Sprintf("%s/check_token", t.cfg.UaaURL),
+		fmt.Sprintf("%s/check_token", uaaURL),
 		strings.NewReader(form.Encode()),
 	)
 	if err != nil {
-		return err
+		return nil, true, err
 	}
+	req = req.WithContext(ctx)
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.SetBasicAuth(t.cfg.UaaClient, t.cfg.UaaPassword)
 
 	res, err := t.httpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, true, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+		return nil, true, statusError(res)
 	}
 
 	if res.StatusCode < 200 || res.StatusCode > 299 {
-		return fmt.Errorf("Received bad check_token status from uaa: %d %s", res.StatusCode, res.Body)
+		return nil, false, statusError(res)
+	}
+
+	var claims Claims
+	err = json.NewDecoder(res.Body).Decode(&claims)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to decode check_token response: %s", err)
+	}
+
+	if !hasAuthority(claims.Scopes, t.cfg.Authority, t.cfg.TeamScopes) {
+		return nil, false, fmt.Errorf("token does not include the %s authority", t.cfg.Authority)
+	}
+
+	return &claims, false, nil
+}
+
+// statusError describes a check_token response that is not a
+// success, including the error UAA gives in the body.
+func statusError(res *http.Response) error {
+	var body struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	err := json.NewDecoder(io.LimitReader(res.Body, 4096)).Decode(&body)
+	if err != nil || body.Error == "" {
+		return fmt.Errorf("Received bad check_token status from uaa: %d", res.StatusCode)
 	}
 
-	return nil
+	return fmt.Errorf("Received bad check_token status from uaa: %d %s: %s", res.StatusCode, body.Error, body.Description)
 }
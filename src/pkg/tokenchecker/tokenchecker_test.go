@@ -12,6 +12,10 @@ import (
 	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/tokenchecker"
 	"encoding/base64"
 	"fmt"
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
 )
 
 func TestCheckToken(t *testing.T) {
@@ -96,12 +100,14 @@ type spyAuthServer struct {
 	mu          sync.Mutex
 	lastRequest *http.Request
 	status      int
+	body        string
 
 }
 
 func newSpyAuthServer(status int) *spyAuthServer {
 	return &spyAuthServer{
 		status: status,
+		body:   `{"client_id":"system-metrics-forwarder","scope":["bosh.system_metrics.read"],"zid":"uaa"}`,
 	}
 }
 
@@ -113,4 +119,165 @@ func (a *spyAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	a.lastRequest = r
 
 	w.WriteHeader(a.status)
+	w.Write([]byte(a.body))
+}
+
+func TestCheckTokenFailsOverToTheNextUAA(t *testing.T) {
+	RegisterTestingT(t)
+
+	down := httptest.NewServer(newSpyAuthServer(503))
+	defer down.Close()
+	sas := newSpyAuthServer(200)
+	up := httptest.NewServer(sas)
+	defer up.Close()
+
+	client := tokenchecker.New(&tokenchecker.TokenCheckerConfig{
+		UaaURL:       "http://localhost:343343",
+		FailoverURLs: []string{down.URL, up.URL},
+		Authority:    "bosh.system_metrics.read",
+	})
+
+	Expect(client.CheckToken("fake-token")).To(Succeed())
+	Expect(sas.lastRequest).ToNot(BeNil())
+}
+
+func TestCheckTokenDoesNotFailOverWhenTheTokenIsRejected(t *testing.T) {
+	RegisterTestingT(t)
+
+	rejecting := httptest.NewServer(newSpyAuthServer(400))
+	defer rejecting.Close()
+	sas := newSpyAuthServer(200)
+	up := httptest.NewServer(sas)
+	defer up.Close()
+
+	client := tokenchecker.New(&tokenchecker.TokenCheckerConfig{
+		UaaURL:       rejecting.URL,
+		FailoverURLs: []string{up.URL},
+		Authority:    "bosh.system_metrics.read",
+	})
+
+	err := client.CheckToken("fake-token")
+	Expect(err).To(HaveOccurred())
+	var unavailable *tokenchecker.UnavailableError
+	Expect(errors.As(err, &unavailable)).To(BeFalse())
+	Expect(sas.lastRequest).To(BeNil())
+}
+
+func TestCheckTokenOpensTheCircuitBreakerWhenUAAIsDown(t *testing.T) {
+	RegisterTestingT(t)
+
+	var requests int64
+	sas := newSpyAuthServer(503)
+	uaa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		sas.ServeHTTP(w, r)
+	}))
+	defer uaa.Close()
+
+	client := tokenchecker.New(&tokenchecker.TokenCheckerConfig{
+		UaaURL:    uaa.URL,
+		Authority: "bosh.system_metrics.read",
+	}, tokenchecker.WithCircuitBreaker(2, 100*time.Millisecond))
+
+	for i := 0; i < 4; i++ {
+		err := client.CheckToken("fake-token")
+		var unavailable *tokenchecker.UnavailableError
+		Expect(errors.As(err, &unavailable)).To(BeTrue())
+	}
+	Expect(atomic.LoadInt64(&requests)).To(Equal(int64(2)))
+
+	sas.mu.Lock()
+	sas.status = 200
+	sas.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+
+	Expect(client.CheckToken("fake-token")).To(Succeed())
+	Expect(client.CheckToken("fake-token")).To(Succeed())
+	Expect(atomic.LoadInt64(&requests)).To(Equal(int64(4)))
+}
+
+func TestCheckTokenGivesUpWhenTheContextIsDone(t *testing.T) {
+	RegisterTestingT(t)
+
+	hung := make(chan struct{})
+	uaa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer uaa.Close()
+	defer close(hung)
+
+	client := tokenchecker.New(&tokenchecker.TokenCheckerConfig{
+		UaaURL:    uaa.URL,
+		Authority: "bosh.system_metrics.read",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := client.CheckTokenContext(ctx, "fake-token")
+	Expect(err).To(Equal(context.DeadlineExceeded))
+	Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+}
+
+func TestCheckTokenClaimsReturnsTheClaimsOfValidTokens(t *testing.T) {
+	RegisterTestingT(t)
+
+	sas := newSpyAuthServer(200)
+	sas.body = `{
+		"client_id": "system-metrics-forwarder",
+		"scope": ["bosh.system_metrics.read"],
+		"authorities": ["bosh.system_metrics.read", "uaa.resource"],
+		"exp": 1499293724,
+		"zid": "uaa"
+	}`
+	uaa := httptest.NewServer(sas)
+	defer uaa.Close()
+
+	client := tokenchecker.New(&tokenchecker.TokenCheckerConfig{
+		UaaURL:    uaa.URL,
+		Authority: "bosh.system_metrics.read",
+	})
+
+	claims, err := client.CheckTokenClaims(context.Background(), "fake-token")
+	Expect(err).ToNot(HaveOccurred())
+	Expect(claims).To(Equal(&tokenchecker.Claims{
+		ClientID:    "system-metrics-forwarder",
+		Scopes:      []string{"bosh.system_metrics.read"},
+		Authorities: []string{"bosh.system_metrics.read", "uaa.resource"},
+		Exp:         1499293724,
+		Zone:        "uaa",
+	}))
+}
+
+func TestCheckTokenVerifiesTheAuthority(t *testing.T) {
+	RegisterTestingT(t)
+
+	sas := newSpyAuthServer(200)
+	sas.body = `{"client_id":"other-client","scope":["openid"]}`
+	uaa := httptest.NewServer(sas)
+	defer uaa.Close()
+
+	client := tokenchecker.New(&tokenchecker.TokenCheckerConfig{
+		UaaURL:    uaa.URL,
+		Authority: "bosh.system_metrics.read",
+	})
+
+	Expect(client.CheckToken("fake-token")).To(MatchError("token does not include the bosh.system_metrics.read authority"))
+}
+
+func TestCheckTokenReportsTheErrorFromUAA(t *testing.T) {
+	RegisterTestingT(t)
+
+	sas := newSpyAuthServer(400)
+	sas.body = `{"error":"invalid_token","error_description":"Token has expired"}`
+	uaa := httptest.NewServer(sas)
+	defer uaa.Close()
+
+	client := tokenchecker.New(&tokenchecker.TokenCheckerConfig{
+		UaaURL:    uaa.URL,
+		Authority: "bosh.system_metrics.read",
+	})
+
+	Expect(client.CheckToken("fake-token")).To(MatchError("Received bad check_token status from uaa: 400 invalid_token: Token has expired"))
 }
@@ -71,6 +71,7 @@ func mapHeartbeat(evt event) (*definitions.Event, error) {
 				InstanceId: evt.InstanceId,
 				JobState:   evt.JobState,
 				Metrics:    filterMetricsWithValues(evt),
+				Teams:      evt.Teams,
 			},
 		},
 	}, nil
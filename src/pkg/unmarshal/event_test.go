@@ -58,7 +58,7 @@ func TestHeartbeatConversion(t *testing.T) {
              "percent":"2"
           }
        },
-       "teams":[],
+       "teams":["loggregator-team"],
        "metrics":[
           {
              "name":"system.load.1m",
@@ -111,6 +111,7 @@ func TestHeartbeatConversion(t *testing.T) {
 						},
 					},
 				},
+				Teams: []string{"loggregator-team"},
 			},
 		},
 	}))
@@ -13,6 +13,7 @@ type event struct {
 	InstanceId string    `json:"instance_id,omitempty"`
 	JobState   string    `json:"job_state,omitempty"`
 	Metrics    []*metric `json:"metrics,omitempty"`
+	Teams      []string  `json:"teams,omitempty"`
 
 	// alert
 	CreatedAt int64  `json:"created_at,omitempty"`
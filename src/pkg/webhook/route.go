@@ -0,0 +1,183 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"text/template"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+)
+
+// Route sends the alerts it matches to a webhook. An empty matcher
+// matches every alert.
+type Route struct {
+	// Name identifies the route in its metrics.
+	Name string
+	URL  string
+
+	// Severities are the bosh severities to match, where 1 is alert,
+	// 2 critical, 3 error and 4 warning.
+	Severities []int32
+	// Deployments are deployment names, or patterns such as cf-*.
+	Deployments []string
+	// Title is a regular expression the alert title must match.
+	Title string
+
+	// Template is a Go text/template used to build the request body
+	// from an Alert. Alerts are sent as CloudEvents when it is empty.
+	Template    string
+	ContentType string
+}
+
+// Alert is the data a route template is executed with.
+type Alert struct {
+	ID         string
+	Time       time.Time
+	Deployment string
+	Severity   int32
+	Category   string
+	Title      string
+	Summary    string
+	Source     string
+}
+
+type route struct {
+	Route
+
+	title    *regexp.Regexp
+	template *template.Template
+}
+
+func newRoute(r Route) (*route, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("webhook route for %s must have a name", r.URL)
+	}
+	if r.URL == "" {
+		return nil, fmt.Errorf("webhook route %s must have a url", r.Name)
+	}
+
+	rt := &route{Route: r}
+
+	if r.Title != "" {
+		re, err := regexp.Compile(r.Title)
+		if err != nil {
+			return nil, fmt.Errorf("webhook route %s has an invalid title: %s", r.Name, err)
+		}
+		rt.title = re
+	}
+
+	for _, d := range r.Deployments {
+		if _, err := path.Match(d, ""); err != nil {
+			return nil, fmt.Errorf("webhook route %s has an invalid deployment pattern %q: %s", r.Name, d, err)
+		}
+	}
+
+	if r.Template != "" {
+		t, err := template.New(r.Name).Funcs(template.FuncMap{"json": toJSON}).Parse(r.Template)
+		if err != nil {
+			return nil, fmt.Errorf("webhook route %s has an invalid template: %s", r.Name, err)
+		}
+		rt.template = t
+	}
+
+	return rt, nil
+}
+
+func (r *route) matches(evt *definitions.Event, a *definitions.Alert) bool {
+	if len(r.Severities) > 0 {
+		found := false
+		for _, s := range r.Severities {
+			if s == a.GetSeverity() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Deployments) > 0 {
+		found := false
+		for _, d := range r.Deployments {
+			if ok, _ := path.Match(d, evt.GetDeployment()); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if r.title != nil && !r.title.MatchString(a.GetTitle()) {
+		return false
+	}
+
+	return true
+}
+
+// encode returns the request body and its content type.
+func (r *route) encode(evt *definitions.Event, a *definitions.Alert) ([]byte, string, error) {
+	alert := Alert{
+		ID:         evt.GetId(),
+		Time:       time.Unix(evt.GetTimestamp(), 0).UTC(),
+		Deployment: evt.GetDeployment(),
+		Severity:   a.GetSeverity(),
+		Category:   a.GetCategory(),
+		Title:      a.GetTitle(),
+		Summary:    a.GetSummary(),
+		Source:     a.GetSource(),
+	}
+
+	if r.template == nil {
+		b, err := cloudEvent(alert)
+		return b, "application/cloudevents+json", err
+	}
+
+	var buf bytes.Buffer
+	err := r.template.Execute(&buf, alert)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := r.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	return buf.Bytes(), contentType, nil
+}
+
+// cloudEvent encodes the alert as a CloudEvents 1.0 event
+// in structured JSON mode.
+func cloudEvent(a Alert) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"specversion":     "1.0",
+		"id":              a.ID,
+		"source":          "/deployments/" + a.Deployment,
+		"type":            "org.cloudfoundry.bosh.alert",
+		"subject":         a.Title,
+		"time":            a.Time.Format(time.RFC3339),
+		"datacontenttype": "application/json",
+		"data": map[string]interface{}{
+			"deployment": a.Deployment,
+			"severity":   a.Severity,
+			"category":   a.Category,
+			"title":      a.Title,
+			"summary":    a.Summary,
+			"source":     a.Source,
+		},
+	})
+}
+
+// toJSON lets templates embed values in JSON payloads,
+// for example {"text": {{json .Summary}}}.
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
@@ -0,0 +1,220 @@
+package webhook
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+)
+
+var (
+	webhookDelivered *expvar.Map
+	webhookFailed    *expvar.Map
+	webhookDropped   *expvar.Map
+	webhookRetries   *expvar.Map
+)
+
+func init() {
+	webhookDelivered = expvar.NewMap("webhook.delivered")
+	webhookFailed = expvar.NewMap("webhook.failed")
+	webhookDropped = expvar.NewMap("webhook.dropped")
+	webhookRetries = expvar.NewMap("webhook.retries")
+}
+
+// Sink posts alerts to the webhooks of the routes that match them.
+// Each route has its own bounded outbox so a slow webhook only delays
+// its own alerts. Alerts that do not fit in a route's outbox are
+// dropped for that route.
+type Sink struct {
+	routes []*outbox
+	client *http.Client
+
+	outboxSize int
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+type outbox struct {
+	*route
+	alerts chan *definitions.Event
+}
+
+type SinkOpt func(*Sink)
+
+// WithOutboxSize sets how many alerts each route queues
+// while waiting to be delivered.
+func WithOutboxSize(n int) SinkOpt {
+	return func(s *Sink) {
+		s.outboxSize = n
+	}
+}
+
+// WithRetries sets how many times a failed delivery is retried. The
+// wait between attempts starts at backoff and doubles each attempt.
+func WithRetries(n int, backoff time.Duration) SinkOpt {
+	return func(s *Sink) {
+		s.retries = n
+		s.backoff = backoff
+	}
+}
+
+// WithHTTPClient sets the client used to deliver alerts.
+func WithHTTPClient(c *http.Client) SinkOpt {
+	return func(s *Sink) {
+		s.client = c
+	}
+}
+
+// New returns a Sink for the given routes. It returns an error if a
+// route is invalid.
+func New(routes []Route, opts ...SinkOpt) (*Sink, error) {
+	s := &Sink{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		outboxSize: 1000,
+		retries:    8,
+		backoff:    time.Second,
+		maxBackoff: 5 * time.Minute,
+	}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	for _, r := range routes {
+		rt, err := newRoute(r)
+		if err != nil {
+			return nil, err
+		}
+
+		s.routes = append(s.routes, &outbox{
+			route:  rt,
+			alerts: make(chan *definitions.Event, s.outboxSize),
+		})
+	}
+
+	return s, nil
+}
+
+// Write queues the alert for every route it matches without blocking.
+func (s *Sink) Write(evt *definitions.Event) {
+	a := evt.GetAlert()
+	if a == nil {
+		return
+	}
+
+	for _, o := range s.routes {
+		if !o.matches(evt, a) {
+			continue
+		}
+
+		select {
+		case o.alerts <- evt:
+		default:
+			webhookDropped.Add(o.Name, 1)
+		}
+	}
+}
+
+// Start spins up a go routine per route that delivers its alerts.
+// It returns a shutdown function that makes one attempt to deliver
+// the alerts still queued and blocks until it is done.
+func (s *Sink) Start() func() {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for _, o := range s.routes {
+		wg.Add(1)
+		go func(o *outbox) {
+			defer wg.Done()
+
+			for {
+				select {
+				case evt := <-o.alerts:
+					s.deliver(o, evt, stop)
+				case <-stop:
+					for {
+						select {
+						case evt := <-o.alerts:
+							s.deliver(o, evt, stop)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}(o)
+	}
+
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
+
+// deliver posts the alert until it succeeds, fails permanently or runs
+// out of retries. Retries stop once the sink is shutting down.
+func (s *Sink) deliver(o *outbox, evt *definitions.Event, stop chan struct{}) {
+	body, contentType, err := o.encode(evt, evt.GetAlert())
+	if err != nil {
+		log.Printf("unable to encode alert for webhook route %s: %s\n", o.Name, err)
+		webhookFailed.Add(o.Name, 1)
+		return
+	}
+
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(o.URL, body, contentType)
+		if err == nil {
+			webhookDelivered.Add(o.Name, 1)
+			return
+		}
+
+		if !retry || attempt >= s.retries {
+			log.Printf("unable to deliver alert %s to webhook route %s: %s\n", evt.GetId(), o.Name, err)
+			webhookFailed.Add(o.Name, 1)
+			return
+		}
+
+		select {
+		case <-stop:
+			log.Printf("unable to deliver alert %s to webhook route %s while shutting down: %s\n", evt.GetId(), o.Name, err)
+			webhookFailed.Add(o.Name, 1)
+			return
+		case <-time.After(backoff):
+		}
+		webhookRetries.Add(o.Name, 1)
+
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+// post sends the body to url. It reports whether a failed
+// delivery is worth retrying.
+func (s *Sink) post(url string, body []byte, contentType string) (bool, error) {
+	resp, err := s.client.Post(url, contentType, bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("webhook responded with %s", resp.Status)
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+
+	return retry, err
+}
@@ -0,0 +1,234 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-server/pkg/webhook"
+	. "github.com/onsi/gomega"
+)
+
+func TestSinkPostsAlertsAsCloudEvents(t *testing.T) {
+	RegisterTestingT(t)
+
+	hook := newFakeWebhook()
+	defer hook.Close()
+
+	sink, err := webhook.New([]webhook.Route{{Name: "all", URL: hook.URL}})
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(alert("cf", 2, "SSH Access Denied"))
+	sink.Write(heartbeat)
+
+	var req *hookRequest
+	Eventually(hook.requests).Should(Receive(&req))
+	Expect(req.contentType).To(Equal("application/cloudevents+json"))
+
+	var ce map[string]interface{}
+	Expect(json.Unmarshal(req.body, &ce)).To(Succeed())
+	Expect(ce).To(HaveKeyWithValue("specversion", "1.0"))
+	Expect(ce).To(HaveKeyWithValue("id", "93eb25a4-9348-4232-6f71-69e1e01081d7"))
+	Expect(ce).To(HaveKeyWithValue("source", "/deployments/cf"))
+	Expect(ce).To(HaveKeyWithValue("type", "org.cloudfoundry.bosh.alert"))
+	Expect(ce).To(HaveKeyWithValue("time", "2017-07-06T16:39:22Z"))
+	Expect(ce["data"]).To(HaveKeyWithValue("summary", "Failed password for vcap"))
+	Expect(ce["data"]).To(HaveKeyWithValue("severity", BeNumerically("==", 2)))
+
+	Consistently(hook.requests).ShouldNot(Receive())
+}
+
+func TestSinkPostsAlertsThroughATemplate(t *testing.T) {
+	RegisterTestingT(t)
+
+	hook := newFakeWebhook()
+	defer hook.Close()
+
+	sink, err := webhook.New([]webhook.Route{{
+		Name:     "slack",
+		URL:      hook.URL,
+		Template: `{"text": {{json (printf "[%s] %s" .Deployment .Title)}}}`,
+	}})
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(alert("cf", 2, `Process "nats" is not running`))
+
+	var req *hookRequest
+	Eventually(hook.requests).Should(Receive(&req))
+	Expect(req.contentType).To(Equal("application/json"))
+	Expect(string(req.body)).To(MatchJSON(`{"text": "[cf] Process \"nats\" is not running"}`))
+}
+
+func TestSinkRoutesAlertsBySeverityDeploymentAndTitle(t *testing.T) {
+	RegisterTestingT(t)
+
+	critical := newFakeWebhook()
+	defer critical.Close()
+	cf := newFakeWebhook()
+	defer cf.Close()
+	ssh := newFakeWebhook()
+	defer ssh.Close()
+
+	sink, err := webhook.New([]webhook.Route{
+		{Name: "critical", URL: critical.URL, Severities: []int32{1, 2}},
+		{Name: "cf", URL: cf.URL, Deployments: []string{"cf", "cf-*"}},
+		{Name: "ssh", URL: ssh.URL, Title: "^SSH"},
+	})
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(alert("cf-mysql", 4, "SSH Access Denied"))
+	sink.Write(alert("concourse", 1, "Process is not running"))
+
+	Eventually(cf.requests).Should(HaveLen(1))
+	Eventually(ssh.requests).Should(HaveLen(1))
+	Eventually(critical.requests).Should(HaveLen(1))
+	Consistently(cf.requests).Should(HaveLen(1))
+	Consistently(ssh.requests).Should(HaveLen(1))
+	Consistently(critical.requests).Should(HaveLen(1))
+}
+
+func TestSinkRetriesFailedDeliveries(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	hook := newFakeWebhook(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer hook.Close()
+
+	sink, err := webhook.New(
+		[]webhook.Route{{Name: "all", URL: hook.URL}},
+		webhook.WithRetries(5, time.Millisecond),
+	)
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(alert("cf", 2, "SSH Access Denied"))
+
+	Eventually(hook.requests).Should(HaveLen(3))
+	Consistently(hook.requests).Should(HaveLen(3))
+}
+
+func TestSinkDoesNotRetryRejectedDeliveries(t *testing.T) {
+	RegisterTestingT(t)
+	log.SetOutput(ioutil.Discard)
+
+	hook := newFakeWebhook(http.StatusBadRequest)
+	defer hook.Close()
+
+	sink, err := webhook.New(
+		[]webhook.Route{{Name: "all", URL: hook.URL}},
+		webhook.WithRetries(5, time.Millisecond),
+	)
+	Expect(err).ToNot(HaveOccurred())
+	defer sink.Start()()
+
+	sink.Write(alert("cf", 2, "SSH Access Denied"))
+
+	Eventually(hook.requests).Should(HaveLen(1))
+	Consistently(hook.requests).Should(HaveLen(1))
+}
+
+func TestSinkDropsAlertsThatDoNotFitInTheOutbox(t *testing.T) {
+	RegisterTestingT(t)
+
+	hook := newFakeWebhook()
+	defer hook.Close()
+
+	sink, err := webhook.New([]webhook.Route{{Name: "all", URL: hook.URL}}, webhook.WithOutboxSize(2))
+	Expect(err).ToNot(HaveOccurred())
+
+	for i := 0; i < 5; i++ {
+		sink.Write(alert("cf", 2, "SSH Access Denied"))
+	}
+	sink.Start()()
+
+	Expect(hook.requests).To(HaveLen(2))
+}
+
+func TestNewRejectsInvalidRoutes(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, r := range []webhook.Route{
+		{URL: "http://example.com"},
+		{Name: "no-url"},
+		{Name: "title", URL: "http://example.com", Title: "("},
+		{Name: "deployment", URL: "http://example.com", Deployments: []string{"["}},
+		{Name: "template", URL: "http://example.com", Template: "{{.Title"},
+	} {
+		_, err := webhook.New([]webhook.Route{r})
+		Expect(err).To(HaveOccurred())
+	}
+}
+
+type hookRequest struct {
+	contentType string
+	body        []byte
+}
+
+type fakeWebhook struct {
+	*httptest.Server
+	requests chan *hookRequest
+
+	mu       sync.Mutex
+	statuses []int
+}
+
+// newFakeWebhook returns a webhook that responds with the given
+// statuses, in order, and then with 200 OK.
+func newFakeWebhook(statuses ...int) *fakeWebhook {
+	h := &fakeWebhook{
+		requests: make(chan *hookRequest, 100),
+		statuses: statuses,
+	}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		h.requests <- &hookRequest{
+			contentType: r.Header.Get("Content-Type"),
+			body:        body,
+		}
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if len(h.statuses) > 0 {
+			w.WriteHeader(h.statuses[0])
+			h.statuses = h.statuses[1:]
+		}
+	}))
+
+	return h
+}
+
+func alert(deployment string, severity int32, title string) *definitions.Event {
+	return &definitions.Event{
+		Id:         "93eb25a4-9348-4232-6f71-69e1e01081d7",
+		Timestamp:  1499359162,
+		Deployment: deployment,
+		Message: &definitions.Event_Alert{
+			Alert: &definitions.Alert{
+				Severity: severity,
+				Title:    title,
+				Summary:  "Failed password for vcap",
+			},
+		},
+	}
+}
+
+var heartbeat = &definitions.Event{
+	Id:         "55b68400-f984-4f76-b341-cf849e07d4f9",
+	Timestamp:  1499293724,
+	Deployment: "cf",
+	Message: &definitions.Event_Heartbeat{
+		Heartbeat: &definitions.Heartbeat{
+			Job:        "consul",
+			InstanceId: "6f60a3ce",
+		},
+	},
+}